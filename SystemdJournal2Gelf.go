@@ -2,280 +2,816 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/DECK36/go-gelf/gelf"
-	"io"
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+	"net"
 	"os"
-	"os/exec"
-	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
-	"sync"
 )
 
-/*
-	http://www.freedesktop.org/software/systemd/man/systemd.journal-fields.html
-	https://github.com/Graylog2/graylog2-docs/wiki/GELF
-*/
-type SystemdJournalEntry struct {
-	Cursor                         string `json:"__CURSOR"`
-	Realtime_timestamp             int64  `json:"__REALTIME_TIMESTAMP,string"`
-	Monotonic_timestamp            string `json:"__MONOTONIC_TIMESTAMP"`
-	Boot_id                        string `json:"_BOOT_ID"`
-	Transport                      string `json:"_TRANSPORT"`
-	Priority                       int32  `json:"PRIORITY,string"`
-	Syslog_facility                string `json:"SYSLOG_FACILITY"`
-	Syslog_identifier              string `json:"SYSLOG_IDENTIFIER"`
-	Message                        string `json:"MESSAGE"`
-	Pid                            string `json:"_PID"`
-	Uid                            string `json:"_UID"`
-	Gid                            string `json:"_GID"`
-	Comm                           string `json:"_COMM"`
-	Exe                            string `json:"_EXE"`
-	Cmdline                        string `json:"_CMDLINE"`
-	Systemd_cgroup                 string `json:"_SYSTEMD_CGROUP"`
-	Systemd_session                string `json:"_SYSTEMD_SESSION"`
-	Systemd_owner_uid              string `json:"_SYSTEMD_OWNER_UID"`
-	Systemd_unit                   string `json:"_SYSTEMD_UNIT"`
-	Source_realtime_timestamp      string `json:"_SOURCE_REALTIME_TIMESTAMP"`
-	Machine_id                     string `json:"_MACHINE_ID"`
-	Hostname                       string `json:"_HOSTNAME"`
-	Logger                         string `json:"LOGGER"`
-	EventId                        string `json:"EVENTID"`
-	Exception                      string `json:"EXCEPTION"`
-	Exception_type                 string `json:"EXCEPTION_TYPE"`
-	Exception_Stacktrace           string `json:"EXCEPTION_STACKTRACE"`
-	Inner_exception                string `json:"INNEREXCEPTION"`
-	Inner_exception_type           string `json:"INNEREXCEPTION_TYPE"`
-	Inner_exception_Stacktrace     string `json:"INNEREXCEPTION_STACKTRACE"`
-	Status_code                    string `json:"STATUSCODE"`
-	Query_string                   string `json:"QUERYSTRING"`
-	Member_id                      string `json:"MEMBERID"`
-	Correlation_id                 string `json:"CORRELATIONID"`
-	Request_path                   string `json:"REQUESTPATH"`
-	Request_id                     string `json:"REQUESTID"`
-	FullMessage                    string
-}
-
-// Strip date from message-content. Use named subpatterns to override other fields
-var messageReplace = map[string]*regexp.Regexp{
-	"*":         regexp.MustCompile("^20[0-9][0-9][/\\-][01][0-9][/\\-][0123][0-9] [0-2]?[0-9]:[0-5][0-9]:[0-5][0-9][,0-9]{0-3} "),
-	"nginx":     regexp.MustCompile("\\[(?P<Priority>[a-z]+)\\] "),
-	"java":      regexp.MustCompile("(?P<Priority>[A-Z]+): "),
-	"mysqld":    regexp.MustCompile("^[0-9]+ \\[(?P<Priority>[A-Z][a-z]+)\\] "),
-	"searchd":   regexp.MustCompile("^\\[([A-Z][a-z]{2} ){2} [0-9]+ [0-2][0-9]:[0-5][0-9]:[0-5][0-9]\\.[0-9]{3} 20[0-9][0-9]\\] \\[[ 0-9]+\\] "),
-	"jenkins":   regexp.MustCompile("^[A-Z][a-z]{2} [01][0-9], 20[0-9][0-9] [0-2]?[0-9]:[0-5][0-9]:[0-5][0-9] [AP]M "),
-	"php-fpm":   regexp.MustCompile("^pool [a-z_0-9\\[\\]\\-]+: "),
-	"syncthing": regexp.MustCompile("^\\[[0-9A-Z]{5}\\] [0-2][0-9]:[0-5][0-9]:[0-5][0-9] (?P<Priority>INFO): "),
-}
+// The entry type of the library, under its old name
+type SystemdJournalEntry = journal2gelf.SystemdJournalEntry
 
-var priorities = map[string]int32{
-	"emergency": 0,
-	"emerg":     0,
-	"alert":     1,
-	"critical":  2,
-	"crit":      2,
-	"error":     3,
-	"err":       3,
-	"warning":   4,
-	"warn":      4,
-	"notice":    5,
-	"info":      6,
-	"debug":     7,
-}
+var (
+	writer      messageWriter
+	allowed     *allowlist
+	exporter    *journalExporter
+	spooler     *spool
+	archiver    *s3Archive
+	fallback    *fallbackFile
+	statuses    *statusTracker
+	resources   *resourceStats
+	ooms        *oomCorrelator
+	security    messageWriter
+	securityOut *outputQueue
+	exportOut   *outputQueue
+	unitLimits  *unitLimiter
+	jobs        *jobTracker
+	checkpoints *checkpoint
+	leaderLock  *os.File
+
+	excludeFields  stringList
+	internalFields = flag.Bool("internal-fields", false, "Also forward journald's internal fields, like __MONOTONIC_TIMESTAMP")
+	mergeMaxLines  = flag.Int("merge-max-lines", 500, "Maximum number of consecutive lines merged into one message")
+	messageIds     = flag.Bool("message-id", false, "Add a message_id derived from the machine id and journal cursor, which stays the same when an entry is sent again")
+	unitMetadata   = flag.Bool("unit-metadata", false, "Add the description, slice, unit file and active state of the unit, as reported by systemd")
+	resourceFlag   = flag.Bool("resource-stats", false, "Add the memory use of the process and CPU pressure of its cgroup to bursts of errors of a unit")
+	oomFlag        = flag.Bool("oom-events", false, "Add the killed process, its cgroup and unit, and cursors of the unit's last entries to OOM killer messages")
+	securityFlag   = flag.Bool("security-events", false, "Recognize logins, authentication failures, sudo and sessions, and add actor, target, action, outcome and source_ip")
+	securityStream = flag.String("security-stream", "security", "Value of the stream field of security events, to route them to a stream in Graylog")
+	securityServer = flag.String("security-server", "", "Send security events to these servers instead, as a comma separated list, implies --security-events")
+	unitRateLimit  = flag.String("unit-rate-limit", "", "Maximum number of entries per unit, like 500/s, 100/m or 1000/h, unlimited by default")
+	unitRateBurst  = flag.Int("unit-rate-burst", 0, "Number of entries a unit may log at once before --unit-rate-limit applies, a second worth by default")
+	unitRateEvery  = flag.Duration("unit-rate-interval", time.Minute, "How often to send the number of entries dropped by --unit-rate-limit")
+	jobEvents      = flag.Bool("job-events", false, "Send the outcome, duration and exit status of cron jobs and services which finish, like those started by timers")
+	configPath     = flag.String("config", "", "JSON file with profiles of options, the command line takes precedence")
+	profileName    = flag.String("profile", "", "Profile of the config file to use, instead of the one it selects")
+	parserList     = flag.String("parse", "", "Add fields from messages of well known programs, as a comma separated list of: netfilter, dnsmasq, resolved and named")
+	readStdin      = flag.Bool("stdin", false, "Read entries from stdin as JSON or in the export format, instead of running journalctl")
+	noInventory    = flag.Bool("no-inventory", false, "Don't send a message describing this host on startup")
+	noCollapse     = flag.Bool("no-collapse", false, "Send every repeat of a message, instead of one message with repeat_count")
+	collapseEvery  = flag.Duration("collapse-interval", 5*time.Second, "Send collapsed repeats at least this often")
+	mergeMaxBytes  = flag.Int("merge-max-bytes", 32*1024, "Maximum size of the merged message in bytes")
+	downgradeRules stringList
+	statusRules    stringList
+	maxMessageSize int
+	parseOptions   = journal2gelf.DefaultParseOptions()
+	converter      = journal2gelf.NewConverter()
+	fieldFlags     stringList
+	hostnameFlag   = flag.String("hostname", "", "Host name to send instead of _HOSTNAME, may refer to journal fields like ${MACHINE_ID}")
+	retryBase      = flag.Duration("retry-base", 100*time.Millisecond, "Delay before retrying a message when no server accepted it, doubled on every attempt")
+	retryMax       = flag.Duration("retry-max", SLEEP_AFTER_ERROR, "Maximum delay between retries of a message")
+	retryTimeout   = flag.Duration("retry-timeout", 5*time.Minute, "Drop a message when it couldn't be sent within this time, 0 retries forever")
+	noRestart      = flag.Bool("no-restart", false, "Exit when journalctl exits while following, instead of restarting it")
+	restartLimit   = flag.Int("max-restarts", 5, "Give up when journalctl has to be restarted more often than this per minute")
+	hostnameFrom   = flag.String("hostname-from", "", "Take the host name from env:NAME or file:/path")
+	statusInterval = flag.Duration("status-change-interval", 5*time.Minute, "How often to send a summary of messages suppressed by --status-change")
+	timezoneFlags  stringList
+	layoutFlags    stringList
+	dryRun         = flag.Bool("dry-run", false, "Print messages as JSON instead of sending them, the server argument is left out")
+	dryRunPretty   = flag.Bool("pretty", false, "Indent the JSON printed with --dry-run")
+	compression    = flag.String("compression", "gzip", "Compression of GELF messages: gzip, zlib or none")
+	compressLevel  = flag.Int("compression-level", 1, "Compression level from 0 to 9, higher is smaller but uses more CPU")
+	chunkSize      = flag.Int("chunk-size", 1420, "Maximum size of a UDP datagram, larger messages are sent in chunks")
+	deliveryMode   = flag.String("delivery-mode", DELIVERY_FAILOVER, "With multiple servers, send to the first reachable one (failover) or to all")
+	filterPriority = flag.String("min-priority", "", "Drop entries less severe than this priority, by name or number")
+	dropMessageRes stringList
+	rateExempt     stringList
+	remoteRules    = flag.String("remote-rules", "", "HTTPS URL of a JSON rule bundle, signed with minisign, the signature is fetched from the URL with .minisig appended")
+	remoteKey      = flag.String("remote-key", "", "Minisign public key of the rule bundle, or a file holding it")
+	remoteCache    = flag.String("remote-cache", "/var/cache/SystemdJournal2Gelf/rules.json", "Where the last verified rule bundle is kept, used when the URL can't be reached")
+	remoteEvery    = flag.Duration("remote-interval", 5*time.Minute, "How often to check the rule bundle for changes")
+	socketPath     = flag.String("socket", "", "Unix socket other programs on the host send entries to, as lines of journalctl --output=json")
+	httpSocket     = flag.String("http-socket", "", "Unix socket applications POST JSON records to, on /entries")
+	auditPath      = flag.String("audit-log", "", "Append counts of read, filtered and sent entries per minute to this file, for the audit subcommand")
+	auditEvery     = flag.Duration("audit-interval", time.Minute, "How often to append to the audit log")
+	auditGraylog   = flag.String("audit-graylog", "", "Graylog URL the audit subcommand counts the messages of the range with")
+	auditToken     = flag.String("audit-graylog-token", "", "Graylog access token for --audit-graylog")
+	auditQuery     = flag.String("audit-graylog-query", "", "Graylog search matching the messages of this host, source:hostname by default")
+	multiValue     = flag.String("multi-value", "join", "How to send fields set more than once: join, first, last or index to add the other values as FIELD_1 and so on")
+	multiValueSep  = flag.String("multi-value-separator", ", ", "Separator of the values of fields set more than once, with --multi-value=join")
+	fieldConflicts = flag.String("field-conflicts", "overwrite", "When a JSON message has a key the entry has a field for: overwrite the field, or suffix to send it as KEY_message_json")
+	controlSocket  = flag.String("control-socket", "", "Unix socket serving the pipeline of the running process, which pipeline show prints")
+	pipelineFormat = flag.String("pipeline-format", "json", "Format pipeline show prints the pipeline in: json, or dot for Graphviz")
+	outputBuffer   = flag.Int("output-buffer", 10000, "Messages buffered per output which mustn't hold up the others, like the security server and --export")
+	canaryPercent  = flag.Int("canary-percent", 0, "Apply a new rule bundle to this percentage of entries first, the others keep the previous bundle")
+	canaryFor      = flag.Duration("canary-duration", time.Hour, "How long a new rule bundle is only applied to --canary-percent of entries")
+	rewriteFile    = flag.String("rewrite-rules", "", "JSON file with message rewrite rules by identifier, merged over the built-in rules")
+	archiveOut     = flag.String("out", "", "Archive written by the export subcommand, gzip compressed when ending in .gz, zstd when ending in .zst, Parquet when ending in .parquet")
+	exportDest     = flag.String("export", "", "Also write entries in journal export format to this file, or socket as tcp:host:port or unix:/path")
+	metricsListen  = flag.String("metrics-listen", "", "Address to serve Prometheus metrics on, like :9101")
+	rateLimit      = flag.Int("rate-limit", 0, "Maximum number of messages sent per second, unlimited by default")
+	senderCount    = flag.Int("senders", 1, "Number of goroutines sending messages, more than one doesn't keep the order")
+	spoolDir       = flag.String("spool-dir", "", "Directory to store messages in while the server is unreachable")
+	spoolMaxSize   = flag.String("spool-max-size", "512M", "Maximum size of the spool, the oldest messages are dropped when full")
+	fallbackPath   = flag.String("fallback-file", "", "File to keep severe messages in which would otherwise be dropped, sent again when a server is reachable")
+	fallbackSize   = flag.String("fallback-max-size", "64M", "Maximum size of the fallback file")
+	checkpointPath = flag.String("checkpoint", "", "File keeping the cursor of the last entry sent, reading continues after it on the next start")
+	standbyLock    = flag.String("standby-lock", "", "Lock file shared with a standby instance, only the instance holding it ships and the other takes over from --checkpoint")
+	backfillBudget = flag.Duration("backfill-budget", 0, "Stop reading after this long, like 30m, and exit once everything read is sent; the next run continues from --checkpoint")
+	immediatePrio  = flag.String("immediate-priority", "crit", "Send messages this severe or more right away, without waiting to merge lines, the rate limit or buffers; none to disable")
+	fallbackLevel  = flag.String("fallback-priority", "err", "Only keep messages of this priority or more severe in the fallback file")
+	spoolMaxAge    = flag.Duration("spool-max-age", 0, "Skip messages spooled longer ago than this, like 24h, they're kept until sent by default")
+	s3Url          = flag.String("s3-url", "", "Also archive messages to S3 compatible storage, as https://host/bucket/prefix")
+	s3Region       = flag.String("s3-region", "us-east-1", "Region of the S3 bucket")
+	s3Key          = flag.String("s3-key", "{host}/{date}/{unit}", "Template of the S3 object names, with {host}, {unit}, {identifier}, {date}, {year}, {month}, {day} and {hour}")
+	s3Format       = flag.String("s3-format", "ndjson", "Format of the S3 objects, gzip compressed ndjson or parquet")
+	s3MaxSize      = flag.String("s3-max-size", "64M", "Upload an S3 object when it reaches this size before compression")
+	s3MaxAge       = flag.Duration("s3-max-age", 5*time.Minute, "Upload an S3 object this long after its first message")
+	splitRequests  = flag.Bool("decompose-requests", false, "Add the path, route and query parameter count of request URLs, and the browser and OS of user agents")
+	normalizeFile  = flag.String("normalize-rules", "", "JSON file with normalization rules for the values of additional fields")
+	maxLineSize    = flag.String("max-line-size", "1M", "Maximum size of a journal entry as read from journalctl, longer entries are skipped")
+	maxMessageFlag = flag.String("max-message-size", "1M", "Maximum size of a GELF message, the full message is truncated to fit")
+	allowlistFile  = flag.String("allowlist", "", "File with units and identifiers to forward, one glob pattern per line")
+)
 
-func (this *SystemdJournalEntry) toGelf() *gelf.Message {
-	var extra = map[string]interface{}{
-		"Boot_id":                     this.Boot_id,
-		"Pid":                         this.Pid,
-		"Uid":                         this.Uid,
-		"Logger":                      this.Logger,
-		"EventId":                     this.EventId,
-		"Exception":                   this.Exception,
-		"Exception_Type":              this.Exception_type,
-		"Exception_Stacktrace":        this.Exception_Stacktrace,
-		"Inner_Exception":             this.Inner_exception,
-		"Inner_Exception_Type":        this.Inner_exception_type,
-		"Inner_Exception_Stacktrace":  this.Inner_exception_Stacktrace,
-		"Request_Id":                  this.Request_id,
-		"Request_Path":                this.Request_path,
-		"Status_Code":                 this.Status_code,
-		"Query_String":                this.Query_string,
-		"Correlation_Id":              this.Correlation_id,
-		"Member_Id":                   this.Member_id,
-	}
-
-	// php-fpm refuses to fill identifier
-	facility := this.Syslog_identifier
-	if "" == facility {
-		facility = this.Comm
-	}
-
-	if this.isJsonMessage() {
-		if err := json.Unmarshal([]byte(this.Message), &extra); err == nil {
-			if m, ok := extra["Message"]; ok {
-				this.Message = m.(string)
-				delete(extra, "Message")
-			}
-
-			if f, ok := extra["FullMessage"]; ok {
-				this.FullMessage = f.(string)
-				delete(extra, "FullMessage")
-			}
-		}
-	} else if -1 != strings.Index(this.Message, "\n") {
-		this.FullMessage = this.Message
-		this.Message = strings.Split(this.Message, "\n")[0]
-	}
-
-	return &gelf.Message{
-		Version:  "1.1",
-		Host:     this.Hostname,
-		Short:    this.Message,
-		Full:     this.FullMessage,
-		TimeUnix: float64(this.Realtime_timestamp) / 1000 / 1000,
-		Level:    this.Priority,
-		Facility: facility,
-		Extra:    extra,
+func init() {
+	flag.Var(&excludeFields, "exclude-field", "Journal field like _PID, or field of the GELF message like Pid, to leave out of the message, may be repeated")
+	flag.Var(&excludeUnits, "exclude-unit", "Drop entries from units matching this glob, may be repeated")
+	flag.Var(&excludeIdentifiers, "exclude-identifier", "Drop entries with a syslog identifier matching this glob, may be repeated")
+	flag.Var(&dropMessageRes, "drop-message-regex", "Drop entries with a message matching this regex, may be repeated")
+	flag.Var(&timezoneFlags, "timezone", "Timezone of timestamps in messages, as identifier=Europe/Amsterdam where * matches all identifiers, may be repeated")
+	flag.Var(&layoutFlags, "timestamp-layout", "Go time layout of the Timestamp subpattern of a rewrite rule, as identifier=layout, may be repeated")
+	flag.Var(&statusRules, "status-change", "Only send matching messages when their Status subpattern changes, as name:regex, may be repeated")
+	flag.Var(&fieldFlags, "field", "Field to add to every message as key=value, may refer to journal fields like ${MACHINE_ID}, may be repeated")
+	flag.Var(&rateExempt, "rate-limit-exempt-unit", "Unit or identifier not limited by --unit-rate-limit, may be a glob and repeated")
+	flag.Var(&downgradeRules, "downgrade", "Downgrade messages to info, as identifier:regex where * matches all identifiers, may be repeated")
+
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Pass server:12201 as first argument and append journalctl parameters to use")
+		fmt.Fprintln(os.Stderr, "Multiple servers can be passed as a comma separated list, use - or --dry-run to print messages instead")
+		fmt.Fprintln(os.Stderr, "Use export --out=archive.ndjson.gz instead of a server to write them to a file")
+		flag.PrintDefaults()
 	}
 }
 
-func (this *SystemdJournalEntry) process() {
-	// Replace generic timestamp
-	this.Message = messageReplace["*"].ReplaceAllString(this.Message, "")
+const SLEEP_AFTER_ERROR = journal2gelf.SLEEP_AFTER_ERROR
+
+func main() {
+	if len(os.Args) > 1 && "receive" == os.Args[1] {
+		receive(os.Args[2:])
+		return
+	}
 
-	re := messageReplace[ this.Syslog_identifier ]
-	if nil == re {
-		re = messageReplace[ this.Comm ]
+	if len(os.Args) > 1 && "config" == os.Args[1] {
+		os.Exit(configCommand(os.Args[2:]))
 	}
 
-	if nil == re {
-		return
+	if len(os.Args) > 1 && "diff-rules" == os.Args[1] {
+		os.Exit(diffRules(os.Args[2:]))
 	}
 
-	m := re.FindStringSubmatch(this.Message)
-	if m == nil {
-		return
+	// Export runs the same processing, but writes the messages to an archive. Audit only applies the filters
+	archive := len(os.Args) > 1 && "export" == os.Args[1]
+	auditing := len(os.Args) > 1 && "audit" == os.Args[1]
+	if archive || auditing {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
 	}
 
-	// Store subpatterns in fields
-	for idx, key := range re.SubexpNames() {
-		if "Priority" == key {
-			this.Priority = priorities[strings.ToLower(m[idx])]
+	// Pipeline show sets up the same processing to describe it, nothing is read or sent
+	showing := len(os.Args) > 1 && "pipeline" == os.Args[1]
+	if showing {
+		if len(os.Args) < 3 || "show" != os.Args[2] {
+			fmt.Fprintln(os.Stderr, "Usage: pipeline show [--control-socket=path] [--pipeline-format=dot] [options] [server]")
+			os.Exit(2)
 		}
+		os.Args = append(os.Args[:1], os.Args[3:]...)
 	}
 
-	this.Message = re.ReplaceAllString(this.Message, "")
-}
+	// Generate dashboards only looks at which features the options enable
+	generating := len(os.Args) > 1 && "generate" == os.Args[1]
+	if generating {
+		if len(os.Args) < 3 || "dashboards" != os.Args[2] {
+			fmt.Fprintln(os.Stderr, "Usage: generate dashboards [options]")
+			os.Exit(2)
+		}
+		os.Args = append(os.Args[:1], os.Args[3:]...)
+	}
 
-func (this *SystemdJournalEntry) send() {
-	message := this.toGelf()
+	flagArgs, args := splitArgs(os.Args[1:])
+	flag.CommandLine.Parse(flagArgs)
 
-	if err := writer.WriteMessage(message); err != nil {
-		/*
-			UDP is nonblocking, but the os stores an error which GO will return on the next call.
-			This means we've already lost a message, but can keep retrying the current one. Sleep to make this less obtrusive
-		*/
-		fmt.Fprintln(os.Stderr, "Processing paused because of: " +err.Error())
-		time.Sleep(SLEEP_AFTER_ERROR)
-		this.send()
+	if len(args) > 0 && "-" == args[0] {
+		*dryRun = true
+		args = args[1:]
 	}
-}
-
-func (this *SystemdJournalEntry) isJsonMessage() bool {
-	return len(this.Message) > 64 && this.Message[0] == '{' && this.Message[1] == '"'
-}
 
-var (
-	pending struct{
-		sync.RWMutex
-		entry *SystemdJournalEntry
+	if "" != *configPath {
+		var err error
+		if args, err = applyConfig(*configPath, *profileName, args, archive || auditing || generating); err != nil {
+			fmt.Fprintf(os.Stderr, "While reading config: %s\n", err)
+			os.Exit(1)
+		}
 	}
-	writer       *gelf.Writer
-)
 
-const (
-	WRITE_INTERVAL             = 50 * time.Millisecond
-	SAMESOURCE_TIME_DIFFERENCE = 100 * 1000
-	SLEEP_AFTER_ERROR          = 15 * time.Second
-)
+	levelSet := false
+	flag.Visit(func(f *flag.Flag) {
+		levelSet = levelSet || "compression-level" == f.Name
+	})
 
-func main() {
-	if len(os.Args) < 3 {
-		fmt.Fprintln(os.Stderr, "Pass server:12201 as first argument and append journalctl parameters to use")
+	if err := setupGelfOptions(*compression, *compressLevel, levelSet, *chunkSize); err != nil {
+		fmt.Fprintf(os.Stderr, "While setting up GELF: %s\n", err)
 		os.Exit(1)
 	}
 
-	if w, err := gelf.NewWriter(os.Args[1]); err != nil {
+	var servers string
+	if auditing || generating {
+		// Nothing is sent
+	} else if showing {
+		if !*dryRun && len(args) > 0 {
+			servers, args = args[0], args[1:]
+		}
+	} else if archive {
+		if "" == *archiveOut {
+			fmt.Fprintln(os.Stderr, "Pass the archive to write with --out")
+			os.Exit(1)
+		}
+
+		if w, err := newArchiveWriter(*archiveOut); err != nil {
+			fmt.Fprintf(os.Stderr, "While creating archive: %s\n", err)
+			os.Exit(1)
+		} else {
+			writer = w
+		}
+	} else if *dryRun {
+		writer = &dryRunWriter{out: os.Stdout, pretty: *dryRunPretty}
+	} else if len(args) < 2 && !(*readStdin && 1 == len(args)) {
+		flag.Usage()
+		os.Exit(1)
+	} else if w, err := newDelivery(args[0], *deliveryMode); err != nil {
 		fmt.Fprintf(os.Stderr, "While connecting to Graylog server: %s\n", err)
 		os.Exit(1)
 	} else {
 		writer = w
+		servers, args = args[0], args[1:]
+	}
+
+	if "" != *securityServer {
+		*securityFlag = true
+	}
+
+	// Printed and archived messages include the security events
+	if "" != *securityServer && !archive && !auditing && !showing && !generating && !*dryRun {
+		if w, err := newDelivery(*securityServer, *deliveryMode); err != nil {
+			fmt.Fprintf(os.Stderr, "While connecting to security server: %s\n", err)
+			os.Exit(1)
+		} else {
+			security = w
+			securityOut = newOutputQueue("security", *outputBuffer)
+		}
+	}
+
+	if *readStdin && len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "journalctl arguments can't be used with --stdin: %s\n", strings.Join(args, " "))
+		os.Exit(1)
+	}
+
+	if mode, err := journal2gelf.ParseMultiValueMode(*multiValue); err != nil {
+		fmt.Fprintf(os.Stderr, "While setting up fields: %s\n", err)
+		os.Exit(1)
+	} else {
+		parseOptions.MultiValues = journal2gelf.MultiValuePolicy{Mode: mode, Separator: *multiValueSep}
+	}
+
+	if mode, err := journal2gelf.ParseConflictMode(*fieldConflicts); err != nil {
+		fmt.Fprintf(os.Stderr, "While setting up fields: %s\n", err)
+		os.Exit(1)
+	} else {
+		converter.Conflicts = mode
+	}
+
+	if *canaryPercent < 0 || *canaryPercent > 100 {
+		fmt.Fprintf(os.Stderr, "Invalid --canary-percent %d, expected 0 to 100\n", *canaryPercent)
+		os.Exit(1)
+	}
+
+	if "" != *remoteRules {
+		if err := setupRemoteRules(*remoteRules, *remoteKey, *remoteCache); err != nil {
+			fmt.Fprintf(os.Stderr, "While setting up remote rules: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := loadRules(); err != nil {
+		fmt.Fprintf(os.Stderr, "While reading rules: %s\n", err)
+		os.Exit(1)
+	}
+	go handleReload()
+
+	if "" != *remoteRules {
+		go pollRemoteRules(*remoteEvery)
+	}
+
+	if err := setupStaticFields(fieldFlags, *hostnameFlag, *hostnameFrom); err != nil {
+		fmt.Fprintf(os.Stderr, "While setting up fields: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := setupParsers(*parserList); err != nil {
+		fmt.Fprintf(os.Stderr, "While setting up parsers: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := setupFilters(*filterPriority, dropMessageRes); err != nil {
+		fmt.Fprintf(os.Stderr, "While setting up filters: %s\n", err)
+		os.Exit(1)
+	}
+
+	if len(statusRules) > 0 {
+		if t, err := newStatusTracker(statusRules, *statusInterval); err != nil {
+			fmt.Fprintf(os.Stderr, "While setting up filters: %s\n", err)
+			os.Exit(1)
+		} else {
+			statuses = t
+		}
+	}
+
+	// Entries from stdin are usually from another host, whose units aren't known here
+	if *unitMetadata && !*readStdin {
+		addEnricher("unit-metadata", unitEnricher{}, UNIT_METADATA_TTL, ENRICH_CACHE_SIZE, 4)
+	}
+
+	if *oomFlag {
+		ooms = newOomCorrelator()
+	}
+
+	if *jobEvents {
+		jobs = newJobTracker()
+	}
+
+	if *resourceFlag && !*readStdin {
+		resources = newResourceStats()
+	}
+
+	if "" != *unitRateLimit {
+		if l, err := newUnitLimiter(*unitRateLimit, *unitRateBurst, *unitRateEvery, rateExempt); err != nil {
+			fmt.Fprintf(os.Stderr, "While setting up filters: %s\n", err)
+			os.Exit(1)
+		} else {
+			unitLimits = l
+			go unitLimits.run()
+		}
+	}
+
+	if "" != *allowlistFile {
+		if a, err := newAllowlist(*allowlistFile); err != nil {
+			fmt.Fprintf(os.Stderr, "While reading allowlist: %s\n", err)
+			os.Exit(1)
+		} else {
+			allowed = a
+			go allowed.watch()
+		}
+	}
+
+	if auditing {
+		os.Exit(auditCommand(args))
+	}
+
+	if showing {
+		os.Exit(pipelineCommand(servers, args))
+	}
+
+	if generating {
+		os.Exit(dashboardsCommand())
+	}
+
+	if "" != *exportDest {
+		if e, err := newJournalExporter(*exportDest); err != nil {
+			fmt.Fprintf(os.Stderr, "While opening export destination: %s\n", err)
+			os.Exit(1)
+		} else {
+			exporter = e
+			exportOut = newOutputQueue("export", *outputBuffer)
+		}
+	}
+
+	if "" != *fallbackPath {
+		size, err := parseSize(*fallbackSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "While opening fallback file: %s\n", err)
+			os.Exit(1)
+		}
+
+		level, err := parsePriority(*fallbackLevel)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "While opening fallback file: %s\n", err)
+			os.Exit(1)
+		}
+
+		if fallback, err = openFallback(*fallbackPath, size, level); err != nil {
+			fmt.Fprintf(os.Stderr, "While opening fallback file: %s\n", err)
+			os.Exit(1)
+		}
+
+		go fallback.replay()
+	}
+
+	if "" != *spoolDir {
+		size, err := parseSize(*spoolMaxSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "While opening spool: %s\n", err)
+			os.Exit(1)
+		}
+
+		if spooler, err = openSpool(*spoolDir, size, *spoolMaxAge); err != nil {
+			fmt.Fprintf(os.Stderr, "While opening spool: %s\n", err)
+			os.Exit(1)
+		}
+
+		go spooler.drain()
+		go spooler.compact()
+	}
+
+	if "" != *s3Url {
+		size, err := parseSize(*s3MaxSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "While setting up S3 archive: %s\n", err)
+			os.Exit(1)
+		}
+
+		if archiver, err = newS3Archive(*s3Url, *s3Region, *s3Key, *s3Format, int(size), *s3MaxAge); err != nil {
+			fmt.Fprintf(os.Stderr, "While setting up S3 archive: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if "" != *metricsListen {
+		go serveMetrics(*metricsListen)
+	}
+
+	lineSize, err := parseSize(*maxLineSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "While parsing --max-line-size: %s\n", err)
+		os.Exit(1)
+	}
+
+	if size, err := parseSize(*maxMessageFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "While parsing --max-message-size: %s\n", err)
+		os.Exit(1)
+	} else {
+		maxMessageSize = int(size)
+	}
+
+	if *retryBase <= 0 || *retryMax <= 0 {
+		fmt.Fprintln(os.Stderr, "--retry-base and --retry-max must be more than 0")
+		os.Exit(1)
 	}
+	retry = journal2gelf.RetryPolicy{Base: *retryBase, Max: *retryMax, Timeout: *retryTimeout}
 
-	journalArgs := []string{"--all", "--output=json"}
-	journalArgs = append(journalArgs, os.Args[2:]...)
-	cmd := exec.Command("journalctl", journalArgs...)
+	if "none" == *immediatePrio {
+		immediateLevel = -1
+	} else if immediateLevel, err = parsePriority(*immediatePrio); err != nil {
+		fmt.Fprintf(os.Stderr, "While parsing --immediate-priority: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *senderCount < 1 {
+		fmt.Fprintln(os.Stderr, "At least one sender is needed")
+		os.Exit(1)
+	}
+
+	output := &deliveryWriter{}
+	if *rateLimit > 0 {
+		output.limiter = newRateLimiter(*rateLimit)
+	}
 
-	stderr, _ := cmd.StderrPipe()
-	go io.Copy(os.Stderr, stderr)
-	stdout, _ := cmd.StdoutPipe()
-	s := bufio.NewScanner(stdout)
+	forwarder := journal2gelf.NewForwarder(output)
+	forwarder.Converter = converter
+	forwarder.Prepare = prepare
+	forwarder.MergeMaxLines = *mergeMaxLines
+	forwarder.MergeMaxBytes = *mergeMaxBytes
+	forwarder.Collapse = !*noCollapse
+	forwarder.CollapseInterval = *collapseEvery
+	forwarder.ImmediatePriority = immediateLevel
+	forwarder.Senders = *senderCount
+	forwarder.Retry = retry
+	forwarder.Dropped = forwarderDropped
+	if *securityFlag {
+		forwarder.Standalone = isSecurityEntry
+	}
+	forwarder.Start()
 
-	go writePendingEntry()
+	journal := newJournalctl(args, *readStdin)
+	go handleSignals(journal)
+
+	// The standby waits here, the checkpoint is read once it leads
+	if "" != *standbyLock {
+		if "" == *checkpointPath || *readStdin {
+			fmt.Fprintln(os.Stderr, "--standby-lock needs --checkpoint, for the standby to continue where the leader stopped")
+			os.Exit(1)
+		}
+
+		if leaderLock, err = waitForLeadership(*standbyLock); errors.Is(err, errStandbyStopped) {
+			forwarder.Close()
+			return
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "While locking standby lock: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if "" != *checkpointPath {
+		if *readStdin {
+			fmt.Fprintln(os.Stderr, "--checkpoint can't be used with --stdin")
+			os.Exit(1)
+		}
+
+		if checkpoints, err = openCheckpoint(*checkpointPath); err != nil {
+			fmt.Fprintf(os.Stderr, "While reading checkpoint: %s\n", err)
+			os.Exit(1)
+		}
+	} else if *backfillBudget > 0 && !*readStdin {
+		fmt.Fprintln(os.Stderr, "--backfill-budget needs --checkpoint, for the next run to continue where it stopped")
+		os.Exit(1)
+	}
+
+	if "" != *auditPath {
+		if audit, err = openAuditLog(*auditPath); err != nil {
+			fmt.Fprintf(os.Stderr, "While opening audit log: %s\n", err)
+			os.Exit(1)
+		}
+
+		go audit.run(*auditEvery)
+	}
 
-	cmd.Start()
+	var socket *entrySocket
+	if "" != *socketPath {
+		if socket, err = listenSocket(*socketPath, forwarder, int(lineSize)); err != nil {
+			fmt.Fprintf(os.Stderr, "While listening on socket: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var ingest *entrySocket
+	if "" != *httpSocket {
+		if ingest, err = listenHttpSocket(*httpSocket, forwarder); err != nil {
+			fmt.Fprintf(os.Stderr, "While listening on HTTP socket: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var control net.Listener
+	if "" != *controlSocket {
+		if control, err = listenControl(*controlSocket, servers, args); err != nil {
+			fmt.Fprintf(os.Stderr, "While listening on control socket: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Entries from stdin are usually from another host
+	if !archive && !*readStdin && !*noInventory {
+		sendInventory(args)
+	}
+
+	if checkpoints != nil {
+		journal.cursor = checkpoints.cursor
+		go checkpoints.run()
+	}
+
+	if *backfillBudget > 0 {
+		time.AfterFunc(*backfillBudget, func() {
+			stopBackfill(journal, *backfillBudget)
+		})
+	}
+
+	maxRestarts := *restartLimit
+	if *noRestart {
+		maxRestarts = 0
+	}
+
+	var journalErr error
+	for {
+		stdout, err := journal.start()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "While starting journalctl: %s\n", err)
+			os.Exit(1)
+		}
+
+		s := bufio.NewScanner(stdout)
+		splitter := &lineSplitter{max: int(lineSize)}
+		s.Buffer(make([]byte, 64*1024), splitter.max)
+		s.Split(splitter.split)
+
+		readEntries(s, journal, forwarder)
+
+		if err := s.Err(); err != nil && !isShuttingDown() {
+			fmt.Fprintf(os.Stderr, "Error from Scanner: %s\n", err)
+			journal.kill()
+			os.Exit(1)
+		}
+
+		restart, err := journal.restart(journal.wait(), maxRestarts)
+		if !restart {
+			journalErr = err
+			break
+		}
+	}
+
+	if socket != nil {
+		socket.Close()
+	}
+
+	if ingest != nil {
+		ingest.Close()
+	}
 
+	if control != nil {
+		control.Close()
+	}
+
+	// Flushes the pending entry and waits until everything is sent
+	forwarder.Close()
+
+	if unitLimits != nil {
+		unitLimits.report(true)
+	}
+
+	if exporter != nil && exportOut.Close() {
+		exporter.Close()
+	}
+
+	if spooler != nil {
+		spooler.Close()
+	}
+
+	if archiver != nil {
+		archiver.Close()
+	}
+
+	if audit != nil {
+		if err := audit.flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write audit log: %s\n", err)
+		}
+	}
+
+	writer.Close()
+	if security != nil && securityOut.Close() {
+		security.Close()
+	}
+
+	// Everything read was sent, continue after the last entry read
+	if checkpoints != nil {
+		if err := checkpoints.save(journal.cursor); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not save checkpoint: %s\n", err)
+		}
+	}
+
+	if n := atomic.LoadUint64(&metrics.entriesFiltered); n > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d entries because of filters\n", n)
+	}
+
+	if n := atomic.LoadUint64(&metrics.entriesRateLimited); n > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d entries because of --unit-rate-limit\n", n)
+	}
+
+	if journalErr != nil && !isShuttingDown() {
+		fmt.Fprintf(os.Stderr, "Error from journalctl: %s\n", journalErr)
+		os.Exit(1)
+	}
+}
+
+func readEntries(s *bufio.Scanner, journal *journalctl, forwarder *journal2gelf.Forwarder) {
 	for s.Scan() {
+		if isShuttingDown() {
+			break
+		}
+
 		line := s.Text()
 
-		var entry = &SystemdJournalEntry{}
-		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		atomic.AddUint64(&metrics.entriesRead, 1)
+
+		started := time.Now()
+		entry, err := journal2gelf.ParseEntryWith([]byte(line), parseOptions)
+		if err != nil {
 			//fmt.Fprintf(os.Stderr, "Could not parse line, skipping: %s\n", line)
+			atomic.AddUint64(&metrics.parseErrors, 1)
 			continue
 		}
+		timeStage(STAGE_DECODE, started)
 
-		entry.process()
+		atomic.StoreInt64(&metrics.lastTimestamp, entry.Realtime_timestamp)
+		journal.seen(entry)
 
-		pending.Lock()
+		timestamp := entry.Realtime_timestamp
+		entryLock.Lock()
+		outcome := handleEntry(entry, forwarder)
+		entryLock.Unlock()
 
-		if pending.entry == nil {
-			pending.entry = entry
-		} else {
-			pending.entry.send()
-			pending.entry = entry
+		if audit != nil {
+			audit.entry(timestamp, outcome)
 		}
+	}
+}
+
+// Process, filter and forward an entry of the journal or the socket, with entryLock held. Returns whether
+// it was forwarded, filtered or rate limited
+func handleEntry(entry *SystemdJournalEntry, forwarder *journal2gelf.Forwarder) int {
+	started := time.Now()
+	set := rulesFor(entry)
+	message := entry.Message
+	entry.Process(set.rules)
+	set.stats.observe(message != entry.Message, started)
+	parseMessage(entry)
+	if ooms != nil {
+		ooms.observe(entry)
+	}
+	if *securityFlag {
+		recognizeSecurityEvent(entry)
+	}
 
-		pending.Unlock()
+	// Filters don't apply to the outcome, the job may be of interest while its messages are not
+	var outcome *SystemdJournalEntry
+	if jobs != nil {
+		outcome = jobs.observe(entry)
+	}
 
-		// Prevent saturation and throttling
-		time.Sleep(1 * time.Millisecond)
+	result := ENTRY_FORWARDED
+	var suppressed bool
+	var summary *SystemdJournalEntry
+	if filtered(entry) {
+		result = ENTRY_FILTERED
+	} else if statuses != nil {
+		suppressed, summary = statuses.suppress(entry)
 	}
 
-	if err := s.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error from Scanner: %s\n", err)
-		cmd.Process.Kill()
-		os.Exit(1)
+	if suppressed {
+		atomic.AddUint64(&metrics.entriesFiltered, 1)
+		result = ENTRY_SUPPRESSED
+	} else if ENTRY_FORWARDED == result && unitLimits != nil && !unitLimits.allow(entry) {
+		atomic.AddUint64(&metrics.entriesRateLimited, 1)
+		result = ENTRY_SUPPRESSED
+	}
+	timeStage(STAGE_PROCESS, started)
+
+	// The entries suppressed before a status change are counted before it
+	if nil != summary {
+		forwarder.Add(summary)
+	}
+
+	if ENTRY_FORWARDED == result {
+		// Export the original entry, merging doesn't change its fields
+		if exporter != nil {
+			exportOut.submit(func() {
+				if err := exporter.export(entry); err != nil {
+					fmt.Fprintln(os.Stderr, "Could not export entry: "+err.Error())
+				}
+			})
+		}
+
+		forwarder.Add(entry)
+	}
+
+	if nil != outcome {
+		forwarder.Add(outcome)
 	}
 
-	cmd.Wait()
-	pending.entry.send()
+	return result
 }
 
-func writePendingEntry() {
-	var entry *SystemdJournalEntry
+type stringList []string
 
-	for {
-		time.Sleep(WRITE_INTERVAL)
+func (this *stringList) String() string {
+	return strings.Join(*this, ",")
+}
 
-		if pending.entry != nil && (time.Now().UnixNano()/1000-pending.entry.Realtime_timestamp) > SAMESOURCE_TIME_DIFFERENCE {
-			pending.Lock()
-			entry = pending.entry
-			pending.entry = nil
-			pending.Unlock()
+func (this *stringList) Set(value string) error {
+	*this = append(*this, value)
+	return nil
+}
 
-			entry.send()
+func (this stringList) contains(value string) bool {
+	for _, v := range this {
+		if v == value {
+			return true
 		}
 	}
+
+	return false
+}
+
+// Separate our own --flags from the arguments meant for journalctl
+func splitArgs(args []string) (own []string, passthrough []string) {
+	for i := 0; i < len(args); i++ {
+		name := strings.SplitN(strings.TrimPrefix(args[i], "--"), "=", 2)[0]
+		f := flag.Lookup(name)
+
+		if !strings.HasPrefix(args[i], "--") || f == nil {
+			passthrough = append(passthrough, args[i])
+			continue
+		}
+
+		own = append(own, args[i])
+
+		// Non-boolean flags may have their value as next argument
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); (!ok || !b.IsBoolFlag()) && !strings.Contains(args[i], "=") && i+1 < len(args) {
+			i++
+			own = append(own, args[i])
+		}
+	}
+
+	return own, passthrough
 }
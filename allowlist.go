@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Units and identifiers which are allowed to be forwarded, one glob pattern per line. The file is watched
+// using inotify and reloaded on every change, so entries can be added or removed without restarting
+type allowlist struct {
+	sync.RWMutex
+	path     string
+	patterns []string
+}
+
+func newAllowlist(file string) (*allowlist, error) {
+	list := &allowlist{path: file}
+
+	if err := list.reload(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (this *allowlist) reload() error {
+	f, err := os.Open(this.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var patterns []string
+	s := bufio.NewScanner(f)
+
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if "" == line || '#' == line[0] {
+			continue
+		}
+
+		if _, err := path.Match(line, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q in %s: %s", line, this.path, err)
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	this.Lock()
+	this.patterns = patterns
+	this.Unlock()
+
+	return nil
+}
+
+func (this *allowlist) allows(entry *SystemdJournalEntry) bool {
+	this.RLock()
+	defer this.RUnlock()
+
+	for _, pattern := range this.patterns {
+		for _, name := range []string{entry.Systemd_unit, entry.Syslog_identifier, entry.Comm} {
+			if "" == name {
+				continue
+			}
+
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Watch the directory instead of the file itself, editors and config management replace files by renaming
+func (this *allowlist) watch() {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Not watching allowlist for changes: "+err.Error())
+		return
+	}
+	defer syscall.Close(fd)
+
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(this.path), syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_CREATE); err != nil {
+		fmt.Fprintln(os.Stderr, "Not watching allowlist for changes: "+err.Error())
+		return
+	}
+
+	name := filepath.Base(this.path)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "Stopped watching allowlist: "+err.Error())
+			return
+		}
+
+		changed := false
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(event.Len)
+
+			if strings.TrimRight(string(buf[start:offset]), "\x00") == name {
+				changed = true
+			}
+		}
+
+		if !changed {
+			continue
+		}
+
+		// Keep using the previous list when the new one is broken
+		if err := this.reload(); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not reload allowlist: "+err.Error())
+		}
+	}
+}
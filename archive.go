@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/DECK36/go-gelf/gelf"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Writes messages as NDJSON to a file for the export subcommand, gzip compressed when the name ends in
+// .gz, zstd compressed when it ends in .zst or as Parquet when it ends in .parquet. The messages are the
+// same as the ones sent to Graylog, so the archive can be imported later on
+type archiveWriter struct {
+	dryRunWriter
+	buffer  *bufio.Writer
+	parquet *parquetWriter
+	closers []io.Closer
+}
+
+func newArchiveWriter(name string) (*archiveWriter, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &archiveWriter{closers: []io.Closer{f}}
+	this.buffer = bufio.NewWriterSize(f, 64*1024)
+	this.out = this.buffer
+
+	if strings.HasSuffix(name, ".gz") {
+		gz := gzip.NewWriter(this.buffer)
+		this.out = gz
+		this.closers = append([]io.Closer{gz}, this.closers...)
+	} else if strings.HasSuffix(name, ".zst") {
+		zst, err := zstd.NewWriter(this.buffer)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		this.out = zst
+		this.closers = append([]io.Closer{zst}, this.closers...)
+	} else if strings.HasSuffix(name, ".parquet") {
+		if this.parquet, err = newParquetWriter(this.buffer); err != nil {
+			f.Close()
+			return nil, err
+		}
+		this.closers = append([]io.Closer{this.parquet}, this.closers...)
+	}
+
+	return this, nil
+}
+
+func (this *archiveWriter) WriteMessage(message *gelf.Message) error {
+	if nil == this.parquet {
+		return this.dryRunWriter.WriteMessage(message)
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	return this.parquet.WriteMessage(message)
+}
+
+// The compressed stream or Parquet footer has to be completed before the buffer is flushed
+func (this *archiveWriter) Close() {
+	this.Lock()
+	defer this.Unlock()
+
+	for i, closer := range this.closers {
+		if i == len(this.closers)-1 {
+			if err := this.buffer.Flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "While writing archive: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if err := closer.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "While writing archive: %s\n", err)
+			os.Exit(1)
+		}
+	}
+}
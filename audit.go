@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+// What happened to an entry of the journal
+const (
+	ENTRY_FORWARDED = iota
+	ENTRY_FILTERED
+	ENTRY_SUPPRESSED
+)
+
+// Counts of one minute, of the time journald recorded for the entries and the timestamp of the messages
+type auditCounts struct {
+	Minute time.Time `json:"minute"`
+	auditTotals
+}
+
+type auditTotals struct {
+	Read       uint64 `json:"read"`
+	Filtered   uint64 `json:"filtered"`
+	Suppressed uint64 `json:"suppressed"`
+	Forwarded  uint64 `json:"forwarded"`
+	Sent       uint64 `json:"sent"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+func (this *auditTotals) add(other auditTotals) {
+	this.Read += other.Read
+	this.Filtered += other.Filtered
+	this.Suppressed += other.Suppressed
+	this.Forwarded += other.Forwarded
+	this.Sent += other.Sent
+	this.Dropped += other.Dropped
+}
+
+// Appends the counts per minute to the audit log every interval, as checkpoints the audit subcommand
+// compares to the journal. A minute may be written more than once, the audit adds them up
+type auditLog struct {
+	sync.Mutex
+	path    string
+	minutes map[int64]*auditCounts
+}
+
+var audit *auditLog
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	return &auditLog{path: path, minutes: map[int64]*auditCounts{}}, nil
+}
+
+func (this *auditLog) minute(timestamp int64) *auditCounts {
+	minute := timestamp / 60e6 * 60
+	counts, ok := this.minutes[minute]
+	if !ok {
+		counts = &auditCounts{Minute: time.Unix(minute, 0).UTC()}
+		this.minutes[minute] = counts
+	}
+
+	return counts
+}
+
+// By the timestamp of the entry, taken before the forwarder may merge it
+func (this *auditLog) entry(timestamp int64, outcome int) {
+	this.Lock()
+	defer this.Unlock()
+
+	counts := this.minute(timestamp)
+	counts.Read++
+	switch outcome {
+	case ENTRY_FILTERED:
+		counts.Filtered++
+	case ENTRY_SUPPRESSED:
+		counts.Suppressed++
+	default:
+		counts.Forwarded++
+	}
+}
+
+func (this *auditLog) message(message *gelf.Message, sent bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	counts := this.minute(int64(message.TimeUnix * 1e6))
+	if sent {
+		counts.Sent++
+	} else {
+		counts.Dropped++
+	}
+}
+
+func (this *auditLog) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := this.flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write audit log: %s\n", err)
+		}
+	}
+}
+
+func (this *auditLog) flush() error {
+	this.Lock()
+	minutes := this.minutes
+	this.minutes = map[int64]*auditCounts{}
+	this.Unlock()
+
+	if 0 == len(minutes) {
+		return nil
+	}
+
+	var keys []int64
+	for minute := range minutes {
+		keys = append(keys, minute)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	file, err := os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for _, minute := range keys {
+		data, _ := json.Marshal(minutes[minute])
+		w.Write(append(data, '\n'))
+	}
+
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Count a message as sent, in the metrics and the audit log
+func countSent(message *gelf.Message) {
+	atomic.AddUint64(&metrics.entriesSent, 1)
+	if audit != nil {
+		audit.message(message, true)
+	}
+}
+
+func countDropped(message *gelf.Message) {
+	atomic.AddUint64(&metrics.entriesDropped, 1)
+	if audit != nil {
+		audit.message(message, false)
+	}
+}
+
+// The reconciliation of the journal and the audit log over a time range
+type auditReport struct {
+	Since      time.Time     `json:"since"`
+	Until      time.Time     `json:"until"`
+	Journal    auditJournal  `json:"journal"`
+	Shipper    auditTotals   `json:"shipper"`
+	Graylog    *uint64       `json:"graylog_messages,omitempty"`
+	Missing    int64         `json:"missing"`
+	Mismatches []auditMinute `json:"mismatches,omitempty"`
+	Reconciled bool          `json:"reconciled"`
+}
+
+type auditJournal struct {
+	Entries  uint64 `json:"entries"`
+	Matching uint64 `json:"matching"`
+}
+
+// A minute in which the entries matching the filters weren't all forwarded or suppressed
+type auditMinute struct {
+	Minute     time.Time `json:"minute"`
+	Matching   uint64    `json:"journal_matching"`
+	Forwarded  uint64    `json:"forwarded"`
+	Suppressed uint64    `json:"suppressed"`
+}
+
+// Count the entries of the journal in the range which match the filters, and compare them per minute to
+// what the audit log says was forwarded. Entries suppressed by --unit-rate-limit or --status-change match
+// the filters but aren't sent, they count as accounted for. Optionally compare the messages sent to what Graylog counts
+func auditCommand(args []string) int {
+	since, until, args, err := auditRange(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "While auditing: %s\n", err)
+		return 2
+	}
+
+	if "" == *auditPath {
+		fmt.Fprintln(os.Stderr, "Pass the audit log written while shipping with --audit-log")
+		return 2
+	}
+
+	report := &auditReport{Since: since, Until: until}
+	journal, err := countJournal(since, until, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "While reading the journal: %s\n", err)
+		return 1
+	}
+
+	shipped, err := readAuditLog(*auditPath, since, until)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "While reading the audit log: %s\n", err)
+		return 1
+	}
+
+	minutes := map[int64]bool{}
+	for minute, n := range journal {
+		report.Journal.Entries += n[0]
+		report.Journal.Matching += n[1]
+		minutes[minute] = true
+	}
+
+	for minute, counts := range shipped {
+		report.Shipper.add(counts.auditTotals)
+		minutes[minute] = true
+	}
+
+	var keys []int64
+	for minute := range minutes {
+		keys = append(keys, minute)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, minute := range keys {
+		counts := shipped[minute]
+		if nil == counts {
+			counts = &auditCounts{}
+		}
+
+		if journal[minute][1] != counts.Forwarded+counts.Suppressed {
+			report.Mismatches = append(report.Mismatches, auditMinute{time.Unix(minute, 0).UTC(), journal[minute][1], counts.Forwarded, counts.Suppressed})
+		}
+	}
+
+	report.Missing = int64(report.Journal.Matching) - int64(report.Shipper.Forwarded+report.Shipper.Suppressed)
+	report.Reconciled = 0 == len(report.Mismatches) && 0 == report.Shipper.Dropped
+
+	if "" != *auditGraylog {
+		n, err := countGraylog(*auditGraylog, *auditToken, *auditQuery, since, until)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "While counting messages in Graylog: %s\n", err)
+			return 1
+		}
+
+		report.Graylog = &n
+		report.Reconciled = report.Reconciled && n == report.Shipper.Sent
+	}
+
+	data, _ := json.MarshalIndent(report, "", "\t")
+	fmt.Println(string(data))
+
+	if !report.Reconciled {
+		return 1
+	}
+
+	return 0
+}
+
+// Layouts accepted for --since and --until, in local time like journalctl
+var auditLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// Take --since and --until from the journalctl arguments, widened to whole minutes like the audit log
+func auditRange(args []string) (time.Time, time.Time, []string, error) {
+	var since, until time.Time
+	var rest []string
+
+	for i := 0; i < len(args); i++ {
+		name, value := args[i], ""
+		if parts := strings.SplitN(args[i], "=", 2); 2 == len(parts) {
+			name, value = parts[0], parts[1]
+		} else if ("--since" == name || "--until" == name) && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+
+		if "--since" != name && "--until" != name {
+			rest = append(rest, args[i])
+			continue
+		}
+
+		t, err := parseAuditTime(value)
+		if err != nil {
+			return since, until, nil, err
+		}
+
+		if "--since" == name {
+			since = t.Truncate(time.Minute)
+		} else {
+			until = t.Add(time.Minute - 1).Truncate(time.Minute)
+		}
+	}
+
+	if since.IsZero() {
+		return since, until, nil, fmt.Errorf("pass the start of the range with --since")
+	}
+
+	if until.IsZero() {
+		until = time.Now().Truncate(time.Minute)
+	}
+
+	if !since.Before(until) {
+		return since, until, nil, fmt.Errorf("--since should be before --until")
+	}
+
+	return since, until, rest, nil
+}
+
+func parseAuditTime(value string) (time.Time, error) {
+	for _, layout := range auditLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q, expected like 2006-01-02 15:04:05", value)
+}
+
+// Entries and the entries matching the filters, per minute
+func countJournal(since, until time.Time, args []string) (map[int64][2]uint64, error) {
+	args = append([]string{"--all", "--output=json", "--since=" + since.Format("2006-01-02 15:04:05"), "--until=" + until.Add(-time.Microsecond).Format("2006-01-02 15:04:05.000000")}, args...)
+	cmd := exec.Command("journalctl", args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	counts := map[int64][2]uint64{}
+	s := bufio.NewScanner(stdout)
+	s.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for s.Scan() {
+		entry, err := journal2gelf.ParseEntryWith(s.Bytes(), parseOptions)
+		if err != nil {
+			continue
+		}
+
+		entry.Process(rulesFor(entry).rules)
+		parseMessage(entry)
+		if *securityFlag {
+			recognizeSecurityEvent(entry)
+		}
+
+		minute := entry.Realtime_timestamp / 60e6 * 60
+		n := counts[minute]
+		n[0]++
+		if !isFiltered(entry) {
+			n[1]++
+		}
+		counts[minute] = n
+	}
+
+	if err := s.Err(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	return counts, cmd.Wait()
+}
+
+func readAuditLog(path string, since, until time.Time) (map[int64]*auditCounts, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	minutes := map[int64]*auditCounts{}
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		var counts auditCounts
+		if err := json.Unmarshal(s.Bytes(), &counts); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		if counts.Minute.Before(since) || !counts.Minute.Before(until) {
+			continue
+		}
+
+		minute := counts.Minute.Unix()
+		if total, ok := minutes[minute]; ok {
+			total.add(counts.auditTotals)
+		} else {
+			minutes[minute] = &counts
+		}
+	}
+
+	return minutes, s.Err()
+}
+
+// The number of messages in the range according to the search API of Graylog, authenticated with an
+// access token
+func countGraylog(base, token, query string, since, until time.Time) (uint64, error) {
+	if "" == query {
+		hostname, _ := os.Hostname()
+		query = "source:" + hostname
+	}
+
+	params := url.Values{
+		"query":  {query},
+		"from":   {since.UTC().Format("2006-01-02T15:04:05.000Z")},
+		"to":     {until.UTC().Add(-time.Millisecond).Format("2006-01-02T15:04:05.000Z")},
+		"limit":  {"1"},
+		"fields": {"timestamp"},
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(base, "/")+"/api/search/universal/absolute?"+params.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if "" != token {
+		req.SetBasicAuth(token, "token")
+	}
+
+	resp, err := (&http.Client{Timeout: REMOTE_TIMEOUT}).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		Total uint64 `json:"total_results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+
+	return result.Total, nil
+}
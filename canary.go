@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A new version of the rule bundle applied to a share of the entries only, while the others keep the
+// previous version. A bad pattern shows in the metrics of its version before it affects all entries, and
+// publishing the previous bundle again ends the canary. After --canary-duration the new version applies
+// to all entries
+type ruleCanary struct {
+	rules   *ruleSet
+	percent uint32
+	started time.Time
+}
+
+// The canary, guarded by ruleLock
+var canary *ruleCanary
+
+// Called for every reload while a canary runs, since the rule files may have changed. It's only started
+// again for another version
+func startCanary(previous, next *ruleSet) {
+	ruleLock.Lock()
+	defer ruleLock.Unlock()
+
+	stableRules = previous
+	if nil != canary && canary.rules.version == next.version {
+		canary.rules = next
+		return
+	}
+
+	canary = &ruleCanary{rules: next, percent: uint32(*canaryPercent), started: time.Now()}
+	time.AfterFunc(*canaryFor, func() {
+		promoteCanary(next.version)
+	})
+
+	fmt.Fprintf(os.Stderr, "Applying rule bundle %s to %d%% of entries for %s, the others keep %s\n", next.version, *canaryPercent, *canaryFor, previous.version)
+}
+
+func promoteCanary(version string) {
+	ruleLock.Lock()
+	defer ruleLock.Unlock()
+
+	if nil == canary || canary.rules.version != version {
+		return
+	}
+
+	stableRules = canary.rules
+	canary = nil
+
+	fmt.Fprintf(os.Stderr, "Applying rule bundle %s to all entries\n", version)
+}
+
+// By a hash of the cursor, so the share is spread over all units and hosts and every entry is handled the
+// same when read again
+func (this *ruleCanary) applies(entry *SystemdJournalEntry) bool {
+	h := fnv.New32a()
+	if "" != entry.Cursor {
+		io.WriteString(h, entry.Cursor)
+	} else {
+		fmt.Fprintf(h, "%d\x00%s", entry.Realtime_timestamp, entry.Message)
+	}
+
+	return h.Sum32()%100 < this.percent
+}
+
+// Counters per version of the rule bundle, to compare the canary to the previous version
+type bundleStats struct {
+	entries   uint64
+	rewritten uint64
+	nanos     uint64
+}
+
+var bundles = struct {
+	sync.Mutex
+	stats map[string]*bundleStats
+}{stats: map[string]*bundleStats{}}
+
+func statsOf(version string) *bundleStats {
+	bundles.Lock()
+	defer bundles.Unlock()
+
+	if _, ok := bundles.stats[version]; !ok {
+		bundles.stats[version] = &bundleStats{}
+	}
+
+	return bundles.stats[version]
+}
+
+// Whether a rewrite rule matched the message, and how long processing took
+func (this *bundleStats) observe(rewritten bool, started time.Time) {
+	atomic.AddUint64(&this.entries, 1)
+	if rewritten {
+		atomic.AddUint64(&this.rewritten, 1)
+	}
+	atomic.AddUint64(&this.nanos, uint64(time.Since(started)))
+}
+
+func writeBundleMetrics(w io.Writer) {
+	ruleLock.RLock()
+	roles := map[string]string{stableRules.version: "stable"}
+	if nil != canary {
+		roles[canary.rules.version] = "canary"
+	}
+	ruleLock.RUnlock()
+
+	bundles.Lock()
+	var versions []string
+	for version := range bundles.stats {
+		versions = append(versions, version)
+	}
+	bundles.Unlock()
+	sort.Strings(versions)
+
+	fmt.Fprintln(w, "# HELP systemdjournal2gelf_rule_bundle_active Versions of the rule bundle in use, the canary applies to --canary-percent of entries")
+	fmt.Fprintln(w, "# TYPE systemdjournal2gelf_rule_bundle_active gauge")
+	for _, version := range versions {
+		if role, ok := roles[version]; ok {
+			fmt.Fprintf(w, "systemdjournal2gelf_rule_bundle_active{bundle=%q,role=%q} 1\n", version, role)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP systemdjournal2gelf_rule_bundle_entries_total Journal entries processed per version of the rule bundle")
+	fmt.Fprintln(w, "# TYPE systemdjournal2gelf_rule_bundle_entries_total counter")
+	for _, version := range versions {
+		fmt.Fprintf(w, "systemdjournal2gelf_rule_bundle_entries_total{bundle=%q} %d\n", version, atomic.LoadUint64(&statsOf(version).entries))
+	}
+
+	fmt.Fprintln(w, "# HELP systemdjournal2gelf_rule_bundle_rewritten_total Journal entries of which a rewrite rule changed the message, per version of the rule bundle")
+	fmt.Fprintln(w, "# TYPE systemdjournal2gelf_rule_bundle_rewritten_total counter")
+	for _, version := range versions {
+		fmt.Fprintf(w, "systemdjournal2gelf_rule_bundle_rewritten_total{bundle=%q} %d\n", version, atomic.LoadUint64(&statsOf(version).rewritten))
+	}
+
+	fmt.Fprintln(w, "# HELP systemdjournal2gelf_rule_bundle_process_seconds_total Time spent applying the rules per version of the rule bundle")
+	fmt.Fprintln(w, "# TYPE systemdjournal2gelf_rule_bundle_process_seconds_total counter")
+	for _, version := range versions {
+		fmt.Fprintf(w, "systemdjournal2gelf_rule_bundle_process_seconds_total{bundle=%q} %v\n", version, float64(atomic.LoadUint64(&statsOf(version).nanos))/float64(time.Second))
+	}
+}
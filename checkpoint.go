@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+const CHECKPOINT_INTERVAL = 10 * time.Second
+
+// Where reading the journal continues on the next start: the cursor of the last entry whose message, and
+// every message before it, was handed to the outputs. It's saved every CHECKPOINT_INTERVAL, so a run which
+// is killed sends the messages of at most that interval again. On a clean exit everything read was sent,
+// and the cursor of the last entry read is saved
+type checkpoint struct {
+	sync.Mutex
+	path     string
+	cursor   string
+	saved    string
+	next     uint64
+	done     uint64
+	sending  map[*gelf.Message]uint64
+	cursors  map[uint64]string
+	finished map[uint64]bool
+}
+
+func openCheckpoint(path string) (*checkpoint, error) {
+	this := &checkpoint{
+		path:     path,
+		sending:  map[*gelf.Message]uint64{},
+		cursors:  map[uint64]string{},
+		finished: map[uint64]bool{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	this.cursor = strings.TrimSpace(string(data))
+	this.saved = this.cursor
+
+	return this, nil
+}
+
+// Messages are numbered in the order they're prepared, which is the order of the journal
+func (this *checkpoint) prepared(message *gelf.Message, cursor string) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.sending[message] = this.next
+	this.cursors[this.next] = cursor
+	this.next++
+}
+
+// With more than one sender messages are handed off out of order, the cursor only moves past those which
+// were all handed off
+func (this *checkpoint) handedOff(message *gelf.Message) {
+	this.Lock()
+	defer this.Unlock()
+
+	seq, ok := this.sending[message]
+	if !ok {
+		return
+	}
+	delete(this.sending, message)
+	this.finished[seq] = true
+
+	for this.finished[this.done] {
+		if cursor := this.cursors[this.done]; "" != cursor {
+			this.cursor = cursor
+		}
+		delete(this.finished, this.done)
+		delete(this.cursors, this.done)
+		this.done++
+	}
+}
+
+func (this *checkpoint) run() {
+	for range time.Tick(CHECKPOINT_INTERVAL) {
+		if err := this.save(""); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not save checkpoint: %s\n", err)
+		}
+	}
+}
+
+// Saves the cursor of the last message handed off, or the given one when everything was sent
+func (this *checkpoint) save(cursor string) error {
+	this.Lock()
+	defer this.Unlock()
+
+	if "" != cursor {
+		this.cursor = cursor
+	}
+
+	if this.cursor == this.saved {
+		return nil
+	}
+
+	if err := ioutil.WriteFile(this.path+".tmp", []byte(this.cursor+"\n"), 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(this.path+".tmp", this.path); err != nil {
+		return err
+	}
+
+	this.saved = this.cursor
+	return nil
+}
+
+// When the backfill budget is used up reading stops like on a signal, but what was read is still sent
+// completely and the checkpoint saved, for the next run to continue
+func stopBackfill(journal *journalctl, budget time.Duration) {
+	fmt.Fprintf(os.Stderr, "Used up the backfill budget of %s, stopping\n", budget)
+
+	atomic.StoreInt32(&shuttingDown, 1)
+	journal.signal(syscall.SIGTERM)
+	time.AfterFunc(JOURNALCTL_GRACE, journal.kill)
+}
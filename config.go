@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_PROFILE = "default"
+
+// A config file holds named profiles of options. Includes are read first, so the including file can
+// override their profiles, and a profile can inherit another one to only list what differs, for example
+// a base profile for the fleet and one per environment
+type configFile struct {
+	Include  []string                  `json:"include,omitempty"`
+	Profile  string                    `json:"profile,omitempty"`
+	Profiles map[string]*configProfile `json:"profiles"`
+}
+
+// Options are named like the command line flags, lists are used for flags which may be repeated
+type configProfile struct {
+	Inherit    string                 `json:"inherit,omitempty"`
+	Server     string                 `json:"server,omitempty"`
+	Options    map[string]interface{} `json:"options,omitempty"`
+	Journalctl []string               `json:"journalctl,omitempty"`
+}
+
+func loadConfig(path string) (*configFile, error) {
+	return readConfig(path, map[string]bool{})
+}
+
+// Includes are relative to the including file and may be globs, like conf.d/*.json
+func readConfig(path string, reading map[string]bool) (*configFile, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if reading[abs] {
+		return nil, fmt.Errorf("%s includes itself", path)
+	}
+	reading[abs] = true
+	defer delete(reading, abs)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file configFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	merged := &configFile{Profiles: map[string]*configProfile{}}
+	for _, include := range file.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+
+		matches, err := filepath.Glob(include)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if nil == matches && !strings.ContainsAny(include, "*?[") {
+			matches = []string{include}
+		}
+
+		for _, match := range matches {
+			included, err := readConfig(match, reading)
+			if err != nil {
+				return nil, err
+			}
+			merged.merge(included)
+		}
+	}
+
+	file.Include = nil
+	merged.merge(&file)
+
+	return merged, nil
+}
+
+func (this *configFile) merge(other *configFile) {
+	if "" != other.Profile {
+		this.Profile = other.Profile
+	}
+
+	for name, profile := range other.Profiles {
+		if nil == profile {
+			continue
+		}
+
+		if existing, ok := this.Profiles[name]; ok {
+			existing.merge(profile)
+		} else {
+			this.Profiles[name] = (&configProfile{}).merge(profile)
+		}
+	}
+}
+
+// Options of other override the same options of this one, the server and journalctl arguments are replaced
+func (this *configProfile) merge(other *configProfile) *configProfile {
+	if "" != other.Inherit {
+		this.Inherit = other.Inherit
+	}
+
+	if "" != other.Server {
+		this.Server = other.Server
+	}
+
+	if nil != other.Journalctl {
+		this.Journalctl = other.Journalctl
+	}
+
+	if nil == this.Options {
+		this.Options = map[string]interface{}{}
+	}
+	for name, value := range other.Options {
+		this.Options[name] = value
+	}
+
+	return this
+}
+
+// The profile with everything it inherits merged in, by name or else the one the file selects
+func (this *configFile) effective(name string) (string, *configProfile, error) {
+	if "" == name {
+		name = this.Profile
+	}
+	if "" == name {
+		name = DEFAULT_PROFILE
+	}
+
+	var chain []*configProfile
+	seen := map[string]bool{}
+	for current := name; "" != current; current = this.Profiles[current].Inherit {
+		if seen[current] {
+			return "", nil, fmt.Errorf("profile %s inherits itself", current)
+		}
+		seen[current] = true
+
+		if _, ok := this.Profiles[current]; !ok {
+			return "", nil, fmt.Errorf("unknown profile %q", current)
+		}
+		chain = append(chain, this.Profiles[current])
+	}
+
+	result := &configProfile{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		result.merge(chain[i])
+	}
+	result.Inherit = ""
+
+	for option, value := range result.Options {
+		if _, err := optionValues(option, value); err != nil {
+			return "", nil, fmt.Errorf("profile %s: %s", name, err)
+		}
+	}
+
+	return name, result, nil
+}
+
+// The values to set the flag to, more than one for lists
+func optionValues(name string, value interface{}) ([]string, error) {
+	if f := flag.Lookup(name); nil == f || "config" == name || "profile" == name {
+		return nil, fmt.Errorf("unknown option %q", name)
+	}
+
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}, nil
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("option %s should be a list of strings", name)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("option %s has an invalid value", name)
+}
+
+// The profile as command line arguments, options sorted by name
+func (this *configProfile) arguments() []string {
+	var names []string
+	for name := range this.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, name := range names {
+		values, _ := optionValues(name, this.Options[name])
+		for _, value := range values {
+			args = append(args, "--"+name+"="+value)
+		}
+	}
+
+	if "" != this.Server {
+		args = append(args, this.Server)
+	}
+
+	return append(args, this.Journalctl...)
+}
+
+// Set the options of the profile which weren't given on the command line, which takes precedence. The server
+// of the profile is put in front of the arguments unless exporting or printing messages, the journalctl
+// arguments of the profile come before the ones of the command line
+func applyConfig(path, profile string, args []string, archive bool) ([]string, error) {
+	file, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, effective, err := file.effective(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	for name, value := range effective.Options {
+		if given[name] {
+			continue
+		}
+
+		values, _ := optionValues(name, value)
+		for _, v := range values {
+			if err := flag.Set(name, v); err != nil {
+				return nil, fmt.Errorf("option %s: %s", name, err)
+			}
+		}
+	}
+
+	needServer := !archive && !*dryRun
+	if "" != effective.Server && needServer {
+		return append(append([]string{effective.Server}, effective.Journalctl...), args...), nil
+	}
+
+	if len(args) > 0 && needServer {
+		return append(append([]string{args[0]}, effective.Journalctl...), args[1:]...), nil
+	}
+
+	return append(append([]string{}, effective.Journalctl...), args...), nil
+}
+
+// config show prints the config file with its includes merged, with --effective only the selected profile
+// with everything it inherits, and the equivalent command line
+func configCommand(args []string) int {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	path := flags.String("config", "", "Config file to read")
+	profile := flags.String("profile", "", "Profile to show, instead of the one selected by the config file")
+	effective := flags.Bool("effective", false, "Show the selected profile with everything it inherits merged in")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: config show --config=file [--effective] [--profile=name]")
+		flags.PrintDefaults()
+	}
+
+	if len(args) < 1 || "show" != args[0] {
+		flags.Usage()
+		return 2
+	}
+	flags.Parse(args[1:])
+
+	if "" == *path {
+		flags.Usage()
+		return 2
+	}
+
+	file, err := loadConfig(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "While reading config: %s\n", err)
+		return 1
+	}
+
+	var out interface{} = file
+	if *effective {
+		name, profile, err := file.effective(*profile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "While reading config: %s\n", err)
+			return 1
+		}
+
+		out = struct {
+			Profile   string         `json:"profile"`
+			Effective *configProfile `json:"effective"`
+			Arguments []string       `json:"arguments"`
+		}{name, profile, profile.arguments()}
+	}
+
+	data, _ := json.MarshalIndent(out, "", "\t")
+	fmt.Println(string(data))
+
+	return 0
+}
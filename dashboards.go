@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Dashboards cover the last hour
+const DASHBOARD_RANGE = 3600
+
+// A dashboard of one feature, with the fields the feature adds and their type
+type dashboardSpec struct {
+	title       string
+	description string
+	fields      map[string]string
+	widgets     []widgetSpec
+}
+
+// Kind is a legacy Graylog widget type: STATS_COUNT, SEARCH_RESULT_CHART or QUICKVALUES, which needs a field
+type widgetSpec struct {
+	description string
+	kind        string
+	query       string
+	field       string
+}
+
+var overviewDashboard = dashboardSpec{
+	title:       "Journal overview",
+	description: "Messages sent by SystemdJournal2Gelf",
+	fields:      map[string]string{"facility": "string", "level": "number", "Transport": "string", "Syslog_Facility": "string"},
+	widgets: []widgetSpec{
+		{"Messages", "STATS_COUNT", "*", ""},
+		{"Errors", "STATS_COUNT", "level:<=3", ""},
+		{"Messages over time", "SEARCH_RESULT_CHART", "*", ""},
+		{"Errors over time", "SEARCH_RESULT_CHART", "level:<=3", ""},
+		{"Hosts", "QUICKVALUES", "*", "source"},
+		{"Identifiers", "QUICKVALUES", "*", "facility"},
+		{"Identifiers logging errors", "QUICKVALUES", "level:<=3", "facility"},
+		{"Levels", "QUICKVALUES", "*", "level"},
+	},
+}
+
+// Dashboards of the parsers of --parse, by name
+var parserDashboards = map[string]dashboardSpec{
+	"netfilter": {
+		title:       "Firewall",
+		description: "Packets logged by iptables and nftables",
+		fields:      map[string]string{"fw_prefix": "string", "fw_src": "string", "fw_dst": "string", "fw_proto": "string", "fw_dst_port": "string", "fw_in": "string"},
+		widgets: []widgetSpec{
+			{"Logged packets over time", "SEARCH_RESULT_CHART", "event:firewall", ""},
+			{"Rules", "QUICKVALUES", "event:firewall", "fw_prefix"},
+			{"Sources", "QUICKVALUES", "event:firewall", "fw_src"},
+			{"Destination ports", "QUICKVALUES", "event:firewall", "fw_dst_port"},
+			{"Protocols", "QUICKVALUES", "event:firewall", "fw_proto"},
+		},
+	},
+	"dnsmasq": {
+		title:       "dnsmasq",
+		description: "DNS queries and DHCP leases of dnsmasq",
+		fields:      map[string]string{"dns_query": "string", "dns_type": "string", "dns_client": "string", "dhcp_event": "string", "dhcp_hostname": "string", "dhcp_mac": "string"},
+		widgets: []widgetSpec{
+			{"Queries over time", "SEARCH_RESULT_CHART", "event:dns_query", ""},
+			{"Queried names", "QUICKVALUES", "event:dns_query", "dns_query"},
+			{"Clients", "QUICKVALUES", "event:dns_query", "dns_client"},
+			{"Record types", "QUICKVALUES", "event:dns_query", "dns_type"},
+			{"DHCP events", "QUICKVALUES", "event:dhcp", "dhcp_event"},
+			{"DHCP hosts", "QUICKVALUES", "event:dhcp", "dhcp_hostname"},
+		},
+	},
+	"resolved": {
+		title:       "systemd-resolved",
+		description: "DNS servers used by systemd-resolved, and lookups with debug logging",
+		fields:      map[string]string{"dns_server": "string", "dns_interface": "string", "dns_feature_set": "string", "dns_query": "string"},
+		widgets: []widgetSpec{
+			{"Server switches over time", "SEARCH_RESULT_CHART", "event:dns_server_switch", ""},
+			{"Servers", "QUICKVALUES", "event:dns_server_switch", "dns_server"},
+			{"Degraded servers", "QUICKVALUES", "event:dns_degraded", "dns_server"},
+			{"Queried names", "QUICKVALUES", "event:dns_query", "dns_query"},
+		},
+	},
+	"named": {
+		title:       "BIND",
+		description: "Queries of BIND's query log",
+		fields:      map[string]string{"dns_query": "string", "dns_type": "string", "dns_client": "string"},
+		widgets: []widgetSpec{
+			{"Queries over time", "SEARCH_RESULT_CHART", "event:dns_query", ""},
+			{"Queried names", "QUICKVALUES", "event:dns_query", "dns_query"},
+			{"Clients", "QUICKVALUES", "event:dns_query", "dns_client"},
+			{"Denied clients", "QUICKVALUES", "event:dns_denied", "dns_client"},
+		},
+	},
+}
+
+var securityDashboard = dashboardSpec{
+	title:       "Security events",
+	description: "Logins, authentication failures, sudo and sessions, of sshd, sudo, logind and PAM",
+	fields:      map[string]string{"action": "string", "outcome": "string", "actor": "string", "target": "string", "source_ip": "string", "command": "string"},
+	widgets: []widgetSpec{
+		{"Failed logins", "STATS_COUNT", "action:login AND outcome:failure", ""},
+		{"Failures over time", "SEARCH_RESULT_CHART", "outcome:failure", ""},
+		{"Sources of failed logins", "QUICKVALUES", "action:login AND outcome:failure", "source_ip"},
+		{"Users of failed logins", "QUICKVALUES", "action:login AND outcome:failure", "actor"},
+		{"Users logging in", "QUICKVALUES", "action:login AND outcome:success", "actor"},
+		{"Sudo commands", "QUICKVALUES", "action:sudo", "command"},
+	},
+}
+
+var jobDashboard = dashboardSpec{
+	title:       "Jobs",
+	description: "Outcomes of cron jobs and services which finish",
+	fields:      map[string]string{"job_kind": "string", "job_name": "string", "job_outcome": "string", "job_duration_seconds": "number", "job_exit_status": "string"},
+	widgets: []widgetSpec{
+		{"Failed jobs", "STATS_COUNT", "event:job_outcome AND job_outcome:failure", ""},
+		{"Failures over time", "SEARCH_RESULT_CHART", "event:job_outcome AND job_outcome:failure", ""},
+		{"Failing jobs", "QUICKVALUES", "event:job_outcome AND job_outcome:failure", "job_name"},
+		{"Jobs", "QUICKVALUES", "event:job_outcome", "job_name"},
+	},
+}
+
+var oomDashboard = dashboardSpec{
+	title:       "Out of memory",
+	description: "Processes killed by the OOM killer",
+	fields:      map[string]string{"oom_comm": "string", "oom_unit": "string", "oom_cgroup": "string", "oom_anon_rss_kb": "number"},
+	widgets: []widgetSpec{
+		{"Kills", "STATS_COUNT", "event:oom_kill", ""},
+		{"Kills over time", "SEARCH_RESULT_CHART", "event:oom_kill", ""},
+		{"Units", "QUICKVALUES", "event:oom_kill", "oom_unit"},
+		{"Processes", "QUICKVALUES", "event:oom_kill", "oom_comm"},
+	},
+}
+
+var rateLimitDashboard = dashboardSpec{
+	title:       "Rate limited units",
+	description: "Units which logged more than --unit-rate-limit allows",
+	fields:      map[string]string{"rate_limited_unit": "string", "suppressed_count": "number"},
+	widgets: []widgetSpec{
+		{"Limited over time", "SEARCH_RESULT_CHART", "event:rate_limited", ""},
+		{"Units", "QUICKVALUES", "event:rate_limited", "rate_limited_unit"},
+	},
+}
+
+var requestDashboard = dashboardSpec{
+	title:       "Requests",
+	description: "Request URLs and user agents, as split by --decompose-requests",
+	fields:      map[string]string{"Url_Route": "string", "Url_Path": "string", "Status_Code": "string", "User_Agent_Browser": "string", "User_Agent_Os": "string", "User_Agent_Bot": "boolean"},
+	widgets: []widgetSpec{
+		{"Requests over time", "SEARCH_RESULT_CHART", "_exists_:Url_Route", ""},
+		{"Routes", "QUICKVALUES", "_exists_:Url_Route", "Url_Route"},
+		{"Status codes", "QUICKVALUES", "_exists_:Status_Code", "Status_Code"},
+		{"Browsers", "QUICKVALUES", "_exists_:User_Agent_Browser", "User_Agent_Browser"},
+		{"Bots", "QUICKVALUES", "User_Agent_Bot:true", "User_Agent"},
+	},
+}
+
+// The dashboards of the features enabled by the options, the overview first
+func enabledDashboards() []dashboardSpec {
+	dashboards := []dashboardSpec{overviewDashboard}
+
+	for _, name := range nonEmpty(strings.Split(*parserList, ",")) {
+		if d, ok := parserDashboards[name]; ok {
+			dashboards = append(dashboards, d)
+		}
+	}
+	if *securityFlag {
+		dashboards = append(dashboards, securityDashboard)
+	}
+	if jobs != nil {
+		dashboards = append(dashboards, jobDashboard)
+	}
+	if ooms != nil {
+		dashboards = append(dashboards, oomDashboard)
+	}
+	if unitLimits != nil {
+		dashboards = append(dashboards, rateLimitDashboard)
+	}
+	if *splitRequests {
+		dashboards = append(dashboards, requestDashboard)
+	}
+
+	return dashboards
+}
+
+// A value of a content pack entity
+func packValue(kind string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"@type": kind, "@value": value}
+}
+
+// The same name always gets the same id, so the same options always give the same content pack
+func packId(name string) string {
+	h := sha1.Sum([]byte("SystemdJournal2Gelf/" + name))
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// Lists the fields with their type, Graylog has no field definitions in content packs
+func (this dashboardSpec) packDescription() string {
+	var fields []string
+	for name, kind := range this.fields {
+		fields = append(fields, name+" ("+kind+")")
+	}
+	sort.Strings(fields)
+
+	return this.description + ". Fields: " + strings.Join(fields, ", ")
+}
+
+// Widgets are laid out two per row
+func (this dashboardSpec) packEntity() map[string]interface{} {
+	var widgets []interface{}
+	for i, w := range this.widgets {
+		configuration := map[string]interface{}{
+			"query":     packValue("string", w.query),
+			"timerange": map[string]interface{}{"type": packValue("string", "relative"), "range": packValue("integer", DASHBOARD_RANGE)},
+		}
+
+		switch w.kind {
+		case "SEARCH_RESULT_CHART":
+			configuration["interval"] = packValue("string", "minute")
+		case "QUICKVALUES":
+			configuration["field"] = packValue("string", w.field)
+			configuration["show_pie_chart"] = packValue("boolean", true)
+			configuration["show_data_table"] = packValue("boolean", true)
+			configuration["sort_order"] = packValue("string", "desc")
+			configuration["limit"] = packValue("integer", 10)
+		case "STATS_COUNT":
+			configuration["trend"] = packValue("boolean", false)
+			configuration["lower_is_better"] = packValue("boolean", true)
+		}
+
+		widgets = append(widgets, map[string]interface{}{
+			"id":            packValue("string", packId(this.title+"/"+w.description)),
+			"description":   packValue("string", w.description),
+			"type":          packValue("string", w.kind),
+			"cache_time":    packValue("integer", 10),
+			"time_range":    map[string]interface{}{"type": packValue("string", "relative"), "range": packValue("integer", DASHBOARD_RANGE)},
+			"configuration": configuration,
+			"position": map[string]interface{}{
+				"width":  packValue("integer", 1),
+				"height": packValue("integer", 1),
+				"row":    packValue("integer", i/2+1),
+				"col":    packValue("integer", i%2+1),
+			},
+		})
+	}
+
+	return map[string]interface{}{
+		"v":    "1",
+		"type": map[string]string{"name": "dashboard", "version": "1"},
+		"id":   packId("dashboard/" + this.title),
+		"data": map[string]interface{}{
+			"title":       packValue("string", this.title),
+			"description": packValue("string", this.packDescription()),
+			"widgets":     widgets,
+		},
+	}
+}
+
+// Security events are routed by their stream field
+func securityStreamEntity() map[string]interface{} {
+	return map[string]interface{}{
+		"v":    "1",
+		"type": map[string]string{"name": "stream", "version": "1"},
+		"id":   packId("stream/" + *securityStream),
+		"data": map[string]interface{}{
+			"title":          packValue("string", "Security events"),
+			"description":    packValue("string", "Messages with stream="+*securityStream+", as tagged by SystemdJournal2Gelf"),
+			"disabled":       packValue("boolean", false),
+			"matching_type":  packValue("string", "AND"),
+			"remove_matches": packValue("boolean", false),
+			"default_stream": packValue("boolean", false),
+			"stream_rules": []interface{}{map[string]interface{}{
+				"type":        packValue("string", "EXACT"),
+				"field":       packValue("string", "stream"),
+				"value":       packValue("string", *securityStream),
+				"inverted":    packValue("boolean", false),
+				"description": packValue("string", ""),
+			}},
+			"outputs":          []interface{}{},
+			"alarm_callbacks":  []interface{}{},
+			"alert_conditions": []interface{}{},
+		},
+	}
+}
+
+// generate dashboards prints a Graylog content pack with a stream and dashboards for the features the
+// options enable, to install under System / Content Packs
+func dashboardsCommand() int {
+	var entities []interface{}
+	var titles []string
+
+	if *securityFlag {
+		entities = append(entities, securityStreamEntity())
+	}
+	for _, d := range enabledDashboards() {
+		entities = append(entities, d.packEntity())
+		titles = append(titles, d.title)
+	}
+
+	pack := map[string]interface{}{
+		"v":           "1",
+		"id":          packId("content-pack/" + strings.Join(titles, ",")),
+		"rev":         1,
+		"name":        "SystemdJournal2Gelf",
+		"summary":     "Dashboards of " + strings.Join(titles, ", "),
+		"description": "Generated by SystemdJournal2Gelf generate dashboards",
+		"vendor":      "SystemdJournal2Gelf",
+		"url":         "https://github.com/parse-nl/SystemdJournal2Gelf",
+		"parameters":  []interface{}{},
+		"entities":    entities,
+	}
+
+	data, err := json.MarshalIndent(pack, "", "\t")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "While generating dashboards: %s\n", err)
+		return 1
+	}
+
+	fmt.Println(string(data))
+	return 0
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+const (
+	DELIVERY_FAILOVER = "failover"
+	DELIVERY_ALL      = "all"
+
+	ENDPOINT_MAX_FAILURES = 3
+)
+
+var (
+	errNoEndpoint  = errors.New("no GELF server reachable")
+	errWriteFailed = journal2gelf.ErrWriteFailed
+	errTooLarge    = journal2gelf.ErrMessageTooLarge
+)
+
+// A GELF server with its own writer. A single failed write only loses that datagram, but when the server is
+// unreachable or after a few failed writes in a row it is taken out of rotation and reconnected in the background, so a dead server doesn't stall the others
+type endpoint struct {
+	sync.Mutex
+	address  string
+	writer   *gelfWriter
+	healthy  bool
+	failures int
+}
+
+// Delivers messages to one or more servers, either to the first healthy one (failover) or to all of them.
+// Writes are never buffered, so a message none of the servers accepted goes to the spool or fallback file
+type delivery struct {
+	mode      string
+	endpoints []*endpoint
+}
+
+func newDelivery(addresses string, mode string) (*delivery, error) {
+	if DELIVERY_FAILOVER != mode && DELIVERY_ALL != mode {
+		return nil, fmt.Errorf("unknown delivery mode %q, use %s or %s", mode, DELIVERY_FAILOVER, DELIVERY_ALL)
+	}
+
+	this := &delivery{mode: mode}
+	var lastErr error
+
+	for _, address := range strings.Split(addresses, ",") {
+		e := &endpoint{address: address}
+
+		if w, err := newGelfWriter(address); err != nil {
+			fmt.Fprintf(os.Stderr, "While connecting to %s: %s\n", address, err)
+			lastErr = err
+			go e.probe()
+		} else {
+			e.writer = w
+			e.healthy = true
+		}
+
+		this.endpoints = append(this.endpoints, e)
+	}
+
+	// Only fatal when no server can be reached at all
+	for _, e := range this.endpoints {
+		if e.healthy {
+			return this, nil
+		}
+	}
+
+	return nil, lastErr
+}
+
+// Returns an error only when no server accepted the message, errWriteFailed when a server may accept it
+// when retried right away and errTooLarge when none ever will
+func (this *delivery) WriteMessage(message *gelf.Message) error {
+	delivered := false
+	var lastErr error = errNoEndpoint
+
+	for _, e := range this.endpoints {
+		if err := e.write(message); err == nil {
+			delivered = true
+
+			if DELIVERY_FAILOVER == this.mode {
+				break
+			}
+		} else if errors.Is(err, errWriteFailed) || errors.Is(err, errTooLarge) {
+			lastErr = err
+		}
+	}
+
+	if !delivered {
+		return lastErr
+	}
+
+	return nil
+}
+
+func (this *delivery) Close() {
+	for _, e := range this.endpoints {
+		e.Lock()
+		if nil != e.writer {
+			e.writer.Close()
+		}
+		e.Unlock()
+	}
+}
+
+func (this *endpoint) isHealthy() bool {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.healthy
+}
+
+func (this *endpoint) write(message *gelf.Message) error {
+	this.Lock()
+	defer this.Unlock()
+
+	if !this.healthy {
+		return errNoEndpoint
+	}
+
+	/*
+		UDP is nonblocking, but the os stores an error which GO will return on the next call.
+		This means we've already lost a message, but the current one can go to another server
+	*/
+	err := this.writer.WriteMessage(message)
+	if nil == err {
+		this.failures = 0
+		return nil
+	}
+
+	// Says nothing about the server
+	if errors.Is(err, errTooLarge) {
+		return err
+	}
+
+	atomic.AddUint64(&metrics.writeErrors, 1)
+
+	// Refused means nothing is listening, any other error may be just this datagram
+	if this.failures++; this.failures < ENDPOINT_MAX_FAILURES && !isUnreachable(err) {
+		return fmt.Errorf("%w to %s: %s", errWriteFailed, this.address, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Disabling %s because of: %s\n", this.address, err)
+	this.healthy = false
+	this.failures = 0
+	go this.probe()
+
+	return err
+}
+
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+}
+
+// Reconnect after a pause, which also resolves the address again
+func (this *endpoint) probe() {
+	for {
+		time.Sleep(SLEEP_AFTER_ERROR)
+
+		w, err := newGelfWriter(this.address)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "While reconnecting to %s: %s\n", this.address, err)
+			continue
+		}
+
+		this.Lock()
+		if nil != this.writer {
+			this.writer.Close()
+		}
+		this.writer = w
+		this.healthy = true
+		this.Unlock()
+
+		fmt.Fprintf(os.Stderr, "Enabled %s again\n", this.address)
+		return
+	}
+}
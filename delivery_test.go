@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+func TestDeliveryAllReportsFailure(t *testing.T) {
+	conn := listenGelf(t)
+	w, err := newGelfWriter(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := &endpoint{address: conn.LocalAddr().String(), writer: w, healthy: true}
+	down := &endpoint{address: "graylog2:12201"}
+	message := &gelf.Message{Version: "1.1", Host: "test", Short: "hello"}
+
+	// Not buffered, so the spool and fallback file take over when no server is left
+	d := &delivery{mode: DELIVERY_ALL, endpoints: []*endpoint{down}}
+	if err := d.WriteMessage(message); !errors.Is(err, errNoEndpoint) {
+		t.Errorf("error %v, want %v", err, errNoEndpoint)
+	}
+
+	d = &delivery{mode: DELIVERY_ALL, endpoints: []*endpoint{down, up}}
+	if err := d.WriteMessage(message); err != nil {
+		t.Errorf("error %v, want the message accepted by the reachable server", err)
+	}
+	d.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadFrom(make([]byte, GELF_CHUNK_MAX)); err != nil {
+		t.Errorf("nothing received: %s", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/DECK36/go-gelf/gelf"
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+// Run a sample of journal entries through two versions of the rewrite rules and print the fields which differ,
+// to review rule changes before deploying them. Exits 1 when there are differences, like diff
+func diffRules(args []string) int {
+	flags := flag.NewFlagSet("diff-rules", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: diff-rules old-rules.json new-rules.json sample.json")
+		fmt.Fprintln(os.Stderr, "Rules are merged over the built-in rules, use builtin for the built-in rules only.")
+		fmt.Fprintln(os.Stderr, "Capture a sample with journalctl --output=json, use - to read it from stdin")
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 3 {
+		flags.Usage()
+		return 2
+	}
+
+	var versions [2]journal2gelf.Rules
+	for idx, file := range flags.Args()[:2] {
+		versions[idx] = journal2gelf.DefaultRules()
+
+		if "builtin" == file {
+			continue
+		}
+
+		if err := versions[idx].LoadRewrite(file); err != nil {
+			fmt.Fprintf(os.Stderr, "While reading rewrite rules: %s\n", err)
+			return 2
+		}
+	}
+
+	sample := os.Stdin
+	if "-" != flags.Arg(2) {
+		f, err := os.Open(flags.Arg(2))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "While reading sample: %s\n", err)
+			return 2
+		}
+		defer f.Close()
+		sample = f
+	}
+
+	s := bufio.NewScanner(sample)
+	s.Buffer(nil, 16*1024*1024)
+	total, differ := 0, 0
+
+	for s.Scan() {
+		var messages [2]*gelf.Message
+
+		for idx := range versions {
+			entry, err := journal2gelf.ParseEntryWith(s.Bytes(), parseOptions)
+			if err != nil {
+				break
+			}
+
+			entry.Process(versions[idx])
+			messages[idx] = converter.ToGelf(entry)
+		}
+
+		if nil == messages[1] {
+			continue
+		}
+
+		total++
+		diff := diffMessages(messages[0], messages[1])
+		if 0 == len(diff) {
+			continue
+		}
+
+		differ++
+		fmt.Printf("entry %d: %s\n", total, messages[0].Short)
+		for _, line := range diff {
+			fmt.Println("  " + line)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "While reading sample: %s\n", err)
+		return 2
+	}
+
+	fmt.Printf("%d of %d entries differ\n", differ, total)
+
+	if differ > 0 {
+		return 1
+	}
+	return 0
+}
+
+func diffMessages(a, b *gelf.Message) []string {
+	fields := func(m *gelf.Message) map[string]interface{} {
+		f := map[string]interface{}{
+			"host":          m.Host,
+			"short_message": m.Short,
+			"full_message":  m.Full,
+			"timestamp":     m.TimeUnix,
+			"level":         m.Level,
+			"facility":      m.Facility,
+		}
+		for key, value := range m.Extra {
+			f[key] = value
+		}
+		return f
+	}
+
+	before, after := fields(a), fields(b)
+
+	keys := make([]string, 0, len(before))
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var diff []string
+	for _, key := range keys {
+		was, inBefore := before[key]
+		now, inAfter := after[key]
+
+		switch {
+		case !inBefore:
+			diff = append(diff, fmt.Sprintf("+ %s: %#v", key, now))
+		case !inAfter:
+			diff = append(diff, fmt.Sprintf("- %s: %#v", key, was))
+		case !reflect.DeepEqual(was, now):
+			diff = append(diff, fmt.Sprintf("~ %s: %#v -> %#v", key, was, now))
+		}
+	}
+
+	return diff
+}
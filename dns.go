@@ -0,0 +1,76 @@
+package main
+
+import (
+	"regexp"
+)
+
+// A message logged by one of the identifiers, its named subpatterns are stored in the fields of the same name
+type messagePattern struct {
+	identifiers stringList
+	event       string
+	re          *regexp.Regexp
+}
+
+var dnsmasqPatterns = []messagePattern{
+	// query[A] example.com from 192.168.1.10
+	{stringList{"dnsmasq"}, "dns_query", regexp.MustCompile(`^query\[(?P<dns_type>[^\]]+)\] (?P<dns_query>\S+) from (?P<dns_client>\S+)`)},
+	// forwarded example.com to 1.1.1.1
+	{stringList{"dnsmasq"}, "dns_forward", regexp.MustCompile(`^forwarded (?P<dns_query>\S+) to (?P<dns_server>\S+)`)},
+	// reply example.com is 93.184.216.34
+	{stringList{"dnsmasq"}, "dns_reply", regexp.MustCompile(`^(?:reply|cached) (?P<dns_query>\S+) is (?P<dns_answer>.+)$`)},
+	// DHCPACK(eth0) 192.168.1.10 aa:bb:cc:dd:ee:ff laptop
+	{stringList{"dnsmasq-dhcp"}, "dhcp", regexp.MustCompile(`^DHCP(?P<dhcp_event>ACK)\((?P<dhcp_interface>[^)]*)\) (?P<dhcp_ip>\S+) (?P<dhcp_mac>\S+)(?: (?P<dhcp_hostname>\S+))?`)},
+	// DHCPDISCOVER(eth0) aa:bb:cc:dd:ee:ff, DHCPNAK(eth0) 192.168.1.10 aa:bb:cc:dd:ee:ff wrong network
+	{stringList{"dnsmasq-dhcp"}, "dhcp", regexp.MustCompile(`^DHCP(?P<dhcp_event>[A-Z]+)\((?P<dhcp_interface>[^)]*)\) (?:(?P<dhcp_ip>[0-9.]+) )?(?P<dhcp_mac>(?:[0-9a-fA-F]{2}[:-]){5}[0-9a-fA-F]{2})`)},
+}
+
+var resolvedPatterns = []messagePattern{
+	// Switching to DNS server 1.1.1.1 for interface eth0.
+	{stringList{"systemd-resolved"}, "dns_server_switch", regexp.MustCompile(`^Switching to (?:fallback )?DNS server (?P<dns_server>\S+?)(?: for interface (?P<dns_interface>\S+?))?\.$`)},
+	// Using degraded feature set UDP instead of UDP+EDNS0 for DNS server 192.168.1.1.
+	{stringList{"systemd-resolved"}, "dns_degraded", regexp.MustCompile(`^Using degraded feature set (?P<dns_feature_set>\S+) instead of \S+ for DNS server (?P<dns_server>\S+?)\.$`)},
+	// Looking up RR for example.com IN A.
+	{stringList{"systemd-resolved"}, "dns_query", regexp.MustCompile(`^Looking up RR for (?P<dns_query>\S+) IN (?P<dns_type>[^\s.]+)\.$`)},
+}
+
+var namedPatterns = []messagePattern{
+	// client @0x7f2c 192.168.1.10#53211 (example.com): query: example.com IN A +E(0)K (192.168.1.1)
+	{stringList{"named"}, "dns_query", regexp.MustCompile(`^client (?:@\S+ )?(?P<dns_client>[0-9a-fA-F.:]+)#\d+ \([^)]*\): (?:view \S+: )?query: (?P<dns_query>\S+) IN (?P<dns_type>\S+)`)},
+	// client @0x7f2c 192.168.1.10#53211 (example.com): query (cache) 'example.com/A/IN' denied
+	{stringList{"named"}, "dns_denied", regexp.MustCompile(`^client (?:@\S+ )?(?P<dns_client>[0-9a-fA-F.:]+)#\d+ \([^)]*\): (?:view \S+: )?query(?: \([^)]*\))? '(?P<dns_query>[^/']+)/(?P<dns_type>[^/']+)/[^']*' denied`)},
+}
+
+func parseDnsmasq(entry *SystemdJournalEntry) {
+	matchPatterns(entry, dnsmasqPatterns)
+}
+
+func parseResolved(entry *SystemdJournalEntry) {
+	matchPatterns(entry, resolvedPatterns)
+}
+
+func parseNamed(entry *SystemdJournalEntry) {
+	matchPatterns(entry, namedPatterns)
+}
+
+// Only the first matching pattern is used
+func matchPatterns(entry *SystemdJournalEntry, patterns []messagePattern) {
+	for _, pattern := range patterns {
+		if !pattern.identifiers.contains(entry.Syslog_identifier) {
+			continue
+		}
+
+		m := pattern.re.FindStringSubmatch(entry.Message)
+		if nil == m {
+			continue
+		}
+
+		entry.SetField("event", pattern.event)
+		for i, name := range pattern.re.SubexpNames() {
+			if "" != name {
+				entry.SetField(name, m[i])
+			}
+		}
+
+		return
+	}
+}
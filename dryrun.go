@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+type messageWriter interface {
+	WriteMessage(message *gelf.Message) error
+	Close()
+}
+
+// Prints messages as JSON, one per line, instead of sending them. Useful to see what would end up in Graylog
+type dryRunWriter struct {
+	sync.Mutex
+	out    io.Writer
+	pretty bool
+}
+
+func (this *dryRunWriter) WriteMessage(message *gelf.Message) error {
+	var data []byte
+	var err error
+
+	if this.pretty {
+		data, err = json.MarshalIndent(message, "", "\t")
+	} else {
+		data, err = json.Marshal(message)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	_, err = fmt.Fprintln(this.out, string(data))
+	return err
+}
+
+func (this *dryRunWriter) Close() {
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Default size of the cache of an enricher, the least recently used results are dropped beyond it
+const ENRICH_CACHE_SIZE = 10000
+
+// Adds fields to messages from a source outside the entry, like systemd. Lookups may be slow, so their
+// result is cached by the key of the entry: entries with the same key get the same fields
+type Enricher interface {
+	// The key the fields are cached by, empty when there's nothing to add for the entry
+	Key(entry *SystemdJournalEntry) string
+
+	// Look up the fields for the entry, may return nil. Failures are cached as well, to not retry them for
+	// every message
+	Enrich(entry *SystemdJournalEntry) map[string]interface{}
+}
+
+// An enricher with its cache, and a limit of lookups running at the same time
+type enrichment struct {
+	sync.Mutex
+	name     string
+	enricher Enricher
+	ttl      time.Duration
+	size     int
+	slots    chan struct{}
+	lru      *list.List
+	cached   map[string]*list.Element
+}
+
+type enrichResult struct {
+	key     string
+	fields  map[string]interface{}
+	fetched time.Time
+}
+
+var enrichers []*enrichment
+
+// Fields of the enricher are added to every message, after the fields of the entry itself
+func addEnricher(name string, enricher Enricher, ttl time.Duration, size, concurrency int) {
+	if size <= 0 {
+		size = ENRICH_CACHE_SIZE
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	enrichers = append(enrichers, &enrichment{
+		name:     name,
+		enricher: enricher,
+		ttl:      ttl,
+		size:     size,
+		slots:    make(chan struct{}, concurrency),
+		lru:      list.New(),
+		cached:   map[string]*list.Element{},
+	})
+}
+
+func enrich(entry *SystemdJournalEntry, extra map[string]interface{}) {
+	for _, e := range enrichers {
+		for key, value := range e.lookup(entry) {
+			addField(extra, key, value)
+		}
+	}
+}
+
+func (this *enrichment) lookup(entry *SystemdJournalEntry) map[string]interface{} {
+	key := this.enricher.Key(entry)
+	if "" == key {
+		return nil
+	}
+
+	if fields, ok := this.get(key); ok {
+		return fields
+	}
+
+	this.slots <- struct{}{}
+	fields := this.enricher.Enrich(entry)
+	<-this.slots
+
+	this.put(key, fields)
+	return fields
+}
+
+func (this *enrichment) get(key string) (map[string]interface{}, bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	element, ok := this.cached[key]
+	if !ok {
+		return nil, false
+	}
+
+	result := element.Value.(*enrichResult)
+	if time.Since(result.fetched) > this.ttl {
+		this.lru.Remove(element)
+		delete(this.cached, key)
+		return nil, false
+	}
+
+	this.lru.MoveToFront(element)
+	return result.fields, true
+}
+
+func (this *enrichment) put(key string, fields map[string]interface{}) {
+	this.Lock()
+	defer this.Unlock()
+
+	if element, ok := this.cached[key]; ok {
+		this.lru.Remove(element)
+	}
+	this.cached[key] = this.lru.PushFront(&enrichResult{key: key, fields: fields, fetched: time.Now()})
+
+	for this.lru.Len() > this.size {
+		oldest := this.lru.Back()
+		this.lru.Remove(oldest)
+		delete(this.cached, oldest.Value.(*enrichResult).key)
+	}
+}
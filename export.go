@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+// Writes entries in the journal export format, which systemd-journal-remote can import. This is binary
+// safe, values which aren't plain text are written as length prefixed data
+// https://www.freedesktop.org/wiki/Software/systemd/export/
+type journalExporter struct {
+	sync.Mutex
+	dest string
+	conn io.WriteCloser
+	buf  *bufio.Writer
+}
+
+// Destination is a file to append to, or a socket as tcp:host:port or unix:/path
+func newJournalExporter(dest string) (*journalExporter, error) {
+	this := &journalExporter{dest: dest}
+
+	if err := this.open(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+func (this *journalExporter) open() error {
+	var conn io.WriteCloser
+	var err error
+
+	if strings.HasPrefix(this.dest, "tcp:") {
+		conn, err = net.Dial("tcp", strings.TrimPrefix(this.dest, "tcp:"))
+	} else if strings.HasPrefix(this.dest, "unix:") {
+		conn, err = net.Dial("unix", strings.TrimPrefix(this.dest, "unix:"))
+	} else {
+		conn, err = os.OpenFile(this.dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	this.conn = conn
+	this.buf = bufio.NewWriter(conn)
+	return nil
+}
+
+func (this *journalExporter) export(entry *SystemdJournalEntry) error {
+	this.Lock()
+	defer this.Unlock()
+
+	// Reconnect after a previous failure
+	if nil == this.conn {
+		if err := this.open(); err != nil {
+			return err
+		}
+	}
+
+	raw := entry.Raw()
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, value := range journalValues(raw[key]) {
+			writeExportField(this.buf, key, value)
+		}
+	}
+
+	this.buf.WriteByte('\n')
+
+	if err := this.buf.Flush(); err != nil {
+		this.conn.Close()
+		this.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+func (this *journalExporter) Close() error {
+	this.Lock()
+	defer this.Unlock()
+
+	if nil == this.conn {
+		return nil
+	}
+
+	this.buf.Flush()
+	return this.conn.Close()
+}
+
+func writeExportField(w *bufio.Writer, key string, value []byte) {
+	if !bytes.ContainsAny(value, "\n") && isPrintable(value) {
+		w.WriteString(key)
+		w.WriteByte('=')
+		w.Write(value)
+		w.WriteByte('\n')
+		return
+	}
+
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+
+	w.WriteString(key)
+	w.WriteByte('\n')
+	w.Write(size[:])
+	w.Write(value)
+	w.WriteByte('\n')
+}
+
+func isPrintable(value []byte) bool {
+	for _, c := range value {
+		if c < ' ' && c != '\t' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The raw bytes of a field, which can be a string, an array of bytes, or an array of these for fields set multiple times
+func journalValues(raw json.RawMessage) [][]byte {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return [][]byte{[]byte(s)}
+	}
+
+	if b, ok := journal2gelf.JournalBytes(raw); ok {
+		return [][]byte{b}
+	}
+
+	var multiple []json.RawMessage
+	if err := json.Unmarshal(raw, &multiple); err != nil {
+		return nil
+	}
+
+	var values [][]byte
+	for _, value := range multiple {
+		if err := json.Unmarshal(value, &s); err == nil {
+			values = append(values, []byte(s))
+		} else if b, ok := journal2gelf.JournalBytes(value); ok {
+			values = append(values, b)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+// Severe messages which would otherwise be dropped, because no server accepted them in time or the spool is
+// full, are appended to this file as JSON lines. It is sent again once a server accepts messages
+type fallbackFile struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxLevel int32
+	size     int64
+}
+
+func openFallback(path string, maxSize int64, maxLevel int32) (*fallbackFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &fallbackFile{path: path, maxSize: maxSize, maxLevel: maxLevel, size: info.Size()}, nil
+}
+
+// Store the message when it's severe enough, a message that doesn't fit is at least logged
+func (this *fallbackFile) keep(message *gelf.Message) bool {
+	if message.Level > this.maxLevel {
+		return false
+	}
+
+	data, err := json.Marshal(newSpoolRecord(message))
+	if err != nil {
+		return false
+	}
+	data = append(data, '\n')
+
+	this.Lock()
+	defer this.Unlock()
+
+	if this.size+int64(len(data)) > this.maxSize {
+		fmt.Fprintf(os.Stderr, "Fallback file is full, dropping message from %s: %.200s\n", message.Facility, message.Short)
+		return false
+	}
+
+	f, err := os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err == nil {
+		_, err = f.Write(data)
+		if closeErr := f.Close(); nil == err {
+			err = closeErr
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write fallback file, dropping message from %s: %.200s\n", message.Facility, message.Short)
+		return false
+	}
+
+	this.size += int64(len(data))
+	atomic.AddUint64(&metrics.fallbackWritten, 1)
+	return true
+}
+
+// Periodically send the stored messages, whatever couldn't be sent stays in the file
+func (this *fallbackFile) replay() {
+	for range time.Tick(SLEEP_AFTER_ERROR) {
+		this.Lock()
+		if this.size > 0 {
+			this.send()
+		}
+		this.Unlock()
+	}
+}
+
+func (this *fallbackFile) send() {
+	data, err := ioutil.ReadFile(this.path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not read fallback file: "+err.Error())
+		return
+	}
+
+	var remaining bytes.Buffer
+	sent := 0
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(make([]byte, 64*1024), len(data)+1)
+	for s.Scan() {
+		var record spoolRecord
+		if err := json.Unmarshal(s.Bytes(), &record); err != nil {
+			continue
+		}
+
+		// Stop at the first failure, the rest would fail as well
+		message := record.message()
+		if remaining.Len() > 0 || nil != writer.WriteMessage(message) {
+			remaining.Write(s.Bytes())
+			remaining.WriteByte('\n')
+			continue
+		}
+
+		sent++
+		countSent(message)
+	}
+
+	if 0 == sent {
+		return
+	}
+
+	tmp := this.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, remaining.Bytes(), 0640); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not write fallback file: "+err.Error())
+		return
+	}
+	if err := os.Rename(tmp, this.path); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not write fallback file: "+err.Error())
+		return
+	}
+
+	this.size = int64(remaining.Len())
+	fmt.Fprintf(os.Stderr, "Sent %d messages from the fallback file\n", sent)
+}
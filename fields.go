@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Fields added to every message, and the host name replacing _HOSTNAME. Both may refer to journal
+// fields of the entry like ${MACHINE_ID}
+var (
+	staticFields = map[string]string{}
+	hostname     string
+)
+
+// Names which are set by toGelf itself, or are part of the GELF message
+var gelfFields = []string{"version", "host", "short_message", "full_message", "timestamp", "level", "facility", "id"}
+
+func setupStaticFields(fields []string, host, hostFrom string) error {
+	reserved := (&SystemdJournalEntry{}).ToGelf().Extra
+
+	for _, value := range fields {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || "" == parts[0] {
+			return fmt.Errorf("invalid field %q, expected key=value", value)
+		}
+
+		key := strings.TrimPrefix(parts[0], "_")
+		if _, ok := reserved[key]; ok {
+			return fmt.Errorf("field %s is already set for every message", key)
+		}
+		for _, name := range gelfFields {
+			if strings.EqualFold(name, key) {
+				return fmt.Errorf("field %s is part of the GELF message, use --hostname to change the host", key)
+			}
+		}
+
+		staticFields[key] = parts[1]
+	}
+
+	hostname = host
+
+	if "" != hostFrom {
+		if "" != host {
+			return fmt.Errorf("use either --hostname or --hostname-from")
+		}
+
+		parts := strings.SplitN(hostFrom, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid --hostname-from %q, expected env:NAME or file:/path", hostFrom)
+		}
+
+		switch parts[0] {
+		case "env":
+			hostname = os.Getenv(parts[1])
+		case "file":
+			data, err := ioutil.ReadFile(parts[1])
+			if err != nil {
+				return err
+			}
+			hostname = strings.TrimSpace(string(data))
+		default:
+			return fmt.Errorf("invalid --hostname-from %q, expected env:NAME or file:/path", hostFrom)
+		}
+
+		if "" == hostname {
+			return fmt.Errorf("no host name found in %s", hostFrom)
+		}
+	}
+
+	return nil
+}
+
+// Replace ${NAME} by the journal field NAME, or _NAME for trusted fields like _MACHINE_ID
+func expandFields(entry *SystemdJournalEntry, value string) string {
+	if -1 == strings.Index(value, "$") {
+		return value
+	}
+
+	return os.Expand(value, func(name string) string {
+		for _, key := range []string{name, "_" + name} {
+			if v, ok := entry.Value(key); ok {
+				return v
+			}
+		}
+
+		return ""
+	})
+}
+
+// Fields already in the message, from the entry itself, are left alone
+func addStaticFields(entry *SystemdJournalEntry, extra map[string]interface{}) {
+	for key, value := range staticFields {
+		addField(extra, key, expandFields(entry, value))
+	}
+}
+
+// Fields added after conversion, by enrichers and static fields, never replace those of the message. When
+// they differ it's counted as a conflict
+func addField(extra map[string]interface{}, key string, value interface{}) {
+	existing, ok := extra[key]
+	if !ok || "" == existing {
+		extra[key] = value
+		return
+	}
+
+	if fmt.Sprint(existing) != fmt.Sprint(value) {
+		atomic.AddUint64(&metrics.fieldConflicts, 1)
+	}
+}
+
+func host(entry *SystemdJournalEntry) string {
+	if "" == hostname {
+		return entry.Hostname
+	}
+
+	return expandFields(entry, hostname)
+}
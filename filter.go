@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+var (
+	minPriority        int32 = -1
+	excludeUnits       stringList
+	excludeIdentifiers stringList
+	dropMessages       []*regexp.Regexp
+)
+
+// Parse the filter flags, returns an error naming the offending value
+func setupFilters(priority string, messageRegexes []string) error {
+	if "" != priority {
+		p, err := parsePriority(priority)
+		if err != nil {
+			return err
+		}
+
+		minPriority = p
+	}
+
+	for _, pattern := range append(excludeUnits, excludeIdentifiers...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %s", pattern, err)
+		}
+	}
+
+	for _, pattern := range messageRegexes {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid regex %q: %s", pattern, err)
+		}
+
+		dropMessages = append(dropMessages, re)
+	}
+
+	return nil
+}
+
+// A priority by name or number
+func parsePriority(value string) (int32, error) {
+	if n, err := strconv.Atoi(value); err == nil && n >= 0 && n <= 7 {
+		return int32(n), nil
+	}
+
+	if p, ok := journal2gelf.PriorityByName(value); ok {
+		return p, nil
+	}
+
+	return 0, fmt.Errorf("unknown priority %q", value)
+}
+
+// Whether this entry should be dropped instead of sent, and count it if so. Must be called after process()
+func filtered(entry *SystemdJournalEntry) bool {
+	if isFiltered(entry) {
+		atomic.AddUint64(&metrics.entriesFiltered, 1)
+		return true
+	}
+
+	return false
+}
+
+func isFiltered(entry *SystemdJournalEntry) bool {
+	if allowed != nil && !allowed.allows(entry) {
+		return true
+	}
+
+	if minPriority >= 0 && entry.Priority > minPriority {
+		return true
+	}
+
+	if matchesAny(excludeUnits, entry.Systemd_unit) || matchesAny(excludeIdentifiers, entry.Syslog_identifier) {
+		return true
+	}
+
+	for _, re := range dropMessages {
+		if re.MatchString(entry.Message) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesAny(patterns []string, name string) bool {
+	if "" == name {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+const (
+	GELF_CHUNK_MIN    = 512
+	GELF_CHUNK_MAX    = 65467
+	GELF_CHUNK_HEADER = 12
+
+	GELF_TRUNCATE_ATTEMPTS = 5
+)
+
+// go-gelf always compresses and uses a fixed chunk size, so messages are sent by this writer instead
+var gelfOptions = struct {
+	compression string
+	level       int
+	chunkSize   int
+}{"gzip", gzip.BestSpeed, 1420}
+
+func setupGelfOptions(compression string, level int, levelSet bool, chunkSize int) error {
+	switch compression {
+	case "gzip", "zlib":
+		if level < gzip.NoCompression || level > gzip.BestCompression {
+			return fmt.Errorf("compression level %d isn't between 0 and 9", level)
+		}
+	case "none":
+		if levelSet {
+			return fmt.Errorf("a compression level can't be used without compression")
+		}
+	default:
+		return fmt.Errorf("unknown compression %q, use gzip, zlib or none", compression)
+	}
+
+	if chunkSize < GELF_CHUNK_MIN || chunkSize > GELF_CHUNK_MAX {
+		return fmt.Errorf("chunk size %d isn't between %d and %d", chunkSize, GELF_CHUNK_MIN, GELF_CHUNK_MAX)
+	}
+
+	gelfOptions.compression = compression
+	gelfOptions.level = level
+	gelfOptions.chunkSize = chunkSize
+
+	return nil
+}
+
+// The most a message can be after compression
+func gelfMaxSize() int {
+	return (gelfOptions.chunkSize - GELF_CHUNK_HEADER) * GELF_MAX_CHUNKS
+}
+
+// Shallow copy, except for Extra which truncating changes. The original may still go to other servers
+func copyMessage(message *gelf.Message) *gelf.Message {
+	copied := *message
+	copied.Extra = make(map[string]interface{}, len(message.Extra)+1)
+	for k, v := range message.Extra {
+		copied.Extra[k] = v
+	}
+
+	return &copied
+}
+
+// Sends GELF messages over UDP, split into chunks when they don't fit in a single datagram. Not safe for
+// concurrent use, the endpoint serializes writes
+type gelfWriter struct {
+	conn net.Conn
+	buf  bytes.Buffer
+}
+
+func newGelfWriter(address string) (*gelfWriter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gelfWriter{conn: conn}, nil
+}
+
+func (this *gelfWriter) WriteMessage(message *gelf.Message) error {
+	if err := this.encode(message); err != nil {
+		return err
+	}
+
+	// Servers discard messages with more chunks, so cut the text to fit. The compression ratio changes as
+	// the text gets shorter, so aim a bit lower on every further attempt
+	for i := 0; i < GELF_TRUNCATE_ATTEMPTS && this.buf.Len() > gelfMaxSize(); i++ {
+		max := messageSize(message) * gelfMaxSize() / this.buf.Len()
+		max -= max * i / 10
+
+		message = copyMessage(message)
+		truncateMessage(message, max)
+
+		if err := this.encode(message); err != nil {
+			return err
+		}
+	}
+
+	if this.buf.Len() <= gelfOptions.chunkSize {
+		_, err := this.conn.Write(this.buf.Bytes())
+		return err
+	}
+
+	return this.writeChunks(this.buf.Bytes())
+}
+
+// Serialize and compress the message into buf
+func (this *gelfWriter) encode(message *gelf.Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	this.buf.Reset()
+	switch gelfOptions.compression {
+	case "gzip":
+		w, _ := gzip.NewWriterLevel(&this.buf, gelfOptions.level)
+		w.Write(data)
+		err = w.Close()
+	case "zlib":
+		w, _ := zlib.NewWriterLevel(&this.buf, gelfOptions.level)
+		w.Write(data)
+		err = w.Close()
+	default:
+		_, err = this.buf.Write(data)
+	}
+
+	return err
+}
+
+func (this *gelfWriter) writeChunks(data []byte) error {
+	size := gelfOptions.chunkSize - GELF_CHUNK_HEADER
+	count := (len(data) + size - 1) / size
+	if count > GELF_MAX_CHUNKS {
+		return fmt.Errorf("%w, %d bytes need %d chunks, more than %d", errTooLarge, len(data), count, GELF_MAX_CHUNKS)
+	}
+
+	chunk := make([]byte, GELF_CHUNK_HEADER, gelfOptions.chunkSize)
+	chunk[0], chunk[1] = 0x1e, 0x0f
+	if _, err := rand.Read(chunk[2:10]); err != nil {
+		return err
+	}
+	chunk[11] = byte(count)
+
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunk[10] = byte(i)
+		if _, err := this.conn.Write(append(chunk[:GELF_CHUNK_HEADER], data[i*size:end]...)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *gelfWriter) Close() error {
+	return this.conn.Close()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+// A UDP socket for the writer to send to, closed with the test
+func listenGelf(tb testing.TB) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// Change the GELF options for the test only
+func withGelfOptions(tb testing.TB, compression string, chunkSize int) {
+	saved := gelfOptions
+	tb.Cleanup(func() { gelfOptions = saved })
+
+	if err := setupGelfOptions(compression, 1, false, chunkSize); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// Text that hardly compresses, so compressed messages need as many chunks
+func randomText(n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 "
+
+	r := rand.New(rand.NewSource(1))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[r.Intn(len(letters))]
+	}
+
+	return string(b)
+}
+
+// Reassemble and decompress the chunks of a single message
+func readChunked(t *testing.T, conn net.PacketConn) (map[string]interface{}, int) {
+	var chunks [][]byte
+	buf := make([]byte, GELF_CHUNK_MAX)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("after %d chunks: %s", len(chunks), err)
+		}
+
+		count := int(buf[11])
+		if nil == chunks {
+			chunks = make([][]byte, count)
+		}
+		chunks[buf[10]] = append([]byte(nil), buf[GELF_CHUNK_HEADER:n]...)
+
+		received := 0
+		for _, c := range chunks {
+			if nil != c {
+				received++
+			}
+		}
+		if received == count {
+			break
+		}
+	}
+
+	var r io.Reader = bytes.NewReader(bytes.Join(chunks, nil))
+	if "gzip" == gelfOptions.compression {
+		var err error
+		if r, err = gzip.NewReader(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var message map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&message); err != nil {
+		t.Fatal(err)
+	}
+
+	return message, len(chunks)
+}
+
+func TestGelfWriterTruncatesToChunkLimit(t *testing.T) {
+	for _, compression := range []string{"none", "gzip"} {
+		t.Run(compression, func(t *testing.T) {
+			withGelfOptions(t, compression, GELF_CHUNK_MIN)
+
+			conn := listenGelf(t)
+			w, err := newGelfWriter(conn.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+
+			original := &gelf.Message{Version: "1.1", Short: "big", Full: randomText(3 * gelfMaxSize())}
+			if err := w.WriteMessage(original); err != nil {
+				t.Fatalf("error %v, want the message truncated", err)
+			}
+
+			message, chunks := readChunked(t, conn)
+			full, _ := message["full_message"].(string)
+			if chunks > GELF_MAX_CHUNKS || true != message["_truncated"] || !strings.HasSuffix(full, TRUNCATED_MARKER) {
+				t.Errorf("sent in %d chunks, truncated: %v, want at most %d chunks and truncated", chunks, message["_truncated"], GELF_MAX_CHUNKS)
+			}
+
+			if nil != original.Extra || len(original.Full) != 3*gelfMaxSize() {
+				t.Error("original message was changed")
+			}
+		})
+	}
+}
+
+func TestGelfWriterTooLarge(t *testing.T) {
+	withGelfOptions(t, "none", GELF_CHUNK_MIN)
+
+	conn := listenGelf(t)
+	w, err := newGelfWriter(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &endpoint{address: conn.LocalAddr().String(), writer: w, healthy: true}
+	defer w.Close()
+
+	// Only the full and short message are truncated
+	message := &gelf.Message{Version: "1.1", Short: "big", Extra: map[string]interface{}{"payload": randomText(2 * gelfMaxSize())}}
+
+	writeErrors := metrics.writeErrors
+	for i := 0; i < ENDPOINT_MAX_FAILURES+1; i++ {
+		if err := e.write(message); !errors.Is(err, errTooLarge) {
+			t.Fatalf("error %v, want %v", err, errTooLarge)
+		}
+	}
+
+	if !e.healthy || 0 != e.failures || writeErrors != metrics.writeErrors {
+		t.Errorf("healthy %v after %d failures and %d write errors, want the server left alone", e.healthy, e.failures, metrics.writeErrors-writeErrors)
+	}
+
+	// Still usable
+	if err := e.write(&gelf.Message{Version: "1.1", Short: "small"}); err != nil {
+		t.Error(err)
+	}
+}
+
+// A typical journal entry, small enough for a single datagram
+func benchmarkMessage() *gelf.Message {
+	return &gelf.Message{
+		Version:  "1.1",
+		Host:     "web-01",
+		Short:    "Accepted publickey for deploy from 10.0.0.12 port 51234 ssh2: ED25519 SHA256:Jx5NqNbPjUO9m2Q5",
+		TimeUnix: 1714557600.123456,
+		Level:    6,
+		Facility: "sshd",
+		Extra: map[string]interface{}{
+			"pid":              "1234",
+			"uid":              "0",
+			"comm":             "sshd",
+			"exe":              "/usr/sbin/sshd",
+			"systemd_unit":     "ssh.service",
+			"boot_id":          "5d3a4e0c6f1b4b2e9a7c8d9e0f1a2b3c",
+			"machine_id":       "0123456789abcdef0123456789abcdef",
+			"transport":        "syslog",
+			"syslog_facility":  "4",
+			"cap_effective":    "1ffffffffff",
+			"systemd_cgroup":   "/system.slice/ssh.service",
+			"systemd_slice":    "system.slice",
+			"hostname":         "web-01",
+			"selinux_context":  "unconfined",
+			"stream_id":        "8c1f5b7e2d4a4f3c9b6a1e0d7c2f8a9b",
+			"source_timestamp": "1714557600123456",
+		},
+	}
+}
+
+func BenchmarkGelfWriter(b *testing.B) {
+	for _, compression := range []string{"none", "gzip"} {
+		b.Run(compression, func(b *testing.B) {
+			withGelfOptions(b, compression, 1420)
+
+			conn := listenGelf(b)
+			w, err := newGelfWriter(conn.LocalAddr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+
+			message := benchmarkMessage()
+			b.SetBytes(int64(messageSize(message)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := w.WriteMessage(message); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How entries are handled on this host, as resolved from the options, the config file and the rules:
+// where they come from, each step in order and where the messages go
+type pipelineGraph struct {
+	Nodes []*pipelineNode `json:"nodes"`
+	Edges []*pipelineEdge `json:"edges"`
+
+	// The nodes the next step follows
+	last []string
+}
+
+// Kind is source, process, filter, enricher or output
+type pipelineNode struct {
+	Id      string                 `json:"id"`
+	Kind    string                 `json:"kind"`
+	Label   string                 `json:"label"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+type pipelineEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Label string `json:"label,omitempty"`
+}
+
+// Entries of all sources go through the first step
+func (this *pipelineGraph) source(id, label string, details map[string]interface{}) {
+	this.Nodes = append(this.Nodes, &pipelineNode{Id: id, Kind: "source", Label: label, Details: details})
+	this.last = append(this.last, id)
+}
+
+// A step all entries go through after the previous one
+func (this *pipelineGraph) step(id, kind, label string, details map[string]interface{}) {
+	this.Nodes = append(this.Nodes, &pipelineNode{Id: id, Kind: kind, Label: label, Details: details})
+	for _, from := range this.last {
+		this.Edges = append(this.Edges, &pipelineEdge{From: from, To: id})
+	}
+	this.last = []string{id}
+}
+
+// A node only some or a copy of the entries go to, the next step follows the previous one
+func (this *pipelineGraph) branch(id, kind, label, edge string, details map[string]interface{}) {
+	this.Nodes = append(this.Nodes, &pipelineNode{Id: id, Kind: kind, Label: label, Details: details})
+	for _, from := range this.last {
+		this.Edges = append(this.Edges, &pipelineEdge{From: from, To: id, Label: edge})
+	}
+}
+
+// The graph of the options and current rules, with the state of the output buffers when running
+func buildPipeline(servers string, journalArgs []string) *pipelineGraph {
+	this := &pipelineGraph{}
+
+	if *readStdin {
+		this.source("stdin", "stdin", nil)
+	} else {
+		this.source("journalctl", "journalctl", map[string]interface{}{"arguments": journalArgs})
+	}
+	if "" != *socketPath {
+		this.source("socket", "socket "+*socketPath, nil)
+	}
+	if "" != *httpSocket {
+		this.source("http-socket", "HTTP socket "+*httpSocket, nil)
+	}
+
+	this.step("rules", "process", "rewrite rules", ruleDetails())
+
+	if names := nonEmpty(strings.Split(*parserList, ",")); nil != names {
+		this.step("parsers", "process", "parsers", map[string]interface{}{"parsers": names})
+	}
+	if ooms != nil {
+		this.step("oom-events", "process", "OOM killer events", nil)
+	}
+	if *securityFlag {
+		this.step("security-events", "process", "security events", map[string]interface{}{"stream": *securityStream})
+	}
+	if jobs != nil {
+		this.branch("job-events", "process", "job outcomes", "", nil)
+	}
+
+	if details := filterDetails(); nil != details {
+		this.step("filters", "filter", "filters", details)
+	}
+	if statuses != nil {
+		var names []string
+		for _, m := range statuses.matchers {
+			names = append(names, m.name)
+		}
+		this.step("status-change", "filter", "status changes", map[string]interface{}{"matchers": names, "interval": statuses.interval.String()})
+	}
+	if unitLimits != nil {
+		this.step("unit-rate-limit", "filter", "unit rate limit", map[string]interface{}{"rate": *unitRateLimit, "burst": unitLimits.burst, "exempt": unitLimits.exempt})
+	}
+
+	if "" != *exportDest {
+		this.branch("export", "output", "export "+*exportDest, "copy", map[string]interface{}{"queue": queueDetails("export")})
+	}
+
+	this.step("forwarder", "process", "merge and collapse", map[string]interface{}{
+		"merge_max_lines":   *mergeMaxLines,
+		"merge_max_bytes":   *mergeMaxBytes,
+		"collapse":          !*noCollapse,
+		"collapse_interval": collapseEvery.String(),
+		"senders":           *senderCount,
+		"immediate":         *immediatePrio,
+	})
+	if jobs != nil {
+		this.Edges = append(this.Edges, &pipelineEdge{From: "job-events", To: "forwarder"})
+	}
+
+	this.step("fields", "process", "fields", fieldDetails())
+
+	for _, e := range enrichers {
+		this.step("enrich-"+e.name, "enricher", e.name, map[string]interface{}{"ttl": e.ttl.String(), "cache_size": e.size})
+	}
+	if resources != nil {
+		this.step("resource-stats", "enricher", "resource-stats", nil)
+	}
+
+	if "" != *s3Url {
+		this.branch("s3", "output", "S3 "+*s3Url, "copy", map[string]interface{}{"format": *s3Format, "key": *s3Key})
+	}
+	if *rateLimit > 0 {
+		this.step("rate-limit", "filter", "rate limit", map[string]interface{}{"per_second": *rateLimit})
+	}
+
+	this.step("deliver", "process", "deliver", map[string]interface{}{"retry_timeout": retryTimeout.String()})
+	if "" != *securityServer && !*dryRun {
+		this.branch("security-server", "output", "security server "+*securityServer, "security events", serverDetails(*securityServer, "security"))
+	}
+	if "" != *fallbackPath {
+		this.branch("fallback", "output", "fallback file "+*fallbackPath, "dropped, "+*fallbackLevel+" or more severe", map[string]interface{}{"max_size": *fallbackSize})
+	}
+	if "" != *spoolDir {
+		this.step("spool", "process", "spool "+*spoolDir, map[string]interface{}{"max_size": *spoolMaxSize, "max_age": spoolMaxAge.String()})
+	}
+
+	if *dryRun {
+		this.step("stdout", "output", "stdout", nil)
+	} else if "" != servers {
+		this.step("servers", "output", "servers "+servers, serverDetails(servers, ""))
+	}
+
+	return this
+}
+
+func nonEmpty(values []string) []string {
+	var result []string
+	for _, v := range values {
+		if "" != v {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// The identifiers which have rules, by the stable rules and the canary when one runs
+func ruleDetails() map[string]interface{} {
+	ruleLock.RLock()
+	defer ruleLock.RUnlock()
+
+	describe := func(set *ruleSet) map[string]interface{} {
+		rewrite, downgrades, timezones := map[string]bool{}, map[string]bool{}, map[string]bool{}
+		for id := range set.rules.Rewrite {
+			rewrite[id] = true
+		}
+		for id := range set.rules.Downgrades {
+			downgrades[id] = true
+		}
+		for id := range set.rules.Timezones {
+			timezones[id] = true
+		}
+		normalized := map[string]bool{}
+		for field := range set.normalizers {
+			normalized[field] = true
+		}
+
+		details := map[string]interface{}{}
+		for name, ids := range map[string]map[string]bool{"rewrite": rewrite, "downgrade": downgrades, "timezones": timezones, "normalized": normalized} {
+			if len(ids) > 0 {
+				details[name] = sortedKeys(ids)
+			}
+		}
+		if "" != set.version && NO_BUNDLE != set.version {
+			details["version"] = set.version
+		}
+
+		return details
+	}
+
+	details := describe(stableRules)
+	if nil != canary {
+		c := describe(canary.rules)
+		c["percent"] = canary.percent
+		c["started"] = canary.started.Format(time.RFC3339)
+		details["canary"] = c
+	}
+
+	return details
+}
+
+func filterDetails() map[string]interface{} {
+	details := map[string]interface{}{}
+
+	if allowed != nil {
+		allowed.RLock()
+		details["allowlist"] = map[string]interface{}{"path": allowed.path, "patterns": len(allowed.patterns)}
+		allowed.RUnlock()
+	}
+	if minPriority >= 0 {
+		details["min_priority"] = minPriority
+	}
+	if nil != excludeUnits {
+		details["exclude_units"] = excludeUnits
+	}
+	if nil != excludeIdentifiers {
+		details["exclude_identifiers"] = excludeIdentifiers
+	}
+	if nil != dropMessages {
+		var patterns []string
+		for _, re := range dropMessages {
+			patterns = append(patterns, re.String())
+		}
+		details["drop_message_regex"] = patterns
+	}
+
+	if 0 == len(details) {
+		return nil
+	}
+
+	return details
+}
+
+func fieldDetails() map[string]interface{} {
+	static := map[string]bool{}
+	for key := range staticFields {
+		static[key] = true
+	}
+
+	details := map[string]interface{}{
+		"multi_value":      *multiValue,
+		"field_conflicts":  *fieldConflicts,
+		"static":           sortedKeys(static),
+		"max_message_size": *maxMessageFlag,
+	}
+	if nil != excludeFields {
+		details["exclude"] = excludeFields
+	}
+	if *internalFields {
+		details["internal_fields"] = true
+	}
+	if *splitRequests {
+		details["decompose_requests"] = true
+	}
+	if *messageIds {
+		details["message_id"] = true
+	}
+	if "" != hostname {
+		details["hostname"] = hostname
+	}
+
+	return details
+}
+
+func serverDetails(servers, queue string) map[string]interface{} {
+	addresses := strings.Split(servers, ",")
+	details := map[string]interface{}{"addresses": addresses}
+	if len(addresses) > 1 {
+		details["mode"] = *deliveryMode
+	}
+
+	if "" != queue {
+		details["queue"] = queueDetails(queue)
+	} else if DELIVERY_ALL == *deliveryMode && len(addresses) > 1 {
+		queues := map[string]interface{}{}
+		for _, address := range addresses {
+			queues[address] = queueDetails(address)
+		}
+		details["queues"] = queues
+	}
+
+	return details
+}
+
+// The buffer of the output, and how it's doing when running
+func queueDetails(name string) map[string]interface{} {
+	outputs.Lock()
+	defer outputs.Unlock()
+
+	for _, q := range outputs.queues {
+		if name == q.name {
+			return map[string]interface{}{
+				"buffer":      cap(q.items),
+				"queued":      len(q.items),
+				"sent":        atomic.LoadUint64(&q.sent),
+				"dropped":     atomic.LoadUint64(&q.dropped),
+				"lag_seconds": q.lag(),
+			}
+		}
+	}
+
+	return map[string]interface{}{"buffer": *outputBuffer}
+}
+
+var nodeShapes = map[string]string{"source": "ellipse", "filter": "octagon", "enricher": "component", "output": "cylinder"}
+
+// As JSON, or as DOT for Graphviz
+func (this *pipelineGraph) format(format string) ([]byte, error) {
+	switch format {
+	case "json":
+		return json.MarshalIndent(this, "", "\t")
+	case "dot":
+		var b strings.Builder
+		b.WriteString("digraph pipeline {\n\trankdir=LR;\n")
+		for _, n := range this.Nodes {
+			shape := nodeShapes[n.Kind]
+			if "" == shape {
+				shape = "box"
+			}
+			fmt.Fprintf(&b, "\t%q [label=%q shape=%s];\n", n.Id, n.Label, shape)
+		}
+		for _, e := range this.Edges {
+			if "" == e.Label {
+				fmt.Fprintf(&b, "\t%q -> %q;\n", e.From, e.To)
+			} else {
+				fmt.Fprintf(&b, "\t%q -> %q [label=%q];\n", e.From, e.To, e.Label)
+			}
+		}
+		b.WriteString("}\n")
+		return []byte(b.String()), nil
+	}
+
+	return nil, fmt.Errorf("unknown format %q, expected json or dot", format)
+}
+
+// Serves the pipeline of the running process on /pipeline, with ?format=dot for Graphviz
+func listenControl(path, servers string, journalArgs []string) (net.Listener, error) {
+	socket, err := openSocket(path, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pipeline", func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if "" == format {
+			format = "json"
+		}
+
+		data, err := buildPipeline(servers, journalArgs).format(format)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Write(data)
+	})
+	go (&http.Server{Handler: mux, ReadTimeout: time.Minute}).Serve(socket.listener)
+
+	return socket.listener, nil
+}
+
+// pipeline show prints the pipeline of the process running with --control-socket, or without it the
+// pipeline the options would result in
+func pipelineCommand(servers string, journalArgs []string) int {
+	var data []byte
+	var err error
+
+	if "" != *controlSocket {
+		data, err = fetchPipeline(*controlSocket, *pipelineFormat)
+	} else {
+		data, err = buildPipeline(servers, journalArgs).format(*pipelineFormat)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "While showing pipeline: %s\n", err)
+		return 1
+	}
+
+	os.Stdout.Write(data)
+	if len(data) > 0 && '\n' != data[len(data)-1] {
+		fmt.Println()
+	}
+
+	return 0
+}
+
+func fetchPipeline(path, format string) ([]byte, error) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://control/pipeline?format=" + url.QueryEscape(format))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if http.StatusOK != resp.StatusCode {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(string(data)))
+	}
+
+	return data, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+// Names of record fields which are mapped onto journal fields, all others are sent as they are
+var recordFields = map[string]string{
+	"message":    "MESSAGE",
+	"priority":   "PRIORITY",
+	"level":      "PRIORITY",
+	"identifier": "SYSLOG_IDENTIFIER",
+}
+
+// Larger requests are refused, send large batches in parts
+const INGEST_MAX_BODY = 16 * 1024 * 1024
+
+type credentialsKey struct{}
+
+// Applications which can't write to the journal POST records to /entries on this socket: a JSON object,
+// an array of them or one object per line. Records are tagged with source=direct, and handled like
+// entries of the journal
+func listenHttpSocket(path string, forwarder *journal2gelf.Forwarder) (*entrySocket, error) {
+	this, err := openSocket(path, forwarder, INGEST_MAX_BODY)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/entries", this.serveEntries)
+
+	server := &http.Server{
+		Handler:     mux,
+		ReadTimeout: time.Minute,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			cred, _ := peerCredentials(conn.(*net.UnixConn))
+			return context.WithValue(ctx, credentialsKey{}, cred)
+		},
+	}
+	go server.Serve(this.listener)
+
+	return this, nil
+}
+
+func (this *entrySocket) serveEntries(w http.ResponseWriter, r *http.Request) {
+	if http.MethodPost != r.Method {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cred, _ := r.Context().Value(credentialsKey{}).(*syscall.Ucred)
+	if nil == cred {
+		http.Error(w, "unknown client", http.StatusForbidden)
+		return
+	}
+
+	// Parse all records first, so either all of them are accepted or none
+	var entries []*SystemdJournalEntry
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(this.maxLine)))
+	for {
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var records []map[string]interface{}
+		if bytes.HasPrefix(bytes.TrimSpace(value), []byte("[")) {
+			if err := json.Unmarshal(value, &records); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else {
+			records = make([]map[string]interface{}, 1)
+			if err := json.Unmarshal(value, &records[0]); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		for i, record := range records {
+			entry, err := recordEntry(record)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("record %d: %s", len(entries)+i+1, err), http.StatusBadRequest)
+				return
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	for _, entry := range entries {
+		atomic.AddUint64(&metrics.entriesRead, 1)
+
+		if !this.handle(entry, cred, "http") {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"accepted\":%d}\n", len(entries))
+}
+
+// A record has a message and any other fields, numbers and booleans are sent as text. The timestamp is in
+// seconds since the epoch like GELF, or RFC 3339
+func recordEntry(record map[string]interface{}) (*SystemdJournalEntry, error) {
+	message, ok := record["message"].(string)
+	if !ok || "" == message {
+		return nil, fmt.Errorf("message is missing")
+	}
+
+	entry := journal2gelf.NewEntry(message).Field("source", "direct")
+	for name, value := range record {
+		if "message" == name || nil == value {
+			continue
+		}
+
+		if strings.HasPrefix(name, "_") {
+			return nil, fmt.Errorf("field %s: names starting with _ are reserved", name)
+		}
+
+		if "timestamp" == name {
+			t, err := recordTime(value)
+			if err != nil {
+				return nil, err
+			}
+			entry.Time(t)
+			continue
+		}
+
+		if mapped, ok := recordFields[name]; ok {
+			name = mapped
+		}
+
+		switch v := value.(type) {
+		case string:
+			entry.Field(name, v)
+		case float64:
+			entry.Field(name, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			entry.Field(name, strconv.FormatBool(v))
+		default:
+			data, _ := json.Marshal(v)
+			entry.Field(name, string(data))
+		}
+	}
+
+	return entry.Build()
+}
+
+func recordTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case float64:
+		return time.Unix(0, int64(v*1e9)), nil
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return t, fmt.Errorf("invalid timestamp %q, expected RFC 3339", v)
+		}
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid timestamp, expected seconds or RFC 3339")
+}
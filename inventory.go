@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+// Send a single message describing this host and how SystemdJournal2Gelf runs, so every start leaves
+// an inventory record in Graylog under the same host as the messages that follow
+func sendInventory(args []string) {
+	entry := localEntry()
+
+	extra := map[string]interface{}{
+		"event":       "startup",
+		"config_hash": configHash(args),
+	}
+
+	if kernel := readProcFile("/proc/sys/kernel/osrelease"); "" != kernel {
+		extra["kernel"] = kernel
+	}
+
+	if uptime := strings.Fields(readProcFile("/proc/uptime")); len(uptime) > 0 {
+		if seconds, err := strconv.ParseFloat(uptime[0], 64); nil == err {
+			extra["uptime_seconds"] = seconds
+		}
+	}
+
+	if out, err := exec.Command("systemctl", "--version").Output(); nil == err {
+		// systemd 252 (252.22-1~deb12u1)
+		if fields := strings.Fields(string(out)); len(fields) > 1 {
+			extra["systemd_version"] = fields[1]
+		}
+	}
+
+	if out, err := exec.Command("systemctl", "list-unit-files", "--state=enabled", "--no-legend").Output(); nil == err {
+		count := 0
+		for s := bufio.NewScanner(bytes.NewReader(out)); s.Scan(); {
+			if "" != strings.TrimSpace(s.Text()) {
+				count++
+			}
+		}
+		extra["enabled_units"] = count
+	}
+
+	for _, key := range []string{"_MACHINE_ID", "_BOOT_ID"} {
+		if value, ok := entry.Value(key); ok && "" != value {
+			extra[strings.ToLower(strings.TrimPrefix(key, "_"))] = value
+		}
+	}
+
+	addStaticFields(entry, extra)
+
+	deliver(&gelf.Message{
+		Version:  "1.1",
+		Host:     host(entry),
+		Short:    "SystemdJournal2Gelf started",
+		TimeUnix: float64(time.Now().UnixNano()/1000) / 1e6,
+		Level:    6,
+		Facility: "SystemdJournal2Gelf",
+		Extra:    extra,
+	})
+}
+
+// An entry with the trusted fields journald would add for this host, so --hostname and --field can refer
+// to them just like for entries from the journal
+func localEntry() *SystemdJournalEntry {
+	name, _ := os.Hostname()
+	data, _ := json.Marshal(map[string]string{
+		"_HOSTNAME":   name,
+		"_MACHINE_ID": readProcFile("/etc/machine-id"),
+		"_BOOT_ID":    strings.Replace(readProcFile("/proc/sys/kernel/random/boot_id"), "-", "", -1),
+	})
+
+	entry, _ := journal2gelf.ParseEntry(data)
+	return entry
+}
+
+// Hash of the options, the journalctl arguments and the files they refer to, to tell which hosts run
+// with the same configuration
+func configHash(args []string) string {
+	h := sha256.New()
+
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(h, "--%s=%s\n", f.Name, f.Value)
+	})
+	for _, arg := range args {
+		fmt.Fprintf(h, "%s\n", arg)
+	}
+
+	for _, path := range []string{*rewriteFile, *normalizeFile, *allowlistFile} {
+		if data, err := ioutil.ReadFile(path); nil == err {
+			h.Write(data)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func readProcFile(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
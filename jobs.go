@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+const JOB_MAX_TRACKED = 10000
+
+var (
+	// backup.service: Main process exited, code=exited, status=1/FAILURE
+	jobExitedLine = regexp.MustCompile(`^\S+: Main process exited, code=(\w+), status=(\d+)`)
+	// backup.service: Failed with result 'exit-code'.
+	jobResultLine = regexp.MustCompile(`^\S+: Failed with result '([^']*)'`)
+	// (root) CMD (/usr/local/bin/backup.sh)
+	cronStartLine = regexp.MustCompile(`^\(([^)]+)\) CMD \((.*)\)$`)
+	// (root) CMDEND (/usr/local/bin/backup.sh), or the session of the job closing
+	cronEndLine  = regexp.MustCompile(`^(?:\([^)]+\) (?:CMDEND|END) \(|pam_unix\(cron:session\): session closed)`)
+	cronExitLine = regexp.MustCompile(`exit status (\d+)`)
+)
+
+var cronIdentifiers = stringList{"CRON", "cron", "crond"}
+
+// A job which started and hasn't ended yet
+type job struct {
+	kind       string
+	name       string
+	user       string
+	started    int64
+	exitStatus string
+	signal     string
+	result     string
+}
+
+// Pairs the start and end of jobs: services which finish, like those started by a timer, and cron jobs.
+// When a job ends an entry describing its outcome and duration is made, so whether it ran is a single
+// query away. Only sees entries in the order they're read, so it must be called from the reader
+type jobTracker struct {
+	running map[string]*job
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{running: map[string]*job{}}
+}
+
+// Returns the outcome of the job the entry ends, if any
+func (this *jobTracker) observe(entry *SystemdJournalEntry) *SystemdJournalEntry {
+	if unit := entry.Fields["UNIT"]; "systemd" == entry.Syslog_identifier && "1" == entry.Pid && "" != unit {
+		return this.observeService(entry, unit)
+	}
+
+	if cronIdentifiers.contains(entry.Syslog_identifier) && "" != entry.Pid {
+		return this.observeCron(entry)
+	}
+
+	return nil
+}
+
+// Services which start and keep running are no jobs, they're forgotten once started
+func (this *jobTracker) observeService(entry *SystemdJournalEntry, unit string) *SystemdJournalEntry {
+	key := entry.Hostname + "\x00" + unit
+	running := this.running[key]
+
+	switch {
+	case strings.HasPrefix(entry.Message, "Starting "):
+		this.start(key, &job{kind: "systemd", name: unit, started: entry.Realtime_timestamp})
+	case strings.HasPrefix(entry.Message, "Started "):
+		delete(this.running, key)
+	case nil == running:
+	case strings.HasPrefix(entry.Message, "Finished "):
+		delete(this.running, key)
+		if "" == running.exitStatus {
+			running.exitStatus = "0"
+		}
+		return running.outcome(entry, true)
+	case strings.HasPrefix(entry.Message, "Failed to start "):
+		delete(this.running, key)
+		return running.outcome(entry, false)
+	default:
+		if m := jobExitedLine.FindStringSubmatch(entry.Message); nil != m {
+			if "exited" == m[1] {
+				running.exitStatus = m[2]
+			} else {
+				running.signal = m[2]
+			}
+		} else if m := jobResultLine.FindStringSubmatch(entry.Message); nil != m {
+			running.result = m[1]
+		}
+	}
+
+	return nil
+}
+
+// Every job runs in its own cron process, which logs both the start and the end
+func (this *jobTracker) observeCron(entry *SystemdJournalEntry) *SystemdJournalEntry {
+	key := entry.Hostname + "\x00" + entry.Pid
+
+	if m := cronStartLine.FindStringSubmatch(entry.Message); nil != m {
+		this.start(key, &job{kind: "cron", name: m[2], user: m[1], started: entry.Realtime_timestamp})
+		return nil
+	}
+
+	running := this.running[key]
+	if nil == running {
+		return nil
+	}
+
+	if m := cronExitLine.FindStringSubmatch(entry.Message); nil != m {
+		running.exitStatus = m[1]
+	}
+
+	if !cronEndLine.MatchString(entry.Message) {
+		return nil
+	}
+
+	delete(this.running, key)
+	return running.outcome(entry, "" == running.exitStatus || "0" == running.exitStatus)
+}
+
+func (this *jobTracker) start(key string, j *job) {
+	if len(this.running) >= JOB_MAX_TRACKED {
+		this.running = map[string]*job{}
+	}
+
+	this.running[key] = j
+}
+
+// An entry of the same host as the one ending the job, at the same time
+func (this *job) outcome(end *SystemdJournalEntry, success bool) *SystemdJournalEntry {
+	duration := float64(end.Realtime_timestamp-this.started) / 1e6
+
+	outcome, priority := "success", "6"
+	message := fmt.Sprintf("Job %s succeeded after %.1fs", this.name, duration)
+	if !success {
+		outcome, priority = "failure", "3"
+		message = fmt.Sprintf("Job %s failed after %.1fs", this.name, duration)
+	}
+
+	fields := map[string]string{
+		"MESSAGE":              message,
+		"PRIORITY":             priority,
+		"SYSLOG_IDENTIFIER":    end.Syslog_identifier,
+		"__REALTIME_TIMESTAMP": strconv.FormatInt(end.Realtime_timestamp, 10),
+		"_HOSTNAME":            end.Hostname,
+		"_MACHINE_ID":          end.Machine_id,
+		"_BOOT_ID":             end.Boot_id,
+		"_SYSTEMD_UNIT":        end.Systemd_unit,
+	}
+	if "systemd" == this.kind {
+		fields["_SYSTEMD_UNIT"] = this.name
+	}
+
+	data, _ := json.Marshal(fields)
+	entry, err := journal2gelf.ParseEntry(data)
+	if err != nil {
+		return nil
+	}
+
+	entry.SetField("event", "job_outcome")
+	entry.SetField("job_kind", this.kind)
+	entry.SetField("job_name", this.name)
+	entry.SetField("job_user", this.user)
+	entry.SetField("job_outcome", outcome)
+	entry.SetField("job_duration_seconds", strconv.FormatFloat(duration, 'f', 3, 64))
+	entry.SetField("job_exit_status", this.exitStatus)
+	entry.SetField("job_signal", this.signal)
+	entry.SetField("job_result", this.result)
+
+	return entry
+}
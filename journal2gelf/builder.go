@@ -0,0 +1,68 @@
+package journal2gelf
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+)
+
+// An entry made by a program instead of read from the journal, with fields named like journal fields.
+// Fields which aren't journal fields are sent as additional fields, like those of the journal:
+//
+//	entry := journal2gelf.NewEntry("Order shipped").Identifier("shop").Field("ORDER_ID", "42")
+type Entry struct {
+	fields map[string]string
+}
+
+// An info entry of now, on this host
+func NewEntry(message string) *Entry {
+	hostname, _ := os.Hostname()
+
+	return (&Entry{fields: map[string]string{}}).
+		Field("MESSAGE", message).
+		Field("_HOSTNAME", hostname).
+		Priority(DEFAULT_PRIORITY).
+		Time(time.Now())
+}
+
+// Priority as in syslog(3), 0 for emergency to 7 for debug
+func (this *Entry) Priority(priority int32) *Entry {
+	return this.Field("PRIORITY", strconv.Itoa(int(priority)))
+}
+
+// The program the entry is of, like the SYSLOG_IDENTIFIER of journal entries
+func (this *Entry) Identifier(identifier string) *Entry {
+	return this.Field("SYSLOG_IDENTIFIER", identifier)
+}
+
+// When the event happened
+func (this *Entry) Time(t time.Time) *Entry {
+	return this.Field("__REALTIME_TIMESTAMP", strconv.FormatInt(t.UnixNano()/1000, 10))
+}
+
+// Set a field, an empty value removes it
+func (this *Entry) Field(name, value string) *Entry {
+	if "" == value {
+		delete(this.fields, name)
+	} else {
+		this.fields[name] = value
+	}
+
+	return this
+}
+
+// The entry as a line of journalctl --output=json
+func (this *Entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.fields)
+}
+
+// The entry as if read from the journal, to be processed and added to a Forwarder
+func (this *Entry) Build() (*SystemdJournalEntry, error) {
+	data, err := this.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseEntry(data)
+}
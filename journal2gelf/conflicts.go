@@ -0,0 +1,53 @@
+package journal2gelf
+
+import (
+	"fmt"
+)
+
+// How a key of a JSON message which the entry already has a field for is handled. Keys set by more than
+// one source take the value of the source with the highest precedence: the JSON message, then fields set
+// by rewrite rules and parsers, then the named fields like Pid and last the other journal fields
+type ConflictMode string
+
+const (
+	// The value of the JSON message replaces the field of the entry
+	CONFLICT_OVERWRITE ConflictMode = "overwrite"
+	// The field of the entry keeps its key, the value of the JSON message is sent with CONFLICT_SUFFIX appended
+	CONFLICT_SUFFIX ConflictMode = "suffix"
+)
+
+const CONFLICT_KEY_SUFFIX = "_message_json"
+
+func ParseConflictMode(name string) (ConflictMode, error) {
+	switch mode := ConflictMode(name); mode {
+	case CONFLICT_OVERWRITE, CONFLICT_SUFFIX:
+		return mode, nil
+	}
+
+	return "", fmt.Errorf("unknown conflict mode %q, expected overwrite or suffix", name)
+}
+
+// Empty named fields are left out of the message, so they don't conflict
+func isSet(extra map[string]interface{}, key string) bool {
+	value, ok := extra[key]
+	return ok && "" != value
+}
+
+// Add the fields of a JSON message to extra, by the mode. Returns the number of conflicts
+func mergeJsonFields(fields, extra map[string]interface{}, mode ConflictMode) int {
+	conflicts := 0
+	for key, value := range fields {
+		if !isSet(extra, key) || extra[key] == value {
+			extra[key] = value
+			continue
+		}
+
+		conflicts++
+		if CONFLICT_SUFFIX == mode {
+			key += CONFLICT_KEY_SUFFIX
+		}
+		extra[key] = value
+	}
+
+	return conflicts
+}
@@ -0,0 +1,349 @@
+// Package journal2gelf converts entries of systemd's journal, as written by journalctl --output=json, to
+// GELF messages for Graylog. A Forwarder merges consecutive lines of a process and sends the messages.
+package journal2gelf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+http://www.freedesktop.org/software/systemd/man/systemd.journal-fields.html
+https://github.com/Graylog2/graylog2-docs/wiki/GELF
+*/
+type SystemdJournalEntry struct {
+	Cursor                     string `json:"__CURSOR"`
+	Realtime_timestamp         int64  `json:"__REALTIME_TIMESTAMP,string"`
+	Monotonic_timestamp        string `json:"__MONOTONIC_TIMESTAMP"`
+	Boot_id                    string `json:"_BOOT_ID"`
+	Transport                  string `json:"_TRANSPORT"`
+	Priority                   int32  `json:"-"`
+	Syslog_facility            string `json:"SYSLOG_FACILITY"`
+	Syslog_identifier          string `json:"SYSLOG_IDENTIFIER"`
+	Message                    string `json:"MESSAGE"`
+	Pid                        string `json:"_PID"`
+	Uid                        string `json:"_UID"`
+	Gid                        string `json:"_GID"`
+	Comm                       string `json:"_COMM"`
+	Exe                        string `json:"_EXE"`
+	Cmdline                    string `json:"_CMDLINE"`
+	Systemd_cgroup             string `json:"_SYSTEMD_CGROUP"`
+	Systemd_session            string `json:"_SYSTEMD_SESSION"`
+	Systemd_owner_uid          string `json:"_SYSTEMD_OWNER_UID"`
+	Systemd_unit               string `json:"_SYSTEMD_UNIT"`
+	Source_realtime_timestamp  string `json:"_SOURCE_REALTIME_TIMESTAMP"`
+	Machine_id                 string `json:"_MACHINE_ID"`
+	Hostname                   string `json:"_HOSTNAME"`
+	Logger                     string `json:"LOGGER"`
+	EventId                    string `json:"EVENTID"`
+	Exception                  string `json:"EXCEPTION"`
+	Exception_type             string `json:"EXCEPTION_TYPE"`
+	Exception_Stacktrace       string `json:"EXCEPTION_STACKTRACE"`
+	Inner_exception            string `json:"INNEREXCEPTION"`
+	Inner_exception_type       string `json:"INNEREXCEPTION_TYPE"`
+	Inner_exception_Stacktrace string `json:"INNEREXCEPTION_STACKTRACE"`
+	Status_code                string `json:"STATUSCODE"`
+	Query_string               string `json:"QUERYSTRING"`
+	Member_id                  string `json:"MEMBERID"`
+	Correlation_id             string `json:"CORRELATIONID"`
+	Request_path               string `json:"REQUESTPATH"`
+	Request_id                 string `json:"REQUESTID"`
+	FullMessage                string
+	Fields                     map[string]string `json:"-"`
+
+	raw               map[string]json.RawMessage
+	multiValues       MultiValuePolicy
+	hasPriority       bool
+	mergedLines       int
+	lastTimestamp     int64
+	lastCursor        string
+	repeats           int
+	conflicts         int
+	ruleFields        map[string]bool
+	embeddedTime      string
+	embeddedTimestamp int64
+}
+
+// Fields already mapped onto the GELF message, all others are forwarded in Extra as-is
+var consumedFields = map[string]bool{
+	"MESSAGE":                   true,
+	"SYSLOG_FACILITY":           true,
+	"_TRANSPORT":                true,
+	"PRIORITY":                  true,
+	"SYSLOG_IDENTIFIER":         true,
+	"_HOSTNAME":                 true,
+	"_BOOT_ID":                  true,
+	"_PID":                      true,
+	"_UID":                      true,
+	"LOGGER":                    true,
+	"EVENTID":                   true,
+	"EXCEPTION":                 true,
+	"EXCEPTION_TYPE":            true,
+	"EXCEPTION_STACKTRACE":      true,
+	"INNEREXCEPTION":            true,
+	"INNEREXCEPTION_TYPE":       true,
+	"INNEREXCEPTION_STACKTRACE": true,
+	"STATUSCODE":                true,
+	"QUERYSTRING":               true,
+	"MEMBERID":                  true,
+	"CORRELATIONID":             true,
+	"REQUESTPATH":               true,
+	"REQUESTID":                 true,
+}
+
+// Names of the syslog facility codes, as used by syslog(3) and RFC 5424
+var facilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp",
+	"ntp", "audit", "alert", "clock", "local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// Unknown codes are passed as is
+func facilityName(code string) string {
+	if n, err := strconv.Atoi(code); err == nil && n >= 0 && n < len(facilities) {
+		return facilities[n]
+	}
+
+	return code
+}
+
+const (
+	DOWNGRADE_PRIORITY = 6
+	DEFAULT_PRIORITY   = 6
+	MAX_PRIORITY       = 7
+)
+
+var priorities = map[string]int32{
+	"emergency": 0,
+	"emerg":     0,
+	"alert":     1,
+	"critical":  2,
+	"crit":      2,
+	"error":     3,
+	"err":       3,
+	"warning":   4,
+	"warn":      4,
+	"notice":    5,
+	"info":      6,
+	"debug":     7,
+}
+
+// A priority by its name, like err or warning
+func PriorityByName(name string) (int32, bool) {
+	p, ok := priorities[strings.ToLower(name)]
+	return p, ok
+}
+
+// How ParseEntryWith decodes an entry
+type ParseOptions struct {
+	MultiValues MultiValuePolicy
+}
+
+func DefaultParseOptions() ParseOptions {
+	return ParseOptions{MultiValues: DefaultMultiValuePolicy()}
+}
+
+// Parse a line of journalctl --output=json
+func ParseEntry(data []byte) (*SystemdJournalEntry, error) {
+	return ParseEntryWith(data, DefaultParseOptions())
+}
+
+// Parse a line of journalctl --output=json with other than the default options
+func ParseEntryWith(data []byte, options ParseOptions) (*SystemdJournalEntry, error) {
+	entry := &SystemdJournalEntry{multiValues: options.MultiValues}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Entries decoded by json.Unmarshal instead of ParseEntryWith use the default options
+func (this *SystemdJournalEntry) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	this.raw = raw
+
+	if "" == this.multiValues.Mode {
+		this.multiValues = DefaultMultiValuePolicy()
+	}
+
+	// Values journald wrote as array of bytes can't be decoded into the string fields, replace them by a string.
+	// The same for fields set more than once, which journald writes as an array of values
+	var decoded map[string]json.RawMessage
+	for key, value := range raw {
+		if len(value) == 0 || '[' != value[0] {
+			continue
+		}
+
+		var fields map[string]string
+		if b, ok := JournalBytes(value); ok {
+			fields = map[string]string{key: strings.ToValidUTF8(string(b), string(utf8.RuneError))}
+		} else if values, ok := JournalValues(value); ok {
+			fields = this.multiValues.apply(key, values)
+		} else {
+			continue
+		}
+
+		if nil == decoded {
+			decoded = make(map[string]json.RawMessage, len(raw))
+			for k, v := range raw {
+				decoded[k] = v
+			}
+		}
+
+		for k, v := range fields {
+			decoded[k], _ = json.Marshal(v)
+		}
+	}
+
+	if nil != decoded {
+		data, _ = json.Marshal(decoded)
+	} else {
+		decoded = raw
+	}
+	// Use a type without methods to prevent recursing into this function
+	type entry SystemdJournalEntry
+	if err := json.Unmarshal(data, (*entry)(this)); err != nil {
+		return err
+	}
+
+	this.Fields = make(map[string]string)
+	this.parsePriority(decoded["PRIORITY"])
+	for key, value := range decoded {
+		if consumedFields[key] {
+			continue
+		}
+
+		// Double underscored fields are journald's internal bookkeeping, they're only available through Raw
+		if strings.HasPrefix(key, "__") {
+			continue
+		}
+
+		if v, ok := JournalValue(value); ok {
+			this.Fields[key] = v
+		}
+	}
+
+	return nil
+}
+
+// Journald doesn't check the priority a process logs, so accept names like err or LOG_ERR too. Entries
+// without one are info, like journald treats them. Values out of range are clamped, anything else is
+// info as well, with the original value kept in raw_priority
+func (this *SystemdJournalEntry) parsePriority(raw json.RawMessage) {
+	this.Priority = DEFAULT_PRIORITY
+	if nil == raw || "null" == string(raw) {
+		return
+	}
+
+	value, ok := JournalValue(raw)
+	if !ok {
+		value = string(raw)
+	}
+	value = strings.TrimSpace(value)
+
+	if n, err := strconv.Atoi(value); err == nil {
+		this.hasPriority = true
+		switch {
+		case n < 0:
+			this.Priority = 0
+		case n > MAX_PRIORITY:
+			this.Priority = MAX_PRIORITY
+		default:
+			this.Priority = int32(n)
+			return
+		}
+
+		this.Fields["raw_priority"] = value
+		return
+	}
+
+	if p, ok := PriorityByName(strings.TrimPrefix(strings.ToLower(value), "log_")); ok {
+		this.Priority = p
+		this.hasPriority = true
+		return
+	}
+
+	this.Fields["raw_priority"] = value
+}
+
+// All fields of the entry as journalctl wrote them, including the ones mapped onto the struct
+func (this *SystemdJournalEntry) Raw() map[string]json.RawMessage {
+	return this.raw
+}
+
+// The value of any field of the entry, as text. Fields set more than once are decoded like when parsing
+func (this *SystemdJournalEntry) Value(name string) (string, bool) {
+	raw, ok := this.raw[name]
+	if !ok {
+		return "", false
+	}
+
+	if values, ok := JournalValues(raw); ok {
+		return this.multiValues.apply(name, values)[name], true
+	}
+
+	return JournalValue(raw)
+}
+
+// Whether the entry has a usable priority, entries without one are info
+func (this *SystemdJournalEntry) HasPriority() bool {
+	return this.hasPriority
+}
+
+// Journald encodes values which aren't valid UTF-8 as an array of bytes
+func JournalValue(raw json.RawMessage) (string, bool) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, true
+	}
+
+	bytes, ok := JournalBytes(raw)
+	if !ok {
+		return "", false
+	}
+
+	if !utf8.Valid(bytes) {
+		return strings.ToValidUTF8(string(bytes), string(utf8.RuneError)), true
+	}
+
+	return string(bytes), true
+}
+
+func JournalBytes(raw json.RawMessage) ([]byte, bool) {
+	var b []int
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return nil, false
+	}
+
+	bytes := make([]byte, len(b))
+	for idx, c := range b {
+		if c < 0 || c > 255 {
+			return nil, false
+		}
+		bytes[idx] = byte(c)
+	}
+
+	return bytes, true
+}
+
+// Derived from the machine and the journal cursor, so sending an entry again results in the same id. A
+// Graylog pipeline or ingest processor can use it as document id to ignore replayed messages
+func (this *SystemdJournalEntry) MessageId() string {
+	machine, _ := this.Value("_MACHINE_ID")
+	sum := sha256.Sum256([]byte(machine + "\x00" + this.Cursor))
+
+	return hex.EncodeToString(sum[:16])
+}
+
+// Whether the message looks like a JSON object, ToGelf falls back to plain text when it doesn't parse
+func (this *SystemdJournalEntry) IsJsonMessage() bool {
+	m := strings.TrimSpace(this.Message)
+	return len(m) >= 2 && '{' == m[0] && '}' == m[len(m)-1]
+}
@@ -0,0 +1,191 @@
+package journal2gelf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) [][]byte {
+	t.Helper()
+
+	file, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, append([]byte{}, scanner.Bytes()...))
+	}
+
+	return lines
+}
+
+// Values which aren't valid or printable UTF-8 and fields set more than once, as captured from journalctl,
+// see testdata/README.md. Runs of invalid bytes become a single replacement character
+func TestParseJournalctlArrays(t *testing.T) {
+	tests := []struct {
+		message    string
+		identifier string
+		bytes      []byte
+		fields     map[string]string
+	}{
+		{"usb 3-2: Product: \uFFFDFlash Disk", "usbinfo", []byte("usb 3-2: Product: \xff\xfeFlash Disk"), nil},
+		{"\x1b[31mconnection refused\x1b[0m", "legacyd\uFFFD", []byte("\x1b[31mconnection refused\x1b[0m"), nil},
+		{"tagged", "shop", nil, map[string]string{"TAG": "blue, green"}},
+		{"mixed", "shop", nil, map[string]string{"NOTE": "plain, bin\uFFFD"}},
+	}
+
+	lines := readFixture(t, "journalctl.json")
+	if len(lines) != len(tests) {
+		t.Fatalf("fixture has %d lines, want %d", len(lines), len(tests))
+	}
+
+	for idx, test := range tests {
+		entry, err := ParseEntry(lines[idx])
+		if err != nil {
+			t.Fatalf("line %d: %s", idx+1, err)
+		}
+
+		if entry.Message != test.message {
+			t.Errorf("line %d: message %q, want %q", idx+1, entry.Message, test.message)
+		}
+		if entry.Syslog_identifier != test.identifier {
+			t.Errorf("line %d: identifier %q, want %q", idx+1, entry.Syslog_identifier, test.identifier)
+		}
+		if "vm" != entry.Hostname || 0 == entry.Realtime_timestamp || "4147" != entry.Pid {
+			t.Errorf("line %d: other fields not decoded: %q %d %q", idx+1, entry.Hostname, entry.Realtime_timestamp, entry.Pid)
+		}
+
+		for key, want := range test.fields {
+			if got := entry.Fields[key]; got != want {
+				t.Errorf("line %d: field %s is %q, want %q", idx+1, key, got, want)
+			}
+			if got, _ := entry.Value(key); got != want {
+				t.Errorf("line %d: Value(%s) is %q, want %q", idx+1, key, got, want)
+			}
+		}
+
+		if nil == test.bytes {
+			continue
+		}
+
+		raw := entry.Raw()["MESSAGE"]
+		if b, ok := JournalBytes(raw); !ok || !bytes.Equal(b, test.bytes) {
+			t.Errorf("line %d: JournalBytes %q %v, want %q", idx+1, b, ok, test.bytes)
+		}
+		if v, ok := JournalValue(raw); !ok || v != test.message {
+			t.Errorf("line %d: JournalValue %q %v, want %q", idx+1, v, ok, test.message)
+		}
+	}
+}
+
+func TestJournalBytesInvalid(t *testing.T) {
+	for _, raw := range []string{`"text"`, `[256]`, `[-1]`, `["a"]`, `{}`} {
+		if b, ok := JournalBytes(json.RawMessage(raw)); ok {
+			t.Errorf("JournalBytes(%s) = %q, want it rejected", raw, b)
+		}
+	}
+
+	if v, ok := JournalValue(json.RawMessage(`"text"`)); !ok || "text" != v {
+		t.Errorf("JournalValue of a string is %q %v", v, ok)
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		want     int32
+		set      bool
+		original string
+	}{
+		{"normal", `"6"`, 6, true, ""},
+		{"emergency", `"0"`, 0, true, ""},
+		{"number", `3`, 3, true, ""},
+		{"spaces", `" 4 "`, 4, true, ""},
+		{"negative", `"-1"`, 0, true, "-1"},
+		{"above debug", `"12"`, 7, true, "12"},
+		{"syslog constant", `"LOG_ERR"`, 3, true, ""},
+		{"lowercase constant", `"log_warning"`, 4, true, ""},
+		{"short name", `"warn"`, 4, true, ""},
+		{"capitalized name", `"Notice"`, 5, true, ""},
+		{"garbage", `"loud"`, 6, false, "loud"},
+		{"empty", `""`, 6, false, ""},
+		{"null", `null`, 6, false, ""},
+		{"byte array", `[51]`, 3, true, ""},
+		{"byte array of a name", `[99,114,105,116]`, 2, true, ""},
+		{"invalid bytes", `[255,254]`, 6, false, "\uFFFD"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry, err := ParseEntry([]byte(`{"MESSAGE":"hello","PRIORITY":` + test.raw + `}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if entry.Priority != test.want || entry.HasPriority() != test.set {
+				t.Errorf("priority %d set %v, want %d set %v", entry.Priority, entry.HasPriority(), test.want, test.set)
+			}
+			if original := entry.Fields["raw_priority"]; original != test.original {
+				t.Errorf("raw_priority %q, want %q", original, test.original)
+			}
+		})
+	}
+
+	entry, err := ParseEntry([]byte(`{"MESSAGE":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if DEFAULT_PRIORITY != entry.Priority || entry.HasPriority() {
+		t.Errorf("without PRIORITY got %d set %v, want %d unset", entry.Priority, entry.HasPriority(), DEFAULT_PRIORITY)
+	}
+}
+
+func TestParseEntryWithMultiValues(t *testing.T) {
+	line := []byte(`{"MESSAGE":"hello","TAG":["a","b","c"]}`)
+
+	tests := []struct {
+		policy MultiValuePolicy
+		fields map[string]string
+	}{
+		{DefaultMultiValuePolicy(), map[string]string{"TAG": "a, b, c"}},
+		{MultiValuePolicy{Mode: MULTI_VALUE_JOIN, Separator: "|"}, map[string]string{"TAG": "a|b|c"}},
+		{MultiValuePolicy{Mode: MULTI_VALUE_FIRST}, map[string]string{"TAG": "a"}},
+		{MultiValuePolicy{Mode: MULTI_VALUE_LAST}, map[string]string{"TAG": "c"}},
+		{MultiValuePolicy{Mode: MULTI_VALUE_INDEX}, map[string]string{"TAG": "a", "TAG_1": "b", "TAG_2": "c"}},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.policy.Mode)+test.policy.Separator, func(t *testing.T) {
+			entry, err := ParseEntryWith(line, ParseOptions{MultiValues: test.policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for key, want := range test.fields {
+				if got := entry.Fields[key]; got != want {
+					t.Errorf("field %s is %q, want %q", key, got, want)
+				}
+			}
+			if value, _ := entry.Value("TAG"); value != test.fields["TAG"] {
+				t.Errorf("Value(TAG) is %q, want %q", value, test.fields["TAG"])
+			}
+		})
+	}
+
+	// Decoded without options, like ParseEntry
+	var entry SystemdJournalEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if "a, b, c" != entry.Fields["TAG"] {
+		t.Errorf("json.Unmarshal decoded %q, want the values joined", entry.Fields["TAG"])
+	}
+}
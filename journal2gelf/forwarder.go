@@ -0,0 +1,320 @@
+package journal2gelf
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+const (
+	WRITE_INTERVAL             = 50 * time.Millisecond
+	SAMESOURCE_TIME_DIFFERENCE = 100 * time.Millisecond
+	SLEEP_AFTER_ERROR          = 15 * time.Second
+	ENTRY_BUFFER               = 1024
+	IMMEDIATE_PRIORITY         = 2
+)
+
+type MessageWriter interface {
+	WriteMessage(message *gelf.Message) error
+}
+
+// Merges consecutive entries of a process into one message, eg. a stacktrace, converts them and writes them
+// to the Writer. Entries are added with Add after Start, Close sends the pending entry and waits until
+// everything is written. Change the fields before calling Start.
+//
+// Unless Collapse is disabled, repeats of the previous message are collapsed: the first occurrence is sent as
+// usual, the pending entry then counts the repeats until another message arrives or CollapseInterval expires
+type Forwarder struct {
+	Writer MessageWriter
+
+	// Converts the entries, with its mode for conflicting fields and its count of them
+	Converter *Converter
+
+	// Called for every message before it's written, to add fields or change it
+	Prepare func(entry *SystemdJournalEntry, message *gelf.Message)
+
+	// How often the pending entry is checked, and how long after its last line it's sent
+	WriteInterval    time.Duration
+	SameSourceWindow time.Duration
+
+	// When the Writer fails the message is written again by the Retry policy. Messages which still failed
+	// after Retry.Timeout are passed to Dropped with the last error, or else logged
+	Retry   RetryPolicy
+	Dropped func(message *gelf.Message, err error)
+
+	// Entries for which Standalone returns true are never merged with lines before or after them
+	Standalone func(entry *SystemdJournalEntry) bool
+
+	MergeMaxLines    int
+	MergeMaxBytes    int
+	Collapse         bool
+	CollapseInterval time.Duration
+
+	// Entries this severe or more, like critical, are sent right away: lines after them aren't merged into
+	// them, and they're written before the other messages waiting to be written. Only their repeats are
+	// collapsed as usual. -1 disables it
+	ImmediatePriority int32
+
+	// Number of goroutines writing messages, with more than one the order isn't kept
+	Senders int
+
+	entries   chan *SystemdJournalEntry
+	merged    chan *SystemdJournalEntry
+	immediate chan *SystemdJournalEntry
+	done      sync.WaitGroup
+}
+
+func NewForwarder(writer MessageWriter) *Forwarder {
+	return &Forwarder{
+		Writer:            writer,
+		Converter:         NewConverter(),
+		WriteInterval:     WRITE_INTERVAL,
+		SameSourceWindow:  SAMESOURCE_TIME_DIFFERENCE,
+		Retry:             DefaultRetryPolicy(),
+		MergeMaxLines:     500,
+		MergeMaxBytes:     32 * 1024,
+		Collapse:          true,
+		CollapseInterval:  5 * time.Second,
+		ImmediatePriority: IMMEDIATE_PRIORITY,
+		Senders:           1,
+	}
+}
+
+func (this *Forwarder) Start() {
+	this.entries = make(chan *SystemdJournalEntry, ENTRY_BUFFER)
+	this.merged = make(chan *SystemdJournalEntry, ENTRY_BUFFER)
+	this.immediate = make(chan *SystemdJournalEntry, ENTRY_BUFFER)
+
+	go this.mergeEntries()
+
+	for i := 0; i < this.Senders; i++ {
+		this.done.Add(1)
+		go this.sendEntries()
+	}
+}
+
+// Entries must be added in the order of the journal, and processed already
+func (this *Forwarder) Add(entry *SystemdJournalEntry) {
+	this.entries <- entry
+}
+
+// Flushes the pending entry and waits until everything is written
+func (this *Forwarder) Close() {
+	close(this.entries)
+	this.done.Wait()
+}
+
+// This goroutine owns the pending entry, so the reader never waits for it
+func (this *Forwarder) mergeEntries() {
+	var pending, last *SystemdJournalEntry
+	var runStarted time.Time
+
+	ticker := time.NewTicker(this.WriteInterval)
+	defer ticker.Stop()
+	defer close(this.merged)
+	defer close(this.immediate)
+
+	window := int64(this.SameSourceWindow / time.Microsecond)
+
+	flush := func() {
+		this.merged <- pending
+		last = pending
+		pending = nil
+	}
+
+	for {
+		select {
+		case entry, ok := <-this.entries:
+			if !ok {
+				if pending != nil {
+					this.merged <- pending
+				}
+				return
+			}
+
+			if pending != nil && pending.repeats > 0 {
+				if entry.isRepeatOf(pending) {
+					pending.repeats++
+					pending.lastTimestamp = entry.Realtime_timestamp
+					pending.lastCursor = entry.Cursor
+					continue
+				}
+
+				flush()
+			}
+
+			repeat := this.Collapse && (entry.isRepeatOf(pending) || (nil == pending && entry.isRepeatOf(last) &&
+				entry.Realtime_timestamp-last.latestTimestamp() < int64(this.CollapseInterval/time.Microsecond)))
+
+			// The lines before a severe entry are merged into it, but it isn't held for the lines after it
+			if !repeat && this.isImmediate(entry) {
+				if pending != nil && this.canMerge(pending, entry) {
+					pending.merge(entry)
+					entry = pending
+				} else if pending != nil {
+					flush()
+				}
+
+				this.immediate <- entry
+				last = entry
+				pending = nil
+				continue
+			}
+
+			if repeat {
+				if pending != nil {
+					flush()
+				}
+
+				pending = entry
+				pending.repeats = 1
+				runStarted = time.Now()
+				continue
+			}
+
+			if pending == nil {
+				pending = entry
+			} else if this.canMerge(pending, entry) {
+				pending.merge(entry)
+			} else {
+				flush()
+				pending = entry
+			}
+
+		case <-ticker.C:
+			if nil == pending {
+				continue
+			}
+
+			if pending.repeats > 0 {
+				if time.Since(runStarted) >= this.CollapseInterval {
+					flush()
+				}
+			} else if (time.Now().UnixNano()/1000 - pending.latestTimestamp()) > window {
+				flush()
+			}
+		}
+	}
+}
+
+func (this *Forwarder) sendEntries() {
+	defer this.done.Done()
+
+	immediate, merged := this.immediate, this.merged
+	for nil != immediate || nil != merged {
+		// Severe messages go first
+		select {
+		case entry, ok := <-immediate:
+			if !ok {
+				immediate = nil
+			} else {
+				this.send(entry)
+			}
+			continue
+		default:
+		}
+
+		select {
+		case entry, ok := <-immediate:
+			if !ok {
+				immediate = nil
+			} else {
+				this.send(entry)
+			}
+		case entry, ok := <-merged:
+			if !ok {
+				merged = nil
+			} else {
+				this.send(entry)
+			}
+		}
+	}
+}
+
+func (this *Forwarder) isImmediate(entry *SystemdJournalEntry) bool {
+	return this.ImmediatePriority >= 0 && entry.Priority <= this.ImmediatePriority
+}
+
+func (this *Forwarder) send(entry *SystemdJournalEntry) {
+	message := this.Converter.ToGelf(entry)
+	if nil != this.Prepare {
+		this.Prepare(entry, message)
+	}
+
+	err := this.Retry.Write(this.Writer, message)
+	if nil == err {
+		return
+	}
+
+	if nil != this.Dropped {
+		this.Dropped(message, err)
+	} else {
+		fmt.Fprintf(os.Stderr, "Dropping message after retrying for %s: %s\n", this.Retry.Timeout, err)
+	}
+}
+
+// Consecutive lines from the same process within the window are considered one message, eg. a stacktrace
+func (this *Forwarder) canMerge(entry, next *SystemdJournalEntry) bool {
+	if "" == entry.Pid || entry.Pid != next.Pid || entry.Systemd_unit != next.Systemd_unit || entry.Hostname != next.Hostname {
+		return false
+	}
+
+	if next.Realtime_timestamp-entry.latestTimestamp() > int64(this.SameSourceWindow/time.Microsecond) || entry.IsJsonMessage() || next.IsJsonMessage() {
+		return false
+	}
+
+	if nil != this.Standalone && (this.Standalone(entry) || this.Standalone(next)) {
+		return false
+	}
+
+	size := len(entry.FullMessage)
+	if 0 == size {
+		size = len(entry.Message)
+	}
+
+	return entry.mergedLines+1 < this.MergeMaxLines && size+1+len(next.Message) <= this.MergeMaxBytes
+}
+
+func (this *SystemdJournalEntry) merge(next *SystemdJournalEntry) {
+	if "" == this.FullMessage {
+		this.FullMessage = this.Message
+	}
+
+	this.FullMessage += "\n" + next.Message
+	this.mergedLines++
+	this.lastTimestamp = next.Realtime_timestamp
+	this.lastCursor = next.Cursor
+
+	// Lower is more severe
+	if next.Priority < this.Priority {
+		this.Priority = next.Priority
+	}
+}
+
+// The same message from the same process, merged entries are never repeated
+func (this *SystemdJournalEntry) isRepeatOf(other *SystemdJournalEntry) bool {
+	return nil != other && 0 == other.mergedLines && this.Message == other.Message && this.Pid == other.Pid &&
+		this.Syslog_identifier == other.Syslog_identifier && this.Hostname == other.Hostname && this.Priority == other.Priority
+}
+
+// Cursor of the last entry merged into this one or collapsed as its repeat, where reading the journal
+// continues after this message
+func (this *SystemdJournalEntry) LatestCursor() string {
+	if "" == this.lastCursor {
+		return this.Cursor
+	}
+
+	return this.lastCursor
+}
+
+// Realtime timestamp of the last entry merged into this one or collapsed as its repeat
+func (this *SystemdJournalEntry) latestTimestamp() int64 {
+	if 0 == this.lastTimestamp {
+		return this.Realtime_timestamp
+	}
+
+	return this.lastTimestamp
+}
@@ -0,0 +1,113 @@
+package journal2gelf
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+// Keeps the short message of everything written
+type countingWriter struct {
+	sync.Mutex
+	messages map[string]int
+}
+
+func (this *countingWriter) WriteMessage(message *gelf.Message) error {
+	this.Lock()
+	defer this.Unlock()
+
+	if nil == this.messages {
+		this.messages = map[string]int{}
+	}
+	this.messages[message.Short]++
+
+	return nil
+}
+
+// Distinct info messages without a pid, so none are merged or collapsed
+func syntheticEntry(i int) *SystemdJournalEntry {
+	return &SystemdJournalEntry{
+		Message:            "entry " + strconv.Itoa(i),
+		Priority:           DEFAULT_PRIORITY,
+		Syslog_identifier:  "synthetic",
+		Realtime_timestamp: int64(i),
+	}
+}
+
+func TestForwarderLosesNothing(t *testing.T) {
+	const count = 100000
+
+	for _, senders := range []int{1, 4} {
+		writer := &countingWriter{}
+		forwarder := NewForwarder(writer)
+		forwarder.Senders = senders
+		forwarder.Start()
+
+		for i := 0; i < count; i++ {
+			forwarder.Add(syntheticEntry(i))
+		}
+		forwarder.Close()
+
+		if len(writer.messages) != count {
+			t.Fatalf("%d senders wrote %d distinct messages, want %d", senders, len(writer.messages), count)
+		}
+		for short, n := range writer.messages {
+			if n != 1 {
+				t.Fatalf("%d senders wrote %q %d times", senders, short, n)
+			}
+		}
+	}
+}
+
+func BenchmarkForwarder(b *testing.B) {
+	writer := &countingWriter{}
+	forwarder := NewForwarder(writer)
+	forwarder.Start()
+
+	for i := 0; i < b.N; i++ {
+		forwarder.Add(syntheticEntry(i))
+	}
+	forwarder.Close()
+}
+
+func TestCollapseAfterInterval(t *testing.T) {
+	w := &failingWriter{}
+	forwarder := NewForwarder(w)
+	forwarder.WriteInterval = 5 * time.Millisecond
+	forwarder.CollapseInterval = 50 * time.Millisecond
+	forwarder.Start()
+
+	// Old enough to be sent on the next tick, unless collapsed
+	started := time.Now().Add(-time.Hour).UnixNano() / 1000
+	repeat := func(ms int64) {
+		forwarder.Add(&SystemdJournalEntry{
+			Message:            "still waiting",
+			Pid:                "42",
+			Priority:           DEFAULT_PRIORITY,
+			Realtime_timestamp: started + ms*1000,
+		})
+	}
+
+	repeat(0)
+	time.Sleep(20 * time.Millisecond)
+	for _, ms := range []int64{10, 20, 30, 40} {
+		repeat(ms)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Within the interval of the last repeat, though not of the first
+	repeat(80)
+	forwarder.Close()
+
+	var counts []interface{}
+	for _, message := range w.written {
+		counts = append(counts, message.Extra["repeat_count"])
+	}
+
+	if 3 != len(counts) || nil != counts[0] || 4 != counts[1] || 1 != counts[2] {
+		t.Errorf("repeat counts %v, want [<nil> 4 1]", counts)
+	}
+}
@@ -0,0 +1,307 @@
+package journal2gelf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+// Converts entries to GELF messages and counts the keys set by more than one source. Safe for concurrent
+// use, change Conflicts before converting entries
+type Converter struct {
+	Conflicts ConflictMode
+
+	conflicts uint64
+}
+
+func NewConverter() *Converter {
+	return &Converter{Conflicts: CONFLICT_OVERWRITE}
+}
+
+// Convert to a GELF message. The journal fields which aren't mapped onto the message or one of the named
+// additional fields are added to Extra as-is, messages which are a JSON object are flattened into Extra
+func (this *Converter) ToGelf(entry *SystemdJournalEntry) *gelf.Message {
+	message, conflicts := entry.toGelf(this.Conflicts)
+	atomic.AddUint64(&this.conflicts, uint64(conflicts))
+
+	return message
+}
+
+// How many times a key was set by more than one source with different values, since the start
+func (this *Converter) ConflictCount() uint64 {
+	return atomic.LoadUint64(&this.conflicts)
+}
+
+// Convert like a new Converter, without counting the conflicts
+func (this *SystemdJournalEntry) ToGelf() *gelf.Message {
+	message, _ := this.toGelf(CONFLICT_OVERWRITE)
+	return message
+}
+
+// The named additional fields of ToGelf by the journal field they're taken from
+var namedFields = map[string][]string{
+	"_BOOT_ID":                  {"Boot_id"},
+	"_PID":                      {"Pid"},
+	"_UID":                      {"Uid"},
+	"LOGGER":                    {"Logger"},
+	"EVENTID":                   {"EventId"},
+	"EXCEPTION":                 {"Exception"},
+	"EXCEPTION_TYPE":            {"Exception_Type"},
+	"EXCEPTION_STACKTRACE":      {"Exception_Stacktrace"},
+	"INNEREXCEPTION":            {"Inner_Exception"},
+	"INNEREXCEPTION_TYPE":       {"Inner_Exception_Type"},
+	"INNEREXCEPTION_STACKTRACE": {"Inner_Exception_Stacktrace"},
+	"REQUESTID":                 {"Request_Id"},
+	"REQUESTPATH":               {"Request_Path"},
+	"STATUSCODE":                {"Status_Code"},
+	"QUERYSTRING":               {"Query_String"},
+	"CORRELATIONID":             {"Correlation_Id"},
+	"MEMBERID":                  {"Member_Id"},
+	"_TRANSPORT":                {"Transport"},
+	"SYSLOG_FACILITY":           {"Syslog_Facility", "Syslog_Facility_Code"},
+}
+
+// The keys in Extra which ToGelf sets from a journal field: the named field, like Pid for _PID, or the
+// field itself and the fields its other values are decoded into when it's set more than once
+func (this *SystemdJournalEntry) ExtraNames(field string) []string {
+	if names, ok := namedFields[field]; ok {
+		return names
+	}
+
+	values, ok := JournalValues(this.raw[field])
+	if !ok {
+		return []string{field}
+	}
+
+	var names []string
+	for name := range this.multiValues.apply(field, values) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (this *SystemdJournalEntry) toGelf(mode ConflictMode) (*gelf.Message, int) {
+	var extra = map[string]interface{}{
+		"Boot_id":                    this.Boot_id,
+		"Pid":                        this.Pid,
+		"Uid":                        this.Uid,
+		"Logger":                     this.Logger,
+		"EventId":                    this.EventId,
+		"Exception":                  this.Exception,
+		"Exception_Type":             this.Exception_type,
+		"Exception_Stacktrace":       this.Exception_Stacktrace,
+		"Inner_Exception":            this.Inner_exception,
+		"Inner_Exception_Type":       this.Inner_exception_type,
+		"Inner_Exception_Stacktrace": this.Inner_exception_Stacktrace,
+		"Request_Id":                 this.Request_id,
+		"Request_Path":               this.Request_path,
+		"Status_Code":                this.Status_code,
+		"Query_String":               this.Query_string,
+		"Correlation_Id":             this.Correlation_id,
+		"Member_Id":                  this.Member_id,
+		"Transport":                  this.Transport,
+		"Syslog_Facility":            facilityName(this.Syslog_facility),
+		"Syslog_Facility_Code":       this.Syslog_facility,
+	}
+
+	// Named fields take precedence over journal fields, fields set by rules over both. Rules which
+	// replaced a journal field are already counted
+	conflicts := this.conflicts
+	for key, value := range this.Fields {
+		if isSet(extra, key) {
+			if !this.ruleFields[key] {
+				continue
+			}
+			if extra[key] != value {
+				conflicts++
+			}
+		}
+		extra[key] = value
+	}
+
+	// php-fpm refuses to fill identifier
+	facility := this.Syslog_identifier
+	if "" == facility {
+		facility = this.Comm
+	}
+
+	// Kernel messages have neither
+	if "" == facility && "kernel" == this.Transport {
+		facility = "kernel"
+	}
+
+	// The entry is left as it is, it may be converted again
+	short, full := this.Message, this.FullMessage
+
+	var fields map[string]interface{}
+	var isJson bool
+	if this.IsJsonMessage() {
+		fields, isJson = parseJsonMessage(this.Message)
+	}
+
+	if isJson {
+		if m, ok := fields["Message"]; ok {
+			if nil != m {
+				short = jsonString(m)
+			}
+			delete(fields, "Message")
+		}
+
+		if f, ok := fields["FullMessage"]; ok {
+			if nil != f {
+				full = jsonString(f)
+			}
+			delete(fields, "FullMessage")
+		}
+
+		flattened := make(map[string]interface{}, len(fields))
+		conflicts += flattenJson("", fields, 0, flattened)
+		conflicts += mergeJsonFields(flattened, extra, mode)
+	} else if -1 != strings.Index(short, "\n") {
+		// Merged entries already carry the complete text
+		if "" == full {
+			full = short
+		}
+		short = strings.Split(short, "\n")[0]
+	}
+
+	timestamp := this.Timestamp()
+	if timestamp != this.Realtime_timestamp {
+		extra["journald_received"] = float64(this.Realtime_timestamp) / 1000 / 1000
+	}
+
+	if this.repeats > 0 {
+		extra["repeat_count"] = this.repeats
+	}
+
+	message := &gelf.Message{
+		Version:  "1.1",
+		Host:     this.Hostname,
+		Short:    short,
+		Full:     full,
+		TimeUnix: float64(timestamp) / 1000 / 1000,
+		Level:    this.Priority,
+		Facility: facility,
+		Extra:    extra,
+	}
+
+	return message, conflicts
+}
+
+// Time the message was logged in microseconds, as used for the GELF timestamp. The time journald
+// received the entry is the last resort, under load or when replaying it can be far off
+func (this *SystemdJournalEntry) Timestamp() int64 {
+	if 0 != this.embeddedTimestamp {
+		return this.embeddedTimestamp
+	}
+
+	if t, err := strconv.ParseInt(this.Source_realtime_timestamp, 10, 64); err == nil && t > 0 {
+		return t
+	}
+
+	return this.Realtime_timestamp
+}
+
+// Nested objects deeper than this are sent as JSON text
+const JSON_MAX_DEPTH = 4
+
+// Parse a message which is a JSON object, anything else is handled as plain text
+func parseJsonMessage(message string) (map[string]interface{}, bool) {
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil || nil == fields {
+		return nil, false
+	}
+
+	// Trailing text means it only started like JSON
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, false
+	}
+
+	return fields, true
+}
+
+// Store nested objects as underscore joined keys, like context_user_id, leaving out nulls. Numbers become
+// integers when possible, arrays are sent as JSON text. Keys are handled in order, so when a nested key
+// joins into one which is also in the message, like context_user_id, the key in the message wins. Returns
+// the number of keys set twice
+func flattenJson(prefix string, value interface{}, depth int, out map[string]interface{}) int {
+	switch v := value.(type) {
+	case nil:
+	case map[string]interface{}:
+		if depth >= JSON_MAX_DEPTH {
+			return setFlattened(out, prefix, jsonString(v))
+		}
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			if "" != key {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		conflicts := 0
+		for _, key := range keys {
+			child := v[key]
+			if "" != prefix {
+				key = prefix + "_" + key
+			}
+
+			conflicts += flattenJson(key, child, depth+1, out)
+		}
+		return conflicts
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return setFlattened(out, prefix, i)
+		} else if f, err := v.Float64(); err == nil {
+			return setFlattened(out, prefix, f)
+		}
+		return setFlattened(out, prefix, v.String())
+	case []interface{}:
+		return setFlattened(out, prefix, jsonString(v))
+	default:
+		return setFlattened(out, prefix, v)
+	}
+
+	return 0
+}
+
+// A key the message has twice is a conflict as well, the last one wins
+func setFlattened(out map[string]interface{}, key string, value interface{}) int {
+	_, ok := out[key]
+	out[key] = value
+
+	if ok {
+		return 1
+	}
+
+	return 0
+}
+
+// Text of any JSON value, for fields which have to be a string
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,218 @@
+package journal2gelf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTimestamp(t *testing.T) {
+	const received = 1714557600500000
+
+	tests := []struct {
+		name     string
+		source   *string
+		want     int64
+		received bool
+	}{
+		{"missing", nil, received, false},
+		{"empty", strPtr(""), received, false},
+		{"garbage", strPtr("yesterday"), received, false},
+		{"negative", strPtr("-5"), received, false},
+		{"zero", strPtr("0"), received, false},
+		{"present", strPtr("1714557600123456"), 1714557600123456, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fields := map[string]string{"MESSAGE": "hello", "__REALTIME_TIMESTAMP": "1714557600500000"}
+			if nil != test.source {
+				fields["_SOURCE_REALTIME_TIMESTAMP"] = *test.source
+			}
+
+			entry := parseTestEntry(t, fields)
+			if got := entry.Timestamp(); got != test.want {
+				t.Errorf("Timestamp() = %d, want %d", got, test.want)
+			}
+
+			message := entry.ToGelf()
+			if message.TimeUnix != float64(test.want)/1000/1000 {
+				t.Errorf("GELF timestamp %f, want %f", message.TimeUnix, float64(test.want)/1000/1000)
+			}
+
+			_, ok := message.Extra["journald_received"]
+			if ok != test.received {
+				t.Errorf("journald_received set: %v, want %v", ok, test.received)
+			}
+		})
+	}
+}
+
+func TestFacilityFallback(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]string
+		want   string
+	}{
+		{"identifier", map[string]string{"SYSLOG_IDENTIFIER": "nginx", "_COMM": "nginx: worker"}, "nginx"},
+		{"comm without identifier", map[string]string{"_COMM": "php-fpm"}, "php-fpm"},
+		{"kernel transport", map[string]string{"_TRANSPORT": "kernel"}, "kernel"},
+		{"identifier of kernel transport", map[string]string{"SYSLOG_IDENTIFIER": "audit", "_TRANSPORT": "kernel"}, "audit"},
+		{"none", map[string]string{"_TRANSPORT": "journal"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.fields["MESSAGE"] = "hello"
+			if got := parseTestEntry(t, test.fields).ToGelf().Facility; got != test.want {
+				t.Errorf("facility %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewlineSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		short   string
+		full    string
+	}{
+		{"single line", "hello", "hello", ""},
+		{"multiple lines", "panic: oops\ngoroutine 1\nmain.main()", "panic: oops", "panic: oops\ngoroutine 1\nmain.main()"},
+		{"trailing newline", "done\n", "done", "done\n"},
+		{"leading newline", "\nafter", "", "\nafter"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := parseTestEntry(t, map[string]string{"MESSAGE": test.message}).ToGelf()
+			if message.Short != test.short || message.Full != test.full {
+				t.Errorf("short %q and full %q, want %q and %q", message.Short, message.Full, test.short, test.full)
+			}
+		})
+	}
+}
+
+func TestConvertTwice(t *testing.T) {
+	for _, text := range []string{`{"Message":"short","FullMessage":"full","user":"bob"}`, "first\nsecond"} {
+		entry := parseTestEntry(t, map[string]string{"MESSAGE": text})
+
+		first := entry.ToGelf()
+		second := entry.ToGelf()
+		if entry.Message != text || "" != entry.FullMessage {
+			t.Errorf("entry changed to %q and %q", entry.Message, entry.FullMessage)
+		}
+		if first.Short != second.Short || first.Full != second.Full || !reflect.DeepEqual(first.Extra, second.Extra) {
+			t.Errorf("second conversion %+v, want %+v", second, first)
+		}
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestConvertersKeepTheirOwnConflicts(t *testing.T) {
+	fields := map[string]string{"MESSAGE": `{"Message":"hello","Pid":"7","user":{"id":1},"user_id":2}`, "_PID": "42"}
+
+	overwrite := NewConverter()
+	suffix := NewConverter()
+	suffix.Conflicts = CONFLICT_SUFFIX
+
+	message := overwrite.ToGelf(parseTestEntry(t, fields))
+	if "7" != message.Extra["Pid"] {
+		t.Errorf("overwrite: Pid is %v, want 7", message.Extra["Pid"])
+	}
+
+	message = suffix.ToGelf(parseTestEntry(t, fields))
+	if "42" != message.Extra["Pid"] || "7" != message.Extra["Pid"+CONFLICT_KEY_SUFFIX] {
+		t.Errorf("suffix: Pid is %v and %v, want 42 and 7", message.Extra["Pid"], message.Extra["Pid"+CONFLICT_KEY_SUFFIX])
+	}
+
+	// Pid, and user_id joined from the nested object
+	if 2 != overwrite.ConflictCount() || 2 != suffix.ConflictCount() {
+		t.Errorf("counted %d and %d conflicts, want 2 each", overwrite.ConflictCount(), suffix.ConflictCount())
+	}
+
+	// A rewrite rule replacing a journal field
+	rules := DefaultRules()
+	if err := rules.AddRewrite(map[string]string{"shop": `^\[(?P<Order_Ref>[a-z]+)\] `}); err != nil {
+		t.Fatal(err)
+	}
+	entry := parseTestEntry(t, map[string]string{"MESSAGE": "[new] shipped", "SYSLOG_IDENTIFIER": "shop", "Order_Ref": "old"})
+	entry.Process(rules)
+	overwrite.ToGelf(entry)
+
+	if 3 != overwrite.ConflictCount() || 2 != suffix.ConflictCount() {
+		t.Errorf("counted %d and %d conflicts, want 3 and 2", overwrite.ConflictCount(), suffix.ConflictCount())
+	}
+}
+
+func TestFieldPrecedence(t *testing.T) {
+	rules := DefaultRules()
+	if err := rules.AddRewrite(map[string]string{"shop": `^\[(?P<Order_Ref>[a-z]+)\] (?P<Syslog_Facility_Code>[0-9]+) `}); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := parseTestEntry(t, map[string]string{
+		"MESSAGE":           "[new] 3 shipped",
+		"SYSLOG_IDENTIFIER": "shop",
+		"SYSLOG_FACILITY":   "1",
+		"_TRANSPORT":        "syslog",
+		"Order_Ref":         "old",
+		"Transport":         "stdout",
+	})
+	entry.Process(rules)
+
+	converter := NewConverter()
+	message := converter.ToGelf(entry)
+
+	// The rule replaced the journal field, the named field wins from the journal field of the same key
+	if "new" != message.Extra["Order_Ref"] || "syslog" != message.Extra["Transport"] || "3" != message.Extra["Syslog_Facility_Code"] {
+		t.Errorf("Order_Ref %v, Transport %v and Syslog_Facility_Code %v, want new, syslog and 3",
+			message.Extra["Order_Ref"], message.Extra["Transport"], message.Extra["Syslog_Facility_Code"])
+	}
+
+	// Only the fields the rule replaced
+	if 2 != converter.ConflictCount() {
+		t.Errorf("counted %d conflicts, want 2", converter.ConflictCount())
+	}
+}
+
+func TestExtraNames(t *testing.T) {
+	line := []byte(`{"MESSAGE":"hello","_PID":"42","SYSLOG_FACILITY":"3","TAG":["a","b","c"],"TENANT_ID":"7"}`)
+
+	tests := []struct {
+		field string
+		mode  MultiValueMode
+		want  []string
+	}{
+		{"_PID", MULTI_VALUE_JOIN, []string{"Pid"}},
+		{"SYSLOG_FACILITY", MULTI_VALUE_JOIN, []string{"Syslog_Facility", "Syslog_Facility_Code"}},
+		{"TENANT_ID", MULTI_VALUE_JOIN, []string{"TENANT_ID"}},
+		{"TAG", MULTI_VALUE_JOIN, []string{"TAG"}},
+		{"TAG", MULTI_VALUE_INDEX, []string{"TAG", "TAG_1", "TAG_2"}},
+		{"MISSING", MULTI_VALUE_INDEX, []string{"MISSING"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.field+" "+string(test.mode), func(t *testing.T) {
+			entry, err := ParseEntryWith(line, ParseOptions{MultiValues: MultiValuePolicy{Mode: test.mode, Separator: ","}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := entry.ExtraNames(test.field)
+			if !reflect.DeepEqual(names, test.want) {
+				t.Fatalf("ExtraNames(%s) = %q, want %q", test.field, names, test.want)
+			}
+
+			extra := entry.ToGelf().Extra
+			for _, name := range names {
+				if _, ok := extra[name]; !ok && "MISSING" != test.field {
+					t.Errorf("%s isn't in the message", name)
+				}
+			}
+		})
+	}
+}
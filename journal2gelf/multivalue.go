@@ -0,0 +1,77 @@
+package journal2gelf
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// How fields which appear more than once in an entry are decoded, journalctl writes them as an array
+type MultiValueMode string
+
+const (
+	// The values joined by the separator
+	MULTI_VALUE_JOIN MultiValueMode = "join"
+	// Only the first or last value
+	MULTI_VALUE_FIRST MultiValueMode = "first"
+	MULTI_VALUE_LAST  MultiValueMode = "last"
+	// The first value in the field, the others in the field with _1, _2 and so on appended
+	MULTI_VALUE_INDEX MultiValueMode = "index"
+)
+
+type MultiValuePolicy struct {
+	Mode      MultiValueMode
+	Separator string
+}
+
+// The values joined by a comma, used by ParseEntry
+func DefaultMultiValuePolicy() MultiValuePolicy {
+	return MultiValuePolicy{Mode: MULTI_VALUE_JOIN, Separator: ", "}
+}
+
+func ParseMultiValueMode(name string) (MultiValueMode, error) {
+	switch mode := MultiValueMode(name); mode {
+	case MULTI_VALUE_JOIN, MULTI_VALUE_FIRST, MULTI_VALUE_LAST, MULTI_VALUE_INDEX:
+		return mode, nil
+	}
+
+	return "", fmt.Errorf("unknown multi-value mode %q, expected join, first, last or index", name)
+}
+
+// The values of a field set more than once, each a string or an array of bytes
+func JournalValues(raw json.RawMessage) ([]string, bool) {
+	var multiple []json.RawMessage
+	if err := json.Unmarshal(raw, &multiple); err != nil || 0 == len(multiple) {
+		return nil, false
+	}
+
+	values := make([]string, 0, len(multiple))
+	for _, value := range multiple {
+		v, ok := JournalValue(value)
+		if !ok {
+			return nil, false
+		}
+		values = append(values, v)
+	}
+
+	return values, true
+}
+
+// The fields to decode the values of name into, by the policy
+func (this MultiValuePolicy) apply(name string, values []string) map[string]string {
+	switch this.Mode {
+	case MULTI_VALUE_FIRST:
+		return map[string]string{name: values[0]}
+	case MULTI_VALUE_LAST:
+		return map[string]string{name: values[len(values)-1]}
+	case MULTI_VALUE_INDEX:
+		fields := map[string]string{name: values[0]}
+		for i, value := range values[1:] {
+			fields[name+"_"+strconv.Itoa(i+1)] = value
+		}
+		return fields
+	}
+
+	return map[string]string{name: strings.Join(values, this.Separator)}
+}
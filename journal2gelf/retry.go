@@ -0,0 +1,101 @@
+package journal2gelf
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+const (
+	RETRY_BASE    = 100 * time.Millisecond
+	RETRY_TIMEOUT = 5 * time.Minute
+
+	// Also when Base or Max isn't set, retries never spin
+	RETRY_MIN_DELAY = time.Millisecond
+)
+
+// Writers return an error wrapping ErrWriteFailed when only this write failed, like a lost datagram, and
+// the server may accept the message when it's retried right away
+var ErrWriteFailed = errors.New("write failed")
+
+// Writers return an error wrapping ErrMessageTooLarge when the message can never be sent, so it isn't retried
+var ErrMessageTooLarge = errors.New("message too large")
+
+// How long a message is retried when the writer fails. The delay doubles on every attempt from Base up to
+// Max, with jitter so multiple senders don't retry in lockstep. After Timeout the message is dropped, to
+// keep up with the journal instead of falling hours behind during an outage. A Timeout of 0 retries forever
+type RetryPolicy struct {
+	Base    time.Duration
+	Max     time.Duration
+	Timeout time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{Base: RETRY_BASE, Max: SLEEP_AFTER_ERROR, Timeout: RETRY_TIMEOUT}
+}
+
+// Delay before the attempt after the given one, counting from 0, at least half of RETRY_MIN_DELAY
+func (this RetryPolicy) Delay(attempt int) time.Duration {
+	d := this.Max
+	if attempt < 32 && this.Base<<uint(attempt) < this.Max {
+		d = this.Base << uint(attempt)
+	}
+
+	if d < RETRY_MIN_DELAY {
+		d = RETRY_MIN_DELAY
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Write the message until it succeeds, or return the last error when Timeout passed. A message that is too
+// large is returned right away
+func (this RetryPolicy) Write(w MessageWriter, message *gelf.Message) error {
+	started := time.Now()
+	paused := false
+
+	for attempt := 0; ; attempt++ {
+		err := w.WriteMessage(message)
+		if nil == err {
+			break
+		}
+
+		if errors.Is(err, ErrMessageTooLarge) {
+			return err
+		}
+
+		// A single lost datagram, the next attempt will most likely succeed
+		if errors.Is(err, ErrWriteFailed) && 0 == attempt {
+			continue
+		}
+
+		wait := this.Delay(attempt)
+		if this.Timeout > 0 {
+			left := this.Timeout - time.Since(started)
+			if left <= 0 {
+				return err
+			}
+
+			if wait > left {
+				wait = left
+			}
+		}
+
+		if !paused {
+			fmt.Fprintln(os.Stderr, "Processing paused because of: "+err.Error())
+			paused = true
+		}
+
+		time.Sleep(wait)
+	}
+
+	if paused {
+		fmt.Fprintln(os.Stderr, "Processing resumed")
+	}
+
+	return nil
+}
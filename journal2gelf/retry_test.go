@@ -0,0 +1,174 @@
+package journal2gelf
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+var errUnreachable = errors.New("unreachable")
+
+// Fails the first failures writes with err, then succeeds. Negative failures always fails
+type failingWriter struct {
+	sync.Mutex
+	failures int
+	err      error
+	attempts int
+	written  []*gelf.Message
+}
+
+func (this *failingWriter) WriteMessage(message *gelf.Message) error {
+	this.Lock()
+	defer this.Unlock()
+
+	this.attempts++
+	if this.failures < 0 || this.attempts <= this.failures {
+		return this.err
+	}
+
+	this.written = append(this.written, message)
+	return nil
+}
+
+func TestRetryWrite(t *testing.T) {
+	policy := RetryPolicy{Base: time.Millisecond, Max: 4 * time.Millisecond, Timeout: time.Second}
+
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+		attempts int
+		dropped  bool
+	}{
+		{"succeeds", 0, errUnreachable, 1, false},
+		{"fails then succeeds", 5, errUnreachable, 6, false},
+		{"single failed write", 1, fmt.Errorf("%w to server: lost", ErrWriteFailed), 2, false},
+		{"failed writes then succeeds", 3, fmt.Errorf("%w to server: lost", ErrWriteFailed), 4, false},
+		{"always fails", -1, errUnreachable, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := policy
+			if test.dropped {
+				p.Timeout = 30 * time.Millisecond
+			}
+
+			w := &failingWriter{failures: test.failures, err: test.err}
+			started := time.Now()
+			err := p.Write(w, &gelf.Message{Short: "hello"})
+
+			if test.dropped {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("error %v, want %v", err, test.err)
+				}
+				if elapsed := time.Since(started); elapsed < p.Timeout || elapsed > p.Timeout+p.Max+20*time.Millisecond {
+					t.Errorf("dropped after %s, want about %s", elapsed, p.Timeout)
+				}
+				return
+			}
+
+			if nil != err {
+				t.Fatalf("error %v, want the message written", err)
+			}
+			if w.attempts != test.attempts || 1 != len(w.written) {
+				t.Errorf("%d attempts writing %d messages, want %d attempts writing 1", w.attempts, len(w.written), test.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryFailedWriteWithoutDelay(t *testing.T) {
+	policy := RetryPolicy{Base: time.Hour, Max: time.Hour, Timeout: time.Hour}
+
+	w := &failingWriter{failures: 1, err: fmt.Errorf("%w to server: lost", ErrWriteFailed)}
+	started := time.Now()
+	if err := policy.Write(w, &gelf.Message{}); nil != err {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("single failed write was retried after %s, want right away", elapsed)
+	}
+}
+
+func TestRetryTooLargeWithoutRetrying(t *testing.T) {
+	policy := RetryPolicy{Base: time.Hour, Max: time.Hour, Timeout: time.Hour}
+
+	w := &failingWriter{failures: -1, err: fmt.Errorf("%w, 200000 bytes", ErrMessageTooLarge)}
+	if err := policy.Write(w, &gelf.Message{}); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("error %v, want %v", err, ErrMessageTooLarge)
+	}
+
+	if 1 != w.attempts {
+		t.Errorf("%d attempts, want 1", w.attempts)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{Base: 100 * time.Millisecond, Max: time.Second}
+
+	for attempt, full := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		full *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			if d := policy.Delay(attempt); d < full/2 || d > full {
+				t.Fatalf("delay of attempt %d is %s, want between %s and %s", attempt, d, full/2, full)
+			}
+		}
+	}
+
+	if d := policy.Delay(1000); d < policy.Max/2 || d > policy.Max {
+		t.Errorf("delay of attempt 1000 is %s, want at most %s", d, policy.Max)
+	}
+
+	// Never a busy loop
+	for _, p := range []RetryPolicy{{}, {Base: 0, Max: time.Second}, {Base: time.Second, Max: 0}} {
+		if d := p.Delay(0); d < RETRY_MIN_DELAY/2 {
+			t.Errorf("delay of %+v is %s, want at least %s", p, d, RETRY_MIN_DELAY/2)
+		}
+	}
+}
+
+func TestForwarderDropsAfterTimeout(t *testing.T) {
+	w := &failingWriter{failures: -1, err: errUnreachable}
+	forwarder := NewForwarder(w)
+	forwarder.Retry = RetryPolicy{Base: time.Millisecond, Max: time.Millisecond, Timeout: 10 * time.Millisecond}
+
+	var dropped []string
+	forwarder.Dropped = func(message *gelf.Message, err error) {
+		if !errors.Is(err, errUnreachable) {
+			t.Errorf("dropped with %v, want %v", err, errUnreachable)
+		}
+		dropped = append(dropped, message.Short)
+	}
+
+	forwarder.Start()
+	forwarder.Add(syntheticEntry(1))
+	forwarder.Add(syntheticEntry(2))
+	forwarder.Close()
+
+	if 2 != len(dropped) || "entry 1" != dropped[0] || "entry 2" != dropped[1] {
+		t.Errorf("dropped %q, want both entries in order", dropped)
+	}
+}
+
+func TestForwarderRetries(t *testing.T) {
+	w := &failingWriter{failures: 3, err: errUnreachable}
+	forwarder := NewForwarder(w)
+	forwarder.Retry = RetryPolicy{Base: time.Millisecond, Max: time.Millisecond, Timeout: time.Second}
+	forwarder.Dropped = func(message *gelf.Message, err error) {
+		t.Errorf("dropped %q: %s", message.Short, err)
+	}
+
+	forwarder.Start()
+	forwarder.Add(syntheticEntry(1))
+	forwarder.Close()
+
+	if 1 != len(w.written) || 4 != w.attempts {
+		t.Errorf("%d attempts writing %d messages, want 4 attempts writing 1", w.attempts, len(w.written))
+	}
+}
@@ -0,0 +1,252 @@
+package journal2gelf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// How entries are processed before they're converted:
+//
+// Rewrite holds regexes by SYSLOG_IDENTIFIER or _COMM, where * applies to all entries. The matched text is
+// removed from the message, named subpatterns are stored in the field with that name, like Priority.
+//
+// Messages matching one of the Downgrades of their identifier, or *, are downgraded to info.
+//
+// A Timestamp subpattern is parsed with the TimestampLayouts of the identifier, and only used for the GELF
+// timestamp when a Timezones entry exists for the identifier, or *. The built-in rule for * only strips the
+// date of messages it's used for
+type Rules struct {
+	Rewrite          map[string]*regexp.Regexp
+	Downgrades       map[string][]*regexp.Regexp
+	Timezones        map[string]*time.Location
+	TimestampLayouts map[string]string
+}
+
+// Date at the start of a message, like 2024-05-01 10:00:00,123
+var genericTimestamp = regexp.MustCompile("^(?P<Timestamp>20[0-9][0-9][/\\-][01][0-9][/\\-][0123][0-9] [0-2]?[0-9]:[0-5][0-9]:[0-5][0-9])[,0-9]{0,4} ")
+
+// The built-in rules, a new copy every call so they can be changed
+func DefaultRules() Rules {
+	return Rules{
+		// Strip date from message-content. Use named subpatterns to override other fields
+		Rewrite: map[string]*regexp.Regexp{
+			"*":         genericTimestamp,
+			"nginx":     regexp.MustCompile("\\[(?P<Priority>[a-z]+)\\] "),
+			"java":      regexp.MustCompile("(?P<Priority>[A-Z]+): "),
+			"mysqld":    regexp.MustCompile("^[0-9]+ \\[(?P<Priority>[A-Z][a-z]+)\\] "),
+			"searchd":   regexp.MustCompile("^\\[(?P<Timestamp>([A-Z][a-z]{2} ){2} [0-9]+ [0-2][0-9]:[0-5][0-9]:[0-5][0-9]\\.[0-9]{3} 20[0-9][0-9])\\] \\[[ 0-9]+\\] "),
+			"jenkins":   regexp.MustCompile("^(?P<Timestamp>[A-Z][a-z]{2} [01][0-9], 20[0-9][0-9] [0-2]?[0-9]:[0-5][0-9]:[0-5][0-9] [AP]M) "),
+			"php-fpm":   regexp.MustCompile("^pool [a-z_0-9\\[\\]\\-]+: "),
+			"syncthing": regexp.MustCompile("^\\[[0-9A-Z]{5}\\] [0-2][0-9]:[0-5][0-9]:[0-5][0-9] (?P<Priority>INFO): "),
+		},
+
+		// Known benign messages which look scary, these are downgraded to info to prevent false alerts
+		Downgrades: map[string][]*regexp.Regexp{
+			"systemd": {
+				regexp.MustCompile("^Failed to reset devices\\.list on "),
+				regexp.MustCompile("^Failed to set devices\\.allow on "),
+			},
+			"kernel": {
+				regexp.MustCompile("^ACPI (BIOS )?(Error|Warning)"),
+				regexp.MustCompile("^ACPI Exception: AE_NOT_FOUND"),
+				regexp.MustCompile("^\\[Firmware Bug\\]: "),
+				regexp.MustCompile("^i8042: (No controller found|Can't read CTR)"),
+				regexp.MustCompile("^piix4_smbus [0-9a-f:.]+: SMBus Host Controller not enabled"),
+			},
+		},
+
+		Timezones: map[string]*time.Location{},
+
+		// Layouts of the timestamps captured by the Timestamp subpattern of the rewrite rules
+		TimestampLayouts: map[string]string{
+			"*":       "2006-01-02 15:04:05",
+			"searchd": "Mon Jan _2 15:04:05.000 2006",
+			"jenkins": "Jan 02, 2006 3:04:05 PM",
+		},
+	}
+}
+
+// Read rewrite rules from a JSON object of identifier: pattern, merged over the existing rules.
+// An empty pattern disables the rule for that identifier
+func (this Rules) LoadRewrite(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var rules map[string]string
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("parsing %s: %s", file, err)
+	}
+
+	if err := this.AddRewrite(rules); err != nil {
+		return fmt.Errorf("%s in %s", err, file)
+	}
+
+	return nil
+}
+
+// Merge rewrite rules of identifier: pattern over the existing rules, like LoadRewrite
+func (this Rules) AddRewrite(rules map[string]string) error {
+	for identifier, pattern := range rules {
+		if "" == pattern {
+			delete(this.Rewrite, identifier)
+			continue
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("rule %q: %s", identifier, err)
+		}
+
+		this.Rewrite[identifier] = re
+	}
+
+	return nil
+}
+
+// Apply the rules: rewrite the message, take the time from the message and downgrade benign messages
+func (this *SystemdJournalEntry) Process(rules Rules) {
+	this.rewrite(rules)
+	this.parseEmbeddedTime(rules)
+	this.downgrade(rules.Downgrades)
+}
+
+func (this *SystemdJournalEntry) rewrite(rules Rules) {
+	// Replace generic timestamp, only when it's used as the GELF timestamp
+	generic := rules.Rewrite["*"]
+	if generic != genericTimestamp || nil != lookupIdentifier(rules.Timezones, this.Syslog_identifier, this.Comm) {
+		this.applyRule(generic)
+	}
+
+	re := rules.Rewrite[this.Syslog_identifier]
+	if nil == re {
+		re = rules.Rewrite[this.Comm]
+	}
+
+	this.applyRule(re)
+}
+
+func (this *SystemdJournalEntry) applyRule(re *regexp.Regexp) {
+	if nil == re {
+		return
+	}
+
+	m := re.FindStringSubmatch(this.Message)
+	if m == nil {
+		return
+	}
+
+	// Store subpatterns in fields
+	for idx, key := range re.SubexpNames() {
+		if "" != key {
+			this.SetField(key, m[idx])
+		}
+	}
+
+	this.Message = re.ReplaceAllString(this.Message, "")
+}
+
+func (this *SystemdJournalEntry) downgrade(downgrades map[string][]*regexp.Regexp) {
+	if this.Priority >= DOWNGRADE_PRIORITY {
+		return
+	}
+
+	patterns := append(downgrades["*"], downgrades[this.Syslog_identifier]...)
+	if "" == this.Syslog_identifier {
+		patterns = append(patterns, downgrades[this.Comm]...)
+	}
+
+	for _, re := range patterns {
+		if re.MatchString(this.Message) {
+			this.Priority = DOWNGRADE_PRIORITY
+			return
+		}
+	}
+}
+
+// Store a value like a named subpattern: in the field with the same name, case insensitive. Unknown names
+// are added to Extra
+func (this *SystemdJournalEntry) SetField(name, value string) {
+	if "" == value {
+		return
+	}
+
+	if "Priority" == name {
+		if p, ok := PriorityByName(value); ok {
+			this.Priority = p
+			this.hasPriority = true
+		}
+		return
+	}
+
+	if "Timestamp" == name {
+		this.embeddedTime = value
+		return
+	}
+
+	v := reflect.ValueOf(this).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+
+		if "" == f.PkgPath && reflect.String == f.Type.Kind() && strings.EqualFold(f.Name, name) {
+			v.Field(i).SetString(value)
+			return
+		}
+	}
+
+	if nil == this.Fields {
+		this.Fields = make(map[string]string)
+	}
+	if nil == this.ruleFields {
+		this.ruleFields = make(map[string]bool)
+	}
+
+	// Replaces the journal field of the same name
+	if _, ok := this.raw[name]; ok && this.Fields[name] != value {
+		this.conflicts++
+	}
+	this.Fields[name] = value
+	this.ruleFields[name] = true
+}
+
+func (this *SystemdJournalEntry) parseEmbeddedTime(rules Rules) {
+	if "" == this.embeddedTime {
+		return
+	}
+
+	location := lookupIdentifier(rules.Timezones, this.Syslog_identifier, this.Comm)
+	if nil == location {
+		return
+	}
+
+	value := strings.Replace(this.embeddedTime, "/", "-", -1)
+	for _, identifier := range []string{this.Syslog_identifier, this.Comm, "*"} {
+		layout, ok := rules.TimestampLayouts[identifier]
+		if !ok {
+			continue
+		}
+
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			this.embeddedTimestamp = t.UnixNano() / 1000
+			return
+		}
+	}
+}
+
+func lookupIdentifier(locations map[string]*time.Location, identifier, comm string) *time.Location {
+	if l, ok := locations[identifier]; ok && "" != identifier {
+		return l
+	}
+
+	if l, ok := locations[comm]; ok && "" != comm {
+		return l
+	}
+
+	return locations["*"]
+}
@@ -0,0 +1,199 @@
+package journal2gelf
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseTestEntry(t *testing.T, fields map[string]string) *SystemdJournalEntry {
+	t.Helper()
+
+	data, _ := json.Marshal(fields)
+	entry, err := ParseEntry(data)
+	if err != nil {
+		t.Fatalf("ParseEntry(%s): %s", data, err)
+	}
+
+	return entry
+}
+
+func TestRewriteSubpatterns(t *testing.T) {
+	tests := []struct {
+		name       string
+		rules      map[string]string
+		identifier string
+		message    string
+		want       string
+		priority   int32
+		fields     map[string]interface{}
+	}{
+		{
+			name:       "named field",
+			rules:      map[string]string{"nginx": `^"[^"]*" (?P<Status_Code>[0-9]{3}) `},
+			identifier: "nginx",
+			message:    `"GET / HTTP/1.1" 404 512`,
+			want:       "512",
+			priority:   6,
+			fields:     map[string]interface{}{"Status_Code": "404"},
+		},
+		{
+			name:       "priority and logger",
+			rules:      map[string]string{"java": `^(?P<Priority>[A-Z]+) (?P<Logger>[\w.]+): `},
+			identifier: "java",
+			message:    "WARN com.example.Shop: out of stock",
+			want:       "out of stock",
+			priority:   4,
+			fields:     map[string]interface{}{"Logger": "com.example.Shop"},
+		},
+		{
+			name:       "field names are case insensitive",
+			rules:      map[string]string{"shop": `^req=(?P<request_id>\S+) `},
+			identifier: "shop",
+			message:    "req=abc123 order placed",
+			want:       "order placed",
+			priority:   6,
+			fields:     map[string]interface{}{"Request_Id": "abc123"},
+		},
+		{
+			name:       "unknown names are additional fields",
+			rules:      map[string]string{"shop": `^\[(?P<Order_Ref>[0-9a-f]+)\] `},
+			identifier: "shop",
+			message:    "[beef] shipped",
+			want:       "shipped",
+			priority:   6,
+			fields:     map[string]interface{}{"Order_Ref": "beef"},
+		},
+		{
+			name:       "unknown priority names are ignored",
+			rules:      map[string]string{"shop": `^(?P<Priority>[A-Z]+): `},
+			identifier: "shop",
+			message:    "VERBOSE: details",
+			want:       "details",
+			priority:   6,
+		},
+		{
+			name:       "empty subpatterns are not set",
+			rules:      map[string]string{"shop": `^(?P<Order_Ref>[0-9]*)- `},
+			identifier: "shop",
+			message:    "- no reference",
+			want:       "no reference",
+			priority:   6,
+			fields:     map[string]interface{}{"Order_Ref": nil},
+		},
+		{
+			name:       "no match",
+			rules:      map[string]string{"shop": `^\[(?P<Order_Ref>[0-9a-f]+)\] `},
+			identifier: "shop",
+			message:    "shipped",
+			want:       "shipped",
+			priority:   6,
+			fields:     map[string]interface{}{"Order_Ref": nil},
+		},
+		{
+			name:       "built-in rule",
+			identifier: "mysqld",
+			message:    "12 [Warning] Aborted connection",
+			want:       "Aborted connection",
+			priority:   4,
+		},
+		{
+			name:       "disabled built-in rule",
+			rules:      map[string]string{"mysqld": ""},
+			identifier: "mysqld",
+			message:    "12 [Warning] Aborted connection",
+			want:       "12 [Warning] Aborted connection",
+			priority:   6,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules := DefaultRules()
+			if err := rules.AddRewrite(test.rules); err != nil {
+				t.Fatal(err)
+			}
+
+			entry := parseTestEntry(t, map[string]string{
+				"MESSAGE":           test.message,
+				"SYSLOG_IDENTIFIER": test.identifier,
+				"PRIORITY":          "6",
+				"_PID":              "42",
+			})
+			entry.Process(rules)
+
+			if entry.Message != test.want {
+				t.Errorf("message %q, want %q", entry.Message, test.want)
+			}
+			if entry.Priority != test.priority {
+				t.Errorf("priority %d, want %d", entry.Priority, test.priority)
+			}
+
+			extra := entry.ToGelf().Extra
+			for key, want := range test.fields {
+				value, ok := extra[key]
+				if nil == want && ok && "" != value {
+					t.Errorf("field %s is %q, want it unset", key, value)
+				} else if nil != want && value != want {
+					t.Errorf("field %s is %q, want %q", key, value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessPriority(t *testing.T) {
+	tests := []struct {
+		identifier string
+		message    string
+		want       int32
+	}{
+		{"nginx", "2024/05/01 10:00:00 [error] 12#12: upstream timed out", 3},
+		{"nginx", "2024/05/01 10:00:00 [warn] 12#12: low disk", 4},
+		{"java", "SEVERE: out of memory", 6},
+		{"java", "ERROR: connection lost", 3},
+		{"mysqld", "12 [Warning] Aborted connection", 4},
+		{"mysqld", "12 [Note] Ready for connections", 6},
+		{"syncthing", "[ABCDE] 10:00:00 INFO: Connected", 6},
+		{"other", "ERROR: not a known identifier", 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.identifier+" "+test.message, func(t *testing.T) {
+			entry := parseTestEntry(t, map[string]string{"MESSAGE": test.message, "SYSLOG_IDENTIFIER": test.identifier, "PRIORITY": "6"})
+			entry.Process(DefaultRules())
+
+			if entry.Priority != test.want {
+				t.Errorf("priority %d, want %d", entry.Priority, test.want)
+			}
+		})
+	}
+}
+
+func TestAddRewriteInvalid(t *testing.T) {
+	err := DefaultRules().AddRewrite(map[string]string{"broken": "(?P<Priority>[a-z]+"})
+	if nil == err || !strings.Contains(err.Error(), `"broken"`) {
+		t.Fatalf("error %v, want one naming the rule", err)
+	}
+}
+
+func TestGenericTimestamp(t *testing.T) {
+	fields := map[string]string{"MESSAGE": "2024-05-01 10:00:00,123 hello", "SYSLOG_IDENTIFIER": "app", "__REALTIME_TIMESTAMP": "1"}
+
+	entry := parseTestEntry(t, fields)
+	entry.Process(DefaultRules())
+	if "2024-05-01 10:00:00,123 hello" != entry.Message || 1 != entry.Timestamp() {
+		t.Errorf("without a timezone got %q at %d, want the message unchanged", entry.Message, entry.Timestamp())
+	}
+
+	rules := DefaultRules()
+	rules.Timezones["*"] = time.UTC
+	entry = parseTestEntry(t, fields)
+	entry.Process(rules)
+
+	want := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC).UnixNano() / 1000
+	if "hello" != entry.Message || want != entry.Timestamp() {
+		t.Errorf("with a timezone got %q at %d, want %q at %d", entry.Message, entry.Timestamp(), "hello", want)
+	}
+}
@@ -0,0 +1,125 @@
+package journal2gelf
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Hands entries to a running SystemdJournal2Gelf over the socket of its --socket option, which processes
+// and sends them like journal entries, or to a Forwarder of the same program
+type Shipper struct {
+	sync.Mutex
+	socket    string
+	conn      net.Conn
+	reader    *bufio.Reader
+	forwarder *Forwarder
+	rules     Rules
+}
+
+// A shipper sending to the socket of SystemdJournal2Gelf, which accepts every entry before Send returns
+func DialShipper(socket string) (*Shipper, error) {
+	this := &Shipper{socket: socket}
+	if err := this.connect(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// A shipper processing entries with the rules and adding them to the forwarder, which must be started
+func NewShipper(forwarder *Forwarder, rules Rules) *Shipper {
+	return &Shipper{forwarder: forwarder, rules: rules}
+}
+
+func (this *Shipper) Send(entry *Entry) error {
+	if nil != this.forwarder {
+		built, err := entry.Build()
+		if err != nil {
+			return err
+		}
+
+		built.Process(this.rules)
+		this.forwarder.Add(built)
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	// Reconnect once, SystemdJournal2Gelf may have restarted since the last entry
+	err = this.send(data)
+	if _, rejected := err.(rejectedError); nil != err && !rejected {
+		if err = this.connect(); nil == err {
+			err = this.send(data)
+		}
+	}
+
+	return err
+}
+
+// The reply of the socket is ok, or the reason the entry was rejected
+type rejectedError string
+
+func (this rejectedError) Error() string {
+	return "entry rejected: " + string(this)
+}
+
+func (this *Shipper) send(data []byte) error {
+	if nil == this.conn {
+		return errors.New("not connected")
+	}
+
+	if _, err := this.conn.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	reply, err := this.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	if reply = strings.TrimSpace(reply); "ok" != reply {
+		return rejectedError(reply)
+	}
+
+	return nil
+}
+
+func (this *Shipper) connect() error {
+	if nil != this.conn {
+		this.conn.Close()
+		this.conn = nil
+	}
+
+	conn, err := net.Dial("unix", this.socket)
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %s", this.socket, err)
+	}
+
+	this.conn = conn
+	this.reader = bufio.NewReader(conn)
+	return nil
+}
+
+func (this *Shipper) Close() error {
+	this.Lock()
+	defer this.Unlock()
+
+	if nil == this.conn {
+		return nil
+	}
+
+	err := this.conn.Close()
+	this.conn = nil
+	return err
+}
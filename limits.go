@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+const TRUNCATED_MARKER = "\n[truncated]"
+
+// Splits lines like bufio.ScanLines, but a line longer than the scanner buffer is skipped instead of
+// stopping the scanner with bufio.ErrTooLong
+type lineSplitter struct {
+	max      int
+	skipping bool
+}
+
+func (this *lineSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		if this.skipping {
+			this.skipping = false
+			return i + 1, nil, nil
+		}
+
+		return i + 1, bytes.TrimSuffix(data[:i], []byte{'\r'}), nil
+	}
+
+	if atEOF {
+		if 0 == len(data) || this.skipping {
+			return len(data), nil, nil
+		}
+
+		return len(data), data, nil
+	}
+
+	// The buffer is full without a newline, discard what we have and everything up to the next one
+	if len(data) >= this.max {
+		if !this.skipping {
+			fmt.Fprintf(os.Stderr, "Skipping journal entry longer than %d bytes, starting with: %.100s\n", this.max, data)
+			atomic.AddUint64(&metrics.linesSkipped, 1)
+			this.skipping = true
+		}
+
+		return len(data), nil, nil
+	}
+
+	return 0, nil, nil
+}
+
+// Cut the full message, and the short message when that isn't enough, so the serialized message fits
+// in max bytes
+func truncateMessage(message *gelf.Message, max int) {
+	size := messageSize(message)
+	if size <= max {
+		return
+	}
+
+	if nil == message.Extra {
+		message.Extra = map[string]interface{}{}
+	}
+	message.Extra["truncated"] = true
+
+	// Escaping makes the serialized text longer than the message itself, so repeat until it fits
+	for _, text := range []*string{&message.Full, &message.Short} {
+		for size > max && "" != *text {
+			*text = truncateText(*text, size-max)
+			size = messageSize(message)
+		}
+	}
+}
+
+// Remove at least excess bytes from the text, on a rune boundary, and append the marker
+func truncateText(text string, excess int) string {
+	text = strings.TrimSuffix(text, TRUNCATED_MARKER)
+
+	n := len(text) - excess - len(TRUNCATED_MARKER)
+	if n <= 0 {
+		return ""
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+
+	return text[:n] + TRUNCATED_MARKER
+}
+
+func messageSize(message *gelf.Message) int {
+	b, err := json.Marshal(message)
+	if err != nil {
+		return 0
+	}
+
+	return len(b)
+}
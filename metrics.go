@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Counters are updated atomically from the hot path, and only read when scraped
+var metrics struct {
+	entriesRead        uint64
+	entriesSent        uint64
+	entriesFiltered    uint64
+	entriesDropped     uint64
+	entriesRateLimited uint64
+	parseErrors        uint64
+	linesSkipped       uint64
+	writeErrors        uint64
+	spoolExpired       uint64
+	spoolDropped       uint64
+	fallbackWritten    uint64
+	fieldConflicts     uint64
+	lastTimestamp      int64
+}
+
+// Stages of handling an entry, timed to see which one a slowdown comes from
+const (
+	STAGE_DECODE = iota
+	STAGE_PROCESS
+	STAGE_ENRICH
+	STAGE_SERIALIZE
+	STAGE_SEND
+	STAGE_COUNT
+)
+
+var stageNames = [STAGE_COUNT]string{"decode", "process", "enrich", "serialize", "send"}
+
+var stages [STAGE_COUNT]struct {
+	nanos uint64
+	count uint64
+}
+
+func timeStage(stage int, started time.Time) {
+	atomic.AddUint64(&stages[stage].nanos, uint64(time.Since(started)))
+	atomic.AddUint64(&stages[stage].count, 1)
+}
+
+// Serve the metrics in the Prometheus text format on /metrics
+func serveMetrics(address string) {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		writeMetric(w, "entries_read_total", "counter", "Journal entries read from journalctl", atomic.LoadUint64(&metrics.entriesRead))
+		writeMetric(w, "entries_sent_total", "counter", "GELF messages sent", atomic.LoadUint64(&metrics.entriesSent))
+		writeMetric(w, "entries_filtered_total", "counter", "Journal entries dropped by filters", atomic.LoadUint64(&metrics.entriesFiltered))
+		writeMetric(w, "entries_rate_limited_total", "counter", "Journal entries dropped by --unit-rate-limit", atomic.LoadUint64(&metrics.entriesRateLimited))
+		writeMetric(w, "entries_dropped_total", "counter", "GELF messages dropped after retrying for --retry-timeout", atomic.LoadUint64(&metrics.entriesDropped))
+		writeMetric(w, "parse_errors_total", "counter", "Lines from journalctl which could not be parsed", atomic.LoadUint64(&metrics.parseErrors))
+		writeMetric(w, "lines_skipped_total", "counter", "Journal entries skipped because they exceed --max-line-size", atomic.LoadUint64(&metrics.linesSkipped))
+		writeMetric(w, "write_errors_total", "counter", "Failed writes to a GELF server", atomic.LoadUint64(&metrics.writeErrors))
+		writeMetric(w, "spool_expired_total", "counter", "Spooled messages skipped because they exceeded --spool-max-age", atomic.LoadUint64(&metrics.spoolExpired))
+		writeMetric(w, "spool_dropped_total", "counter", "Spooled messages dropped because the spool exceeded --spool-max-size", atomic.LoadUint64(&metrics.spoolDropped))
+		writeMetric(w, "fallback_written_total", "counter", "Severe messages written to the fallback file instead of being dropped", atomic.LoadUint64(&metrics.fallbackWritten))
+		writeMetric(w, "field_conflicts_total", "counter", "Fields of a message set by more than one source with different values", converter.ConflictCount()+atomic.LoadUint64(&metrics.fieldConflicts))
+
+		lag := 0.0
+		if last := atomic.LoadInt64(&metrics.lastTimestamp); last > 0 {
+			lag = float64(time.Now().UnixNano()/1000-last) / 1000 / 1000
+		}
+		writeMetric(w, "lag_seconds", "gauge", "Time between now and the last entry read from the journal", lag)
+
+		fmt.Fprintln(w, "# HELP systemdjournal2gelf_stage_duration_seconds Time spent per stage: decoding the JSON from journalctl, rewriting and filtering, converting to GELF, serializing and sending")
+		fmt.Fprintln(w, "# TYPE systemdjournal2gelf_stage_duration_seconds summary")
+		for i, name := range stageNames {
+			fmt.Fprintf(w, "systemdjournal2gelf_stage_duration_seconds_sum{stage=%q} %v\n", name, float64(atomic.LoadUint64(&stages[i].nanos))/float64(time.Second))
+			fmt.Fprintf(w, "systemdjournal2gelf_stage_duration_seconds_count{stage=%q} %v\n", name, atomic.LoadUint64(&stages[i].count))
+		}
+
+		if "" != *standbyLock {
+			writeMetric(w, "leader", "gauge", "1 when this instance holds --standby-lock and ships, 0 while it's the standby", atomic.LoadInt32(&leading))
+		}
+
+		writeOutputMetrics(w)
+
+		if "" != *remoteRules {
+			writeBundleMetrics(w)
+		}
+	})
+
+	if err := http.ListenAndServe(address, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "While serving metrics: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP systemdjournal2gelf_%s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE systemdjournal2gelf_%s %s\n", name, kind)
+	fmt.Fprintf(w, "systemdjournal2gelf_%s %v\n", name, value)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+)
+
+// Fields of the kernel's netfilter log lines, the remaining words after PROTO are TCP flags
+var netfilterFields = map[string]string{
+	"IN":       "fw_in",
+	"OUT":      "fw_out",
+	"MAC":      "fw_mac",
+	"SRC":      "fw_src",
+	"DST":      "fw_dst",
+	"LEN":      "fw_len",
+	"TTL":      "fw_ttl",
+	"HOPLIMIT": "fw_ttl",
+	"PROTO":    "fw_proto",
+	"SPT":      "fw_src_port",
+	"DPT":      "fw_dst_port",
+	"TYPE":     "fw_icmp_type",
+	"CODE":     "fw_icmp_code",
+}
+
+var tcpFlags = map[string]bool{"CWR": true, "ECE": true, "URG": true, "ACK": true, "PSH": true, "RST": true, "SYN": true, "FIN": true}
+
+// Logged by the LOG target of iptables and the log statement of nftables, behind the configured prefix:
+// [UFW BLOCK] IN=eth0 OUT= MAC=... SRC=203.0.113.5 DST=10.0.0.2 LEN=60 ... PROTO=TCP SPT=51234 DPT=22 ... SYN URGP=0
+func parseNetfilter(entry *SystemdJournalEntry) {
+	if "kernel" != entry.Transport {
+		return
+	}
+
+	message := entry.Message
+	start := strings.Index(message, "IN=")
+	if start < 0 || (start > 0 && ' ' != message[start-1]) || !strings.Contains(message[start:], " OUT=") {
+		return
+	}
+
+	entry.SetField("event", "firewall")
+	entry.SetField("fw_prefix", strings.TrimSpace(message[:start]))
+
+	var flags []string
+	for _, word := range strings.Fields(message[start:]) {
+		// ICMP errors quote the offending packet in brackets, its addresses aren't the ones of this packet
+		if strings.HasPrefix(word, "[") {
+			break
+		}
+
+		parts := strings.SplitN(word, "=", 2)
+		if 1 == len(parts) {
+			if tcpFlags[word] {
+				flags = append(flags, word)
+			}
+			continue
+		}
+
+		if field, ok := netfilterFields[parts[0]]; ok {
+			entry.SetField(field, parts[1])
+		}
+	}
+
+	if len(flags) > 0 {
+		entry.SetField("fw_tcp_flags", strings.Join(flags, " "))
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// How to clean up the value of an extra field, applied in the order of the fields
+type normalizer struct {
+	Trim       bool              `json:"trim"`
+	Lowercase  bool              `json:"lowercase"`
+	Uppercase  bool              `json:"uppercase"`
+	StripQuery bool              `json:"strip_query"`
+	Map        map[string]string `json:"map"`
+}
+
+// Read a JSON object of field name: normalizer, added to into
+func loadNormalizers(file string, into map[string]*normalizer) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var loaded map[string]*normalizer
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("parsing %s: %s", file, err)
+	}
+
+	return addNormalizers(into, loaded, file)
+}
+
+// All normalizers are checked before any is added, so on errors into is unchanged
+func addNormalizers(into, loaded map[string]*normalizer, source string) error {
+	for name, n := range loaded {
+		if nil == n {
+			return fmt.Errorf("field %q in %s has no normalizer", name, source)
+		}
+
+		if n.Lowercase && n.Uppercase {
+			return fmt.Errorf("field %q in %s is both lowercased and uppercased", name, source)
+		}
+	}
+
+	for name, n := range loaded {
+		into[name] = n
+	}
+
+	return nil
+}
+
+func (this *normalizer) normalize(value string) string {
+	if this.Trim {
+		value = strings.TrimSpace(value)
+	}
+
+	if this.Lowercase {
+		value = strings.ToLower(value)
+	} else if this.Uppercase {
+		value = strings.ToUpper(value)
+	}
+
+	if this.StripQuery {
+		if idx := strings.IndexAny(value, "?#"); idx != -1 {
+			value = value[:idx]
+		}
+	}
+
+	if mapped, ok := this.Map[value]; ok {
+		value = mapped
+	}
+
+	return value
+}
+
+// Normalizers are by name of the extra field
+func normalizeExtra(normalizers map[string]*normalizer, extra map[string]interface{}) {
+	for name, n := range normalizers {
+		if value, ok := extra[name].(string); ok {
+			extra[name] = n.normalize(value)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	OOM_RECENT_CURSORS = 5
+	OOM_MAX_TRACKED    = 10000
+)
+
+var (
+	// oom-kill:constraint=CONSTRAINT_MEMCG,nodemask=(null),cpuset=/,mems_allowed=0,oom_memcg=/system.slice/x.service,task_memcg=/system.slice/x.service,task=java,pid=1234,uid=0
+	oomKillLine = regexp.MustCompile("^oom-kill:.*task_memcg=([^,]*),task=([^,]*),pid=([0-9]+)")
+	// Out of memory: Killed process 1234 (java) total-vm:4414364kB, anon-rss:2613420kB, file-rss:0kB, ...
+	oomKilledLine = regexp.MustCompile("Killed process ([0-9]+) \\(([^)]*)\\)(?:.*anon-rss:([0-9]+)kB)?")
+)
+
+// Recognizes the kernel's OOM killer messages and adds the killed process, its cgroup and unit to the message
+// about the kill, along with the cursors of the last entries of that unit. Only sees entries in the order
+// they're read, so it must be called from the reader
+type oomCorrelator struct {
+	recent map[string][]string
+	units  map[string]string
+	kills  map[string][2]string
+}
+
+func newOomCorrelator() *oomCorrelator {
+	return &oomCorrelator{recent: map[string][]string{}, units: map[string]string{}, kills: map[string][2]string{}}
+}
+
+func (this *oomCorrelator) observe(entry *SystemdJournalEntry) {
+	if "kernel" != entry.Transport {
+		this.remember(entry)
+		return
+	}
+
+	// Newer kernels first log the cgroup of the victim, then the kill itself
+	if m := oomKillLine.FindStringSubmatch(entry.Message); nil != m {
+		if len(this.kills) >= OOM_MAX_TRACKED {
+			this.kills = map[string][2]string{}
+		}
+		this.kills[m[3]] = [2]string{m[1], m[2]}
+		return
+	}
+
+	m := oomKilledLine.FindStringSubmatch(entry.Message)
+	if nil == m {
+		return
+	}
+
+	pid := m[1]
+	cgroup := this.kills[pid][0]
+	delete(this.kills, pid)
+
+	unit := unitOfCgroup(cgroup)
+	if "" == unit {
+		unit = this.units[pid]
+	}
+
+	entry.SetField("event", "oom_kill")
+	entry.SetField("oom_pid", pid)
+	entry.SetField("oom_comm", m[2])
+	entry.SetField("oom_cgroup", cgroup)
+	if "" != m[3] {
+		entry.SetField("oom_anon_rss_kb", m[3])
+	}
+
+	if "" != unit {
+		entry.SetField("oom_unit", unit)
+		entry.SetField("oom_recent_cursors", strings.Join(this.recent[unit], " "))
+	}
+}
+
+// Keep the unit of every process, and the last cursors of every unit
+func (this *oomCorrelator) remember(entry *SystemdJournalEntry) {
+	if "" == entry.Systemd_unit {
+		return
+	}
+
+	if "" != entry.Pid {
+		if len(this.units) >= OOM_MAX_TRACKED {
+			this.units = map[string]string{}
+		}
+		this.units[entry.Pid] = entry.Systemd_unit
+	}
+
+	if "" != entry.Cursor {
+		cursors := append(this.recent[entry.Systemd_unit], entry.Cursor)
+		if len(cursors) > OOM_RECENT_CURSORS {
+			cursors = cursors[len(cursors)-OOM_RECENT_CURSORS:]
+		}
+		this.recent[entry.Systemd_unit] = cursors
+	}
+}
+
+// The innermost unit in a cgroup path like /user.slice/user-1000.slice/user@1000.service/app.slice/x.service
+func unitOfCgroup(cgroup string) string {
+	parts := strings.Split(cgroup, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		for _, suffix := range []string{".service", ".scope", ".socket", ".mount", ".swap"} {
+			if strings.HasSuffix(parts[i], suffix) {
+				return parts[i]
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outputs which aren't the GELF servers of the primary path, like the security server or the journal
+// export, each have their own goroutine and bounded buffer. A stalled output then only fills its own
+// buffer, after which its messages are dropped and counted, instead of holding up the others
+type outputQueue struct {
+	name    string
+	items   chan queuedItem
+	dropped uint64
+	sent    uint64
+	busy    int64
+	done    sync.WaitGroup
+}
+
+type queuedItem struct {
+	queued time.Time
+	send   func()
+}
+
+var outputs = struct {
+	sync.Mutex
+	queues []*outputQueue
+}{}
+
+func newOutputQueue(name string, size int) *outputQueue {
+	this := &outputQueue{name: name, items: make(chan queuedItem, size)}
+
+	outputs.Lock()
+	outputs.queues = append(outputs.queues, this)
+	outputs.Unlock()
+
+	this.done.Add(1)
+	go this.run()
+
+	return this
+}
+
+// Never blocks, when the buffer is full the item is dropped
+func (this *outputQueue) submit(send func()) bool {
+	select {
+	case this.items <- queuedItem{time.Now(), send}:
+		return true
+	default:
+		if 1 == atomic.AddUint64(&this.dropped, 1) {
+			fmt.Fprintf(os.Stderr, "Output %s can't keep up, dropping messages\n", this.name)
+		}
+		return false
+	}
+}
+
+func (this *outputQueue) run() {
+	defer this.done.Done()
+
+	for item := range this.items {
+		atomic.StoreInt64(&this.busy, item.queued.UnixNano())
+		item.send()
+		atomic.StoreInt64(&this.busy, 0)
+		atomic.AddUint64(&this.sent, 1)
+	}
+}
+
+// How long the item being sent has waited, zero when idle
+func (this *outputQueue) lag() float64 {
+	busy := atomic.LoadInt64(&this.busy)
+	if 0 == busy {
+		return 0
+	}
+
+	return time.Since(time.Unix(0, busy)).Seconds()
+}
+
+// Sends what's buffered and waits for it, up to SHUTDOWN_TIMEOUT. Returns false when the output is
+// stalled, its goroutine is then still sending and the output can't be closed
+func (this *outputQueue) Close() bool {
+	close(this.items)
+
+	finished := make(chan struct{})
+	go func() {
+		this.done.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(SHUTDOWN_TIMEOUT):
+		fmt.Fprintf(os.Stderr, "Output %s is stalled, dropping %d buffered messages\n", this.name, len(this.items))
+		return false
+	}
+}
+
+func writeOutputMetrics(w io.Writer) {
+	outputs.Lock()
+	queues := append([]*outputQueue{}, outputs.queues...)
+	outputs.Unlock()
+
+	if 0 == len(queues) {
+		return
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].name < queues[j].name })
+
+	fmt.Fprintln(w, "# HELP systemdjournal2gelf_output_queued Messages buffered per output")
+	fmt.Fprintln(w, "# TYPE systemdjournal2gelf_output_queued gauge")
+	for _, q := range queues {
+		fmt.Fprintf(w, "systemdjournal2gelf_output_queued{output=%q} %d\n", q.name, len(q.items))
+	}
+
+	fmt.Fprintln(w, "# HELP systemdjournal2gelf_output_sent_total Messages handed to the output")
+	fmt.Fprintln(w, "# TYPE systemdjournal2gelf_output_sent_total counter")
+	for _, q := range queues {
+		fmt.Fprintf(w, "systemdjournal2gelf_output_sent_total{output=%q} %d\n", q.name, atomic.LoadUint64(&q.sent))
+	}
+
+	fmt.Fprintln(w, "# HELP systemdjournal2gelf_output_dropped_total Messages dropped because the buffer of the output was full")
+	fmt.Fprintln(w, "# TYPE systemdjournal2gelf_output_dropped_total counter")
+	for _, q := range queues {
+		fmt.Fprintf(w, "systemdjournal2gelf_output_dropped_total{output=%q} %d\n", q.name, atomic.LoadUint64(&q.dropped))
+	}
+
+	fmt.Fprintln(w, "# HELP systemdjournal2gelf_output_lag_seconds How long the message the output is sending waited in its buffer")
+	fmt.Fprintln(w, "# TYPE systemdjournal2gelf_output_lag_seconds gauge")
+	for _, q := range queues {
+		fmt.Fprintf(w, "systemdjournal2gelf_output_lag_seconds{output=%q} %v\n", q.name, q.lag())
+	}
+}
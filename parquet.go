@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+const PARQUET_ROW_GROUP_SIZE = 10000
+
+// Parquet physical and converted types, encodings and codecs, as defined by parquet.thrift
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetUtf8            = 0
+	parquetTimestampMicros = 10
+
+	parquetOptional = 1
+	parquetPlain    = 0
+	parquetRle      = 3
+	parquetGzip     = 2
+)
+
+// Writes GELF messages as a Parquet file with one column per GELF field and per field of the field
+// mapping, the remaining additional fields end up as a JSON object in the extra column. Only what's
+// needed for that is implemented: flat optional columns, plain encoding and gzip compressed pages
+type parquetWriter struct {
+	out       io.Writer
+	offset    int64
+	columns   []*parquetColumn
+	rows      int
+	total     int64
+	rowGroups [][]parquetChunk
+	groupRows []int
+}
+
+type parquetColumn struct {
+	name      string
+	kind      int32
+	converted int32
+	levels    []bool
+	values    bytes.Buffer
+}
+
+type parquetChunk struct {
+	column           *parquetColumn
+	offset           int64
+	values           int
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+func newParquetWriter(out io.Writer) (*parquetWriter, error) {
+	this := &parquetWriter{out: out}
+
+	this.columns = []*parquetColumn{
+		{name: "host", kind: parquetByteArray, converted: parquetUtf8},
+		{name: "short_message", kind: parquetByteArray, converted: parquetUtf8},
+		{name: "full_message", kind: parquetByteArray, converted: parquetUtf8},
+		{name: "timestamp", kind: parquetInt64, converted: parquetTimestampMicros},
+		{name: "level", kind: parquetInt32, converted: -1},
+		{name: "facility", kind: parquetByteArray, converted: parquetUtf8},
+	}
+
+	// Every message has the mapped fields, so they get their own column
+	var mapped []string
+	for name := range (&SystemdJournalEntry{}).ToGelf().Extra {
+		mapped = append(mapped, name)
+	}
+	sort.Strings(mapped)
+
+	for _, name := range mapped {
+		this.columns = append(this.columns, &parquetColumn{name: name, kind: parquetByteArray, converted: parquetUtf8})
+	}
+	this.columns = append(this.columns, &parquetColumn{name: "extra", kind: parquetByteArray, converted: parquetUtf8})
+
+	return this, this.write([]byte("PAR1"))
+}
+
+func (this *parquetWriter) write(data []byte) error {
+	n, err := this.out.Write(data)
+	this.offset += int64(n)
+	return err
+}
+
+func (this *parquetWriter) WriteMessage(message *gelf.Message) error {
+	extra := map[string]interface{}{}
+	for key, value := range message.Extra {
+		extra[key] = value
+	}
+
+	for _, column := range this.columns {
+		switch column.name {
+		case "host":
+			column.addString(message.Host)
+		case "short_message":
+			column.addString(message.Short)
+		case "full_message":
+			column.addString(message.Full)
+		case "timestamp":
+			column.addInt64(int64(math.Round(message.TimeUnix * 1000 * 1000)))
+		case "level":
+			column.addInt32(message.Level)
+		case "facility":
+			column.addString(message.Facility)
+		case "extra":
+			if 0 == len(extra) {
+				column.addNull()
+			} else if data, err := json.Marshal(extra); err != nil {
+				return err
+			} else {
+				column.addString(string(data))
+			}
+		default:
+			value, ok := extra[column.name]
+			delete(extra, column.name)
+
+			if s, isString := value.(string); !ok || "" == s {
+				column.addNull()
+			} else if isString {
+				column.addString(s)
+			} else {
+				data, _ := json.Marshal(value)
+				column.addString(string(data))
+			}
+		}
+	}
+
+	if this.rows++; this.rows >= PARQUET_ROW_GROUP_SIZE {
+		return this.flush()
+	}
+
+	return nil
+}
+
+func (this *parquetColumn) addNull() {
+	this.levels = append(this.levels, false)
+}
+
+func (this *parquetColumn) addString(value string) {
+	if "" == value {
+		this.addNull()
+		return
+	}
+
+	this.levels = append(this.levels, true)
+	binary.Write(&this.values, binary.LittleEndian, uint32(len(value)))
+	this.values.WriteString(value)
+}
+
+func (this *parquetColumn) addInt32(value int32) {
+	this.levels = append(this.levels, true)
+	binary.Write(&this.values, binary.LittleEndian, value)
+}
+
+func (this *parquetColumn) addInt64(value int64) {
+	this.levels = append(this.levels, true)
+	binary.Write(&this.values, binary.LittleEndian, value)
+}
+
+// Write the buffered rows as a row group, with a single data page per column
+func (this *parquetWriter) flush() error {
+	if 0 == this.rows {
+		return nil
+	}
+
+	var chunks []parquetChunk
+	for _, column := range this.columns {
+		var page bytes.Buffer
+
+		levels := encodeLevels(column.levels)
+		binary.Write(&page, binary.LittleEndian, uint32(len(levels)))
+		page.Write(levels)
+		page.Write(column.values.Bytes())
+
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(page.Bytes())
+		gz.Close()
+
+		var header thriftWriter
+		header.i32(1, 0)
+		header.i32(2, int32(page.Len()))
+		header.i32(3, int32(compressed.Len()))
+		header.beginStruct(5)
+		header.i32(1, int32(len(column.levels)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRle)
+		header.i32(4, parquetRle)
+		header.endStruct()
+		header.stop()
+
+		chunk := parquetChunk{
+			column:           column,
+			offset:           this.offset,
+			values:           len(column.levels),
+			uncompressedSize: int64(header.Len() + page.Len()),
+			compressedSize:   int64(header.Len() + compressed.Len()),
+		}
+
+		if err := this.write(header.Bytes()); err != nil {
+			return err
+		}
+		if err := this.write(compressed.Bytes()); err != nil {
+			return err
+		}
+
+		chunks = append(chunks, chunk)
+		column.levels = column.levels[:0]
+		column.values.Reset()
+	}
+
+	this.rowGroups = append(this.rowGroups, chunks)
+	this.groupRows = append(this.groupRows, this.rows)
+	this.total += int64(this.rows)
+	this.rows = 0
+
+	return nil
+}
+
+// Write the remaining rows and the footer describing the file, the underlying writer isn't closed
+func (this *parquetWriter) Close() error {
+	if err := this.flush(); err != nil {
+		return err
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+
+	meta.beginList(2, thriftStruct, len(this.columns)+1)
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(this.columns)))
+	meta.stop()
+	for _, column := range this.columns {
+		meta.i32(1, column.kind)
+		meta.i32(3, parquetOptional)
+		meta.binary(4, column.name)
+		if column.converted >= 0 {
+			meta.i32(6, column.converted)
+		}
+		meta.stop()
+	}
+	meta.endList()
+
+	meta.i64(3, this.total)
+
+	meta.beginList(4, thriftStruct, len(this.rowGroups))
+	for i, chunks := range this.rowGroups {
+		var size int64
+
+		meta.beginList(1, thriftStruct, len(chunks))
+		for _, chunk := range chunks {
+			size += chunk.uncompressedSize
+
+			meta.i64(2, chunk.offset)
+			meta.beginStruct(3)
+			meta.i32(1, chunk.column.kind)
+			meta.beginList(2, thriftI32, 2)
+			meta.varint(parquetPlain)
+			meta.varint(parquetRle)
+			meta.endList()
+			meta.beginList(3, thriftBinary, 1)
+			meta.uvarint(uint64(len(chunk.column.name)))
+			meta.WriteString(chunk.column.name)
+			meta.endList()
+			meta.i32(4, parquetGzip)
+			meta.i64(5, int64(chunk.values))
+			meta.i64(6, chunk.uncompressedSize)
+			meta.i64(7, chunk.compressedSize)
+			meta.i64(9, chunk.offset)
+			meta.endStruct()
+			meta.stop()
+		}
+		meta.endList()
+
+		meta.i64(2, size)
+		meta.i64(3, int64(this.groupRows[i]))
+		meta.stop()
+	}
+	meta.endList()
+
+	meta.binary(6, "SystemdJournal2Gelf")
+	meta.stop()
+
+	if err := this.write(meta.Bytes()); err != nil {
+		return err
+	}
+
+	var footer [8]byte
+	binary.LittleEndian.PutUint32(footer[:4], uint32(meta.Len()))
+	copy(footer[4:], "PAR1")
+	return this.write(footer[:])
+}
+
+// Definition levels in the RLE hybrid encoding with a bit width of 1, as one run per repeated value
+func encodeLevels(levels []bool) []byte {
+	var out []byte
+	var tmp [binary.MaxVarintLen64]byte
+
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+
+		n := binary.PutUvarint(tmp[:], uint64(j-i)<<1)
+		out = append(out, tmp[:n]...)
+		if levels[i] {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+
+		i = j
+	}
+
+	return out
+}
+
+// Thrift compact protocol, just enough for the Parquet metadata
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+type thriftWriter struct {
+	bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+func (this *thriftWriter) field(id int16, kind byte) {
+	if delta := id - this.last; delta > 0 && delta <= 15 {
+		this.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		this.WriteByte(kind)
+		this.varint(int64(id))
+	}
+	this.last = id
+}
+
+func (this *thriftWriter) uvarint(value uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	this.Write(tmp[:binary.PutUvarint(tmp[:], value)])
+}
+
+// Zigzag encoded, like binary.PutVarint
+func (this *thriftWriter) varint(value int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	this.Write(tmp[:binary.PutVarint(tmp[:], value)])
+}
+
+func (this *thriftWriter) i32(id int16, value int32) {
+	this.field(id, thriftI32)
+	this.varint(int64(value))
+}
+
+func (this *thriftWriter) i64(id int16, value int64) {
+	this.field(id, thriftI64)
+	this.varint(value)
+}
+
+func (this *thriftWriter) binary(id int16, value string) {
+	this.field(id, thriftBinary)
+	this.uvarint(uint64(len(value)))
+	this.WriteString(value)
+}
+
+// Elements of a list of structs are written as structs, ended by stop
+func (this *thriftWriter) beginList(id int16, kind byte, size int) {
+	this.field(id, thriftList)
+	if size < 15 {
+		this.WriteByte(byte(size)<<4 | kind)
+	} else {
+		this.WriteByte(0xf0 | kind)
+		this.uvarint(uint64(size))
+	}
+	this.stack = append(this.stack, this.last)
+	this.last = 0
+}
+
+func (this *thriftWriter) endList() {
+	this.last = this.stack[len(this.stack)-1]
+	this.stack = this.stack[:len(this.stack)-1]
+}
+
+func (this *thriftWriter) beginStruct(id int16) {
+	this.field(id, thriftStruct)
+	this.stack = append(this.stack, this.last)
+	this.last = 0
+}
+
+func (this *thriftWriter) endStruct() {
+	this.stop()
+	this.last = this.stack[len(this.stack)-1]
+	this.stack = this.stack[:len(this.stack)-1]
+}
+
+// Ends a struct, and resets the field ids for the next struct in a list
+func (this *thriftWriter) stop() {
+	this.WriteByte(0)
+	this.last = 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Parsers adding fields from the messages of well known programs, by the name used with --parse
+var messageParsers = map[string]func(entry *SystemdJournalEntry){
+	"netfilter": parseNetfilter,
+	"dnsmasq":   parseDnsmasq,
+	"resolved":  parseResolved,
+	"named":     parseNamed,
+}
+
+var parsers []func(entry *SystemdJournalEntry)
+
+func setupParsers(names string) error {
+	for _, name := range strings.Split(names, ",") {
+		if "" == name {
+			continue
+		}
+
+		parser, ok := messageParsers[name]
+		if !ok {
+			return fmt.Errorf("unknown parser %q, use %s", name, strings.Join(parserNames(), ", "))
+		}
+
+		parsers = append(parsers, parser)
+	}
+
+	return nil
+}
+
+func parserNames() []string {
+	var names []string
+	for name := range messageParsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func parseMessage(entry *SystemdJournalEntry) {
+	for _, parser := range parsers {
+		parser(entry)
+	}
+}
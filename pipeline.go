@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+// Add what the options ask for to a message converted by the forwarder, and archive it
+func prepare(entry *SystemdJournalEntry, message *gelf.Message) {
+	started := time.Now()
+	extra := message.Extra
+	excludeExtra(entry, extra)
+
+	for key, raw := range entry.Raw() {
+		if excludeFields.contains(key) {
+			continue
+		}
+
+		if _, ok := extra[key]; !ok && *internalFields && strings.HasPrefix(key, "__") {
+			if value, ok := journal2gelf.JournalValue(raw); ok {
+				extra[key] = value
+			}
+		}
+	}
+
+	if *splitRequests {
+		decomposeRequest(extra)
+	}
+
+	normalizeExtra(rulesFor(entry).normalizers, extra)
+
+	if *messageIds && "" != entry.Cursor {
+		extra["message_id"] = entry.MessageId()
+	}
+
+	enrich(entry, extra)
+
+	if resources != nil {
+		resources.annotate(entry, extra)
+	}
+
+	addStaticFields(entry, extra)
+	message.Host = host(entry)
+	timeStage(STAGE_ENRICH, started)
+
+	started = time.Now()
+	truncateMessage(message, maxMessageSize)
+	timeStage(STAGE_SERIALIZE, started)
+
+	if archiver != nil {
+		archiver.add(entry, message)
+	}
+
+	if checkpoints != nil {
+		checkpoints.prepared(message, entry.LatestCursor())
+	}
+}
+
+// Remove the fields of --exclude-field from the converted message, by the journal field like _PID or by the
+// name in the message like Pid
+func excludeExtra(entry *SystemdJournalEntry, extra map[string]interface{}) {
+	for _, name := range excludeFields {
+		delete(extra, name)
+		for _, key := range entry.ExtraNames(name) {
+			delete(extra, key)
+		}
+	}
+}
+
+// Messages this severe or more skip the rate limit and the buffers of the spool and servers, -1 disables it
+var immediateLevel int32 = journal2gelf.IMMEDIATE_PRIORITY
+
+func isImmediate(message *gelf.Message) bool {
+	return message.Level <= immediateLevel
+}
+
+// Hands the messages of the forwarder to send. The forwarder retries the messages no server accepted, and
+// passes them to forwarderDropped after retry.Timeout
+type deliveryWriter struct {
+	limiter *rateLimiter
+}
+
+func (this *deliveryWriter) WriteMessage(message *gelf.Message) error {
+	if this.limiter != nil && !isImmediate(message) {
+		this.limiter.wait()
+	}
+
+	started := time.Now()
+	err := send(message)
+	timeStage(STAGE_SEND, started)
+
+	if nil == err && checkpoints != nil {
+		checkpoints.handedOff(message)
+	}
+
+	return err
+}
+
+// The message was kept in the fallback file or dropped, either way reading may continue after it
+func forwarderDropped(message *gelf.Message, err error) {
+	dropped(message, err)
+
+	if checkpoints != nil {
+		checkpoints.handedOff(message)
+	}
+}
+
+// Token bucket allowing bursts of up to one second worth of messages
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	return &rateLimiter{rate: float64(perSecond), tokens: float64(perSecond), last: time.Now()}
+}
+
+func (this *rateLimiter) wait() {
+	this.Lock()
+	defer this.Unlock()
+
+	this.refill()
+	if this.tokens < 1 {
+		time.Sleep(time.Duration((1 - this.tokens) / this.rate * float64(time.Second)))
+		this.refill()
+	}
+
+	this.tokens--
+}
+
+func (this *rateLimiter) refill() {
+	now := time.Now()
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	this.last = now
+
+	if this.tokens > this.rate {
+		this.tokens = this.rate
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+func TestExcludeExtra(t *testing.T) {
+	line := []byte(`{"MESSAGE":"hello","_PID":"42","_UID":"0","_CMDLINE":"app --serve","TAG":["a","b"],"TENANT_ID":"7"}`)
+	options := journal2gelf.ParseOptions{MultiValues: journal2gelf.MultiValuePolicy{Mode: journal2gelf.MULTI_VALUE_INDEX}}
+
+	saved := excludeFields
+	defer func() { excludeFields = saved }()
+	excludeFields = stringList{"_PID", "Uid", "_CMDLINE", "TAG"}
+
+	entry, err := journal2gelf.ParseEntryWith(line, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extra := entry.ToGelf().Extra
+	excludeExtra(entry, extra)
+
+	for _, key := range []string{"Pid", "Uid", "_CMDLINE", "TAG", "TAG_1"} {
+		if _, ok := extra[key]; ok {
+			t.Errorf("%s wasn't excluded", key)
+		}
+	}
+	if "7" != extra["TENANT_ID"] {
+		t.Errorf("TENANT_ID is %v, want it kept", extra["TENANT_ID"])
+	}
+}
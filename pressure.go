@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ERROR_PRIORITY        = 3
+	RESOURCE_BURST        = 3
+	RESOURCE_BURST_WINDOW = 10 * time.Second
+	CGROUP_ROOT           = "/sys/fs/cgroup"
+)
+
+// Adds the memory use of the process and the CPU pressure of its cgroup to error messages, once a unit
+// logs RESOURCE_BURST errors within RESOURCE_BURST_WINDOW. The stats are read when the message is sent,
+// which is right after it was logged unless delivery is behind
+type resourceStats struct {
+	sync.Mutex
+	errors map[string][]time.Time
+}
+
+func newResourceStats() *resourceStats {
+	return &resourceStats{errors: map[string][]time.Time{}}
+}
+
+func (this *resourceStats) annotate(entry *SystemdJournalEntry, extra map[string]interface{}) {
+	if "" == entry.Systemd_unit || !entry.HasPriority() || entry.Priority > ERROR_PRIORITY {
+		return
+	}
+
+	if !this.inBurst(entry.Systemd_unit) {
+		return
+	}
+
+	if pid, err := strconv.Atoi(entry.Pid); nil == err && pid > 0 {
+		if rss, ok := processRss(pid); ok {
+			extra["proc_rss"] = rss
+		}
+	}
+
+	if pressure, ok := cpuPressure(entryCgroup(entry)); ok {
+		extra["cgroup_cpu_pressure"] = pressure
+	}
+}
+
+// Count the error and tell whether the unit logged enough of them recently
+func (this *resourceStats) inBurst(unit string) bool {
+	this.Lock()
+	defer this.Unlock()
+
+	now := time.Now()
+	recent := this.errors[unit][:0]
+	for _, t := range this.errors[unit] {
+		if now.Sub(t) < RESOURCE_BURST_WINDOW {
+			recent = append(recent, t)
+		}
+	}
+
+	recent = append(recent, now)
+	if len(recent) > RESOURCE_BURST {
+		recent = recent[len(recent)-RESOURCE_BURST:]
+	}
+	this.errors[unit] = recent
+
+	return len(recent) >= RESOURCE_BURST
+}
+
+// The cgroup journald recorded for the entry, or the one the process is in now
+func entryCgroup(entry *SystemdJournalEntry) string {
+	if value, ok := entry.Value("_SYSTEMD_CGROUP"); ok && "" != value {
+		return value
+	}
+
+	if !isNumber(entry.Pid) {
+		return ""
+	}
+
+	data, err := ioutil.ReadFile("/proc/" + entry.Pid + "/cgroup")
+	if err != nil {
+		return ""
+	}
+
+	// The unified hierarchy is listed as 0::/system.slice/nginx.service
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::")
+		}
+	}
+
+	return ""
+}
+
+// Resident set size in bytes, from the second field of /proc/PID/statm which is counted in pages
+func processRss(pid int) (int64, bool) {
+	fields := strings.Fields(readProcFile("/proc/" + strconv.Itoa(pid) + "/statm"))
+	if len(fields) < 2 {
+		return 0, false
+	}
+
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return pages * int64(os.Getpagesize()), true
+}
+
+// The share of the last 10 seconds in which some tasks of the cgroup waited for CPU, in percent:
+// some avg10=1.23 avg60=0.50 avg300=0.10 total=12345
+func cpuPressure(cgroup string) (float64, bool) {
+	if "" == cgroup {
+		return 0, false
+	}
+
+	content := readProcFile(filepath.Join(CGROUP_ROOT, filepath.Clean("/"+cgroup), "cpu.pressure"))
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || "some" != fields[0] {
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "avg10=") {
+				value, err := strconv.ParseFloat(strings.TrimPrefix(field, "avg10="), 64)
+				return value, nil == err
+			}
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	JOURNAL_SOCKET      = "/run/systemd/journal/socket"
+	GELF_CHUNK_TIMEOUT  = 5 * time.Second
+	GELF_MAX_CHUNKS     = 128
+	GELF_MAX_INFLATED   = 8 * 1024 * 1024
+	JOURNAL_FIELD_LIMIT = 64
+)
+
+// Receive GELF messages over UDP and write them to the local journal using journald's native protocol,
+// so a central host can keep a journal archive next to Graylog
+func receive(args []string) {
+	flags := flag.NewFlagSet("receive", flag.ExitOnError)
+	listen := flags.String("listen", ":12201", "UDP address to receive GELF messages on")
+	socket := flags.String("journal-socket", JOURNAL_SOCKET, "Socket of journald's native protocol")
+	flags.Parse(args)
+
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "While listening for GELF messages: %s\n", err)
+		os.Exit(1)
+	}
+
+	journal, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: *socket, Net: "unixgram"})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "While connecting to journald: %s\n", err)
+		os.Exit(1)
+	}
+
+	chunks := make(map[string]*gelfChunks)
+	buf := make([]byte, 65536)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error receiving GELF message: %s\n", err)
+			os.Exit(1)
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		if data = reassembleGelf(chunks, data); nil == data {
+			continue
+		}
+
+		fields, err := decodeGelf(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not decode GELF message, skipping: %s\n", err)
+			continue
+		}
+
+		if err := writeJournal(journal, fields); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write to journal: %s\n", err)
+		}
+	}
+}
+
+type gelfChunks struct {
+	parts    [][]byte
+	received int
+	started  time.Time
+}
+
+// Returns the complete message once all chunks are received, or the datagram itself when it isn't chunked
+func reassembleGelf(pending map[string]*gelfChunks, data []byte) []byte {
+	if len(data) < 12 || data[0] != 0x1e || data[1] != 0x0f {
+		return data
+	}
+
+	for id, chunks := range pending {
+		if time.Since(chunks.started) > GELF_CHUNK_TIMEOUT {
+			delete(pending, id)
+		}
+	}
+
+	id, seq, count := string(data[2:10]), int(data[10]), int(data[11])
+	if count > GELF_MAX_CHUNKS || seq >= count {
+		return nil
+	}
+
+	chunks := pending[id]
+	if nil == chunks {
+		chunks = &gelfChunks{parts: make([][]byte, count), started: time.Now()}
+		pending[id] = chunks
+	}
+
+	if seq >= len(chunks.parts) || nil != chunks.parts[seq] {
+		return nil
+	}
+
+	chunks.parts[seq] = data[12:]
+	if chunks.received++; chunks.received < len(chunks.parts) {
+		return nil
+	}
+
+	delete(pending, id)
+	return bytes.Join(chunks.parts, nil)
+}
+
+// Decompress and parse a GELF message into journal fields
+func decodeGelf(data []byte) (map[string]string, error) {
+	var r io.Reader = bytes.NewReader(data)
+	var err error
+
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		r, err = gzip.NewReader(r)
+	} else if len(data) > 2 && data[0] == 0x78 {
+		r, err = zlib.NewReader(r)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var message map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(r, GELF_MAX_INFLATED)).Decode(&message); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string)
+	for key, value := range message {
+		switch key {
+		case "version":
+		case "short_message":
+			if _, ok := fields["MESSAGE"]; !ok {
+				fields["MESSAGE"] = gelfString(value)
+			}
+		case "full_message":
+			if full := gelfString(value); "" != full {
+				fields["MESSAGE"] = full
+			}
+		case "level":
+			fields["PRIORITY"] = gelfString(value)
+		case "facility":
+			fields["SYSLOG_IDENTIFIER"] = gelfString(value)
+		case "host":
+			fields["GELF_HOST"] = gelfString(value)
+		case "timestamp":
+			if ts, ok := value.(float64); ok {
+				fields["GELF_TIMESTAMP"] = strconv.FormatInt(int64(ts*1000*1000), 10)
+			}
+		default:
+			if name := journalFieldName(key); "" != name {
+				fields[name] = gelfString(value)
+			}
+		}
+	}
+
+	if _, ok := fields["MESSAGE"]; !ok {
+		return nil, errors.New("message without short_message")
+	}
+
+	return fields, nil
+}
+
+func gelfString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// Journal fields are uppercase letters, digits and underscores, and clients may not set ones starting with an underscore
+func journalFieldName(key string) string {
+	name := strings.ToUpper(strings.TrimLeft(key, "_"))
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+
+	if "" == name {
+		return ""
+	}
+
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "GELF_" + name
+	}
+
+	if len(name) > JOURNAL_FIELD_LIMIT {
+		name = name[:JOURNAL_FIELD_LIMIT]
+	}
+
+	return name
+}
+
+func writeJournal(conn *net.UnixConn, fields map[string]string) error {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, key := range keys {
+		writeExportField(w, key, []byte(fields[key]))
+	}
+	w.Flush()
+
+	_, err := conn.Write(buf.Bytes())
+	if err == nil {
+		return nil
+	}
+
+	// Messages larger than a datagram are passed as file descriptor, like sd_journal_send does
+	if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+		return writeJournalFd(conn, buf.Bytes())
+	}
+
+	return err
+}
+
+func writeJournalFd(conn *net.UnixConn, data []byte) error {
+	f, err := ioutil.TempFile("/dev/shm", "journal.")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+
+	// WriteMsgUnix refuses connected datagram sockets
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	rights := syscall.UnixRights(int(f.Fd()))
+	if werr := raw.Write(func(fd uintptr) bool {
+		err = syscall.Sendmsg(int(fd), nil, rights, nil, 0)
+		return err != syscall.EAGAIN
+	}); werr != nil {
+		return werr
+	}
+
+	return err
+}
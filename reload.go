@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+// Rewrite rules, downgrades, timezones and normalizers built from one version of the rule bundle, the
+// rule files and the options
+type ruleSet struct {
+	version     string
+	bundle      *ruleBundle
+	rules       journal2gelf.Rules
+	normalizers map[string]*normalizer
+	stats       *bundleStats
+}
+
+// Guards the rule sets, which are replaced as a whole on reload
+var ruleLock sync.RWMutex
+
+// The rules of all entries except those of the canary, the built-in ones until the options are read
+var stableRules = &ruleSet{rules: journal2gelf.DefaultRules(), normalizers: map[string]*normalizer{}, stats: &bundleStats{}}
+
+func buildRules(bundle *ruleBundle, version string) (*ruleSet, error) {
+	set := &ruleSet{
+		version:     version,
+		bundle:      bundle,
+		rules:       journal2gelf.DefaultRules(),
+		normalizers: map[string]*normalizer{},
+		stats:       statsOf(version),
+	}
+
+	if nil != bundle {
+		if err := set.rules.AddRewrite(bundle.Rewrite); err != nil {
+			return nil, fmt.Errorf("rewrite rules of the rule bundle: %s", err)
+		}
+
+		if err := addNormalizers(set.normalizers, bundle.Normalize, "the rule bundle"); err != nil {
+			return nil, fmt.Errorf("normalization rules: %s", err)
+		}
+	}
+
+	if "" != *rewriteFile {
+		if err := set.rules.LoadRewrite(*rewriteFile); err != nil {
+			return nil, fmt.Errorf("rewrite rules: %s", err)
+		}
+	}
+
+	if "" != *normalizeFile {
+		if err := loadNormalizers(*normalizeFile, set.normalizers); err != nil {
+			return nil, fmt.Errorf("normalization rules: %s", err)
+		}
+	}
+
+	if err := setupTimezones(set.rules, timezoneFlags, layoutFlags); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range downgradeRules {
+		parts := strings.SplitN(rule, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid downgrade rule %q, use identifier:regex", rule)
+		}
+
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid downgrade rule %q: %s", rule, err)
+		}
+
+		set.rules.Downgrades[parts[0]] = append(set.rules.Downgrades[parts[0]], re)
+	}
+
+	return set, nil
+}
+
+// Build the rules from the built-in rules, the rule bundle, the rule files and the options, in that order,
+// and replace the current ones. On errors the current ones are kept. A new version of the rule bundle
+// starts a canary when --canary-percent is set
+func loadRules() error {
+	bundle, version := currentBundle()
+	set, err := buildRules(bundle, version)
+	if err != nil {
+		return err
+	}
+
+	ruleLock.RLock()
+	stable := stableRules
+	ruleLock.RUnlock()
+
+	if *canaryPercent <= 0 || "" == stable.version || version == stable.version {
+		ruleLock.Lock()
+		stableRules = set
+		canary = nil
+		ruleLock.Unlock()
+
+		return nil
+	}
+
+	// The rule files may have changed as well, so the previous bundle is built again
+	previous, err := buildRules(stable.bundle, stable.version)
+	if err != nil {
+		return err
+	}
+
+	startCanary(previous, set)
+	return nil
+}
+
+// The rules for the entry, which depend on whether the canary applies to it
+func rulesFor(entry *SystemdJournalEntry) *ruleSet {
+	ruleLock.RLock()
+	defer ruleLock.RUnlock()
+
+	if nil != canary && canary.applies(entry) {
+		return canary.rules
+	}
+
+	return stableRules
+}
+
+// On SIGHUP read the rule files and the cached rule bundle again
+func handleReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		reload()
+	}
+}
+
+func reload() {
+	if "" != *remoteRules {
+		if err := loadCachedBundle(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read the cached rule bundle, keeping the current one: %s\n", err)
+		}
+	}
+
+	if err := loadRules(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not reload rules, keeping the current ones: %s\n", err)
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "Reloaded rules")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	REMOTE_TIMEOUT  = 30 * time.Second
+	REMOTE_MAX_SIZE = 16 * 1024 * 1024
+	NO_BUNDLE       = "none"
+)
+
+// Rules managed centrally, in the format of the --rewrite-rules and --normalize-rules files
+type ruleBundle struct {
+	Rewrite   map[string]string      `json:"rewrite_rules"`
+	Normalize map[string]*normalizer `json:"normalize_rules"`
+}
+
+// The rule bundle is only used when its signature verifies. The last verified one is cached, to start with
+// the same rules when the URL can't be reached
+var remote struct {
+	sync.Mutex
+	url     string
+	key     *minisignKey
+	cache   string
+	data    []byte
+	bundle  *ruleBundle
+	version string
+}
+
+func setupRemoteRules(url, key, cache string) error {
+	if !strings.HasPrefix(url, "https://") {
+		return fmt.Errorf("invalid url %q, expected https://", url)
+	}
+
+	if "" == key {
+		return fmt.Errorf("pass the public key the rule bundle is signed with in --remote-key")
+	}
+
+	k, err := parseMinisignKey(key)
+	if err != nil {
+		return err
+	}
+
+	remote.url = url
+	remote.key = k
+	remote.cache = cache
+
+	data, signature, err := fetchBundle()
+	if err == nil {
+		err = useBundle(data, signature, true)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not fetch rule bundle, using the cached one: %s\n", err)
+		if err := loadCachedBundle(); err != nil {
+			fmt.Fprintf(os.Stderr, "Starting without rule bundle: %s\n", err)
+		}
+	}
+
+	return nil
+}
+
+// The bundle with its version, NO_BUNDLE without one
+func currentBundle() (*ruleBundle, string) {
+	remote.Lock()
+	defer remote.Unlock()
+
+	if nil == remote.bundle {
+		return nil, NO_BUNDLE
+	}
+
+	return remote.bundle, remote.version
+}
+
+// Check for a changed bundle every interval, and apply it like on SIGHUP
+func pollRemoteRules(interval time.Duration) {
+	for range time.Tick(interval) {
+		data, signature, err := fetchBundle()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not fetch rule bundle: %s\n", err)
+			continue
+		}
+
+		remote.Lock()
+		unchanged := bytes.Equal(data, remote.data)
+		remote.Unlock()
+
+		if unchanged {
+			continue
+		}
+
+		if err := useBundle(data, signature, true); err != nil {
+			fmt.Fprintf(os.Stderr, "Not using the new rule bundle: %s\n", err)
+			continue
+		}
+
+		reload()
+	}
+}
+
+func fetchBundle() ([]byte, []byte, error) {
+	client := &http.Client{Timeout: REMOTE_TIMEOUT}
+
+	data, err := fetch(client, remote.url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signature, err := fetch(client, remote.url+".minisig")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, signature, nil
+}
+
+func fetch(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	// A truncated bundle fails verification
+	return ioutil.ReadAll(io.LimitReader(resp.Body, REMOTE_MAX_SIZE))
+}
+
+func loadCachedBundle() error {
+	data, err := ioutil.ReadFile(remote.cache)
+	if err != nil {
+		return err
+	}
+
+	signature, err := ioutil.ReadFile(remote.cache + ".minisig")
+	if err != nil {
+		return err
+	}
+
+	return useBundle(data, signature, false)
+}
+
+// Verify and parse the bundle, and cache it when it was fetched
+func useBundle(data, signature []byte, fetched bool) error {
+	if err := remote.key.verify(data, signature); err != nil {
+		return err
+	}
+
+	var bundle ruleBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return fmt.Errorf("parsing rule bundle: %s", err)
+	}
+
+	if fetched {
+		if err := writeCache(remote.cache+".minisig", signature); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not cache rule bundle: %s\n", err)
+		} else if err := writeCache(remote.cache, data); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not cache rule bundle: %s\n", err)
+		}
+	}
+
+	remote.Lock()
+	remote.data = data
+	remote.bundle = &bundle
+	remote.version = bundleVersion(data)
+	remote.Unlock()
+
+	return nil
+}
+
+// The start of the SHA-256 of the bundle, to tell versions apart in metrics
+func bundleVersion(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// Replace the file at once, so it's never read half written
+func writeCache(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Extra fields holding the requested URL or path, and the user agent, the first one present is used
+var (
+	urlFields       = []string{"Request_Url", "Request_Path", "Url", "url", "request_uri"}
+	userAgentFields = []string{"User_Agent", "UserAgent", "user_agent", "HTTP_USER_AGENT"}
+)
+
+// Path segments which are an identifier rather than part of the route
+var routeIdentifier = regexp.MustCompile("^([0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,}|[0-9A-Za-z_-]*[0-9][0-9A-Za-z_-]*[A-Za-z][0-9A-Za-z_-]{10,})$")
+
+var bots = []string{"bot", "crawler", "spider", "slurp", "curl/", "wget/", "python-requests", "go-http-client", "okhttp", "java/"}
+
+// First match wins, so more specific tokens go first
+var (
+	browsers = [][2]string{
+		{"Edg/", "Edge"},
+		{"Edge/", "Edge"},
+		{"OPR/", "Opera"},
+		{"SamsungBrowser/", "Samsung Internet"},
+		{"Chromium/", "Chromium"},
+		{"Chrome/", "Chrome"},
+		{"CriOS/", "Chrome"},
+		{"Firefox/", "Firefox"},
+		{"FxiOS/", "Firefox"},
+		{"MSIE ", "Internet Explorer"},
+		{"Trident/", "Internet Explorer"},
+		{"Safari/", "Safari"},
+	}
+	operatingSystems = [][2]string{
+		{"Windows NT", "Windows"},
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iOS"},
+		{"CrOS", "Chrome OS"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// Split request URLs into path, route and number of query parameters, and the user agent into browser and OS
+func decomposeRequest(extra map[string]interface{}) {
+	if raw := firstString(extra, urlFields); "" != raw {
+		if u, err := url.Parse(raw); err == nil {
+			query := u.RawQuery
+			if q, ok := extra["Query_String"].(string); ok && "" == query {
+				query = strings.TrimPrefix(q, "?")
+			}
+
+			extra["Url_Path"] = u.Path
+			extra["Url_Route"] = normalizeRoute(u.Path)
+			extra["Url_Query_Params"] = countQueryParams(query)
+		}
+	}
+
+	if ua := firstString(extra, userAgentFields); "" != ua {
+		extra["User_Agent_Bot"] = isBot(ua)
+		extra["User_Agent_Browser"] = lookupToken(ua, browsers)
+		extra["User_Agent_Os"] = lookupToken(ua, operatingSystems)
+	}
+}
+
+func firstString(extra map[string]interface{}, names []string) string {
+	for _, name := range names {
+		if value, ok := extra[name].(string); ok && "" != value {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// Replace identifiers in the path by :id, so /user/42/orders and /user/43/orders have the same route
+func normalizeRoute(path string) string {
+	segments := strings.Split(path, "/")
+	for idx, segment := range segments {
+		if routeIdentifier.MatchString(segment) {
+			segments[idx] = ":id"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func countQueryParams(query string) int {
+	count := 0
+	for _, param := range strings.Split(query, "&") {
+		if "" != param {
+			count++
+		}
+	}
+
+	return count
+}
+
+func isBot(ua string) bool {
+	lower := strings.ToLower(ua)
+	for _, token := range bots {
+		if strings.Contains(lower, token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func lookupToken(ua string, tokens [][2]string) string {
+	for _, token := range tokens {
+		if strings.Contains(ua, token[0]) {
+			return token[1]
+		}
+	}
+
+	return "Other"
+}
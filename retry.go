@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/DECK36/go-gelf/gelf"
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+// How long messages are retried when no server accepts them, set by the options
+var retry = journal2gelf.DefaultRetryPolicy()
+
+// Writes messages by send, so retry can be used for messages which don't come from the forwarder
+type sender struct{}
+
+func (sender) WriteMessage(message *gelf.Message) error {
+	return send(message)
+}
+
+// Messages which aren't entries of the journal, retried until retry.Timeout passed like the forwarder does
+func deliver(message *gelf.Message) {
+	if err := retry.Write(sender{}, message); err != nil {
+		dropped(message, err)
+	}
+}
+
+// Write the message once. Security events go to their own servers when set, through their own buffer and
+// without the spool and fallback file, which retry by themselves like the spool does. Only the error of
+// the servers is returned, to be retried by the caller
+func send(message *gelf.Message) error {
+	if security != nil && isSecurityEvent(message) {
+		securityOut.submit(func() {
+			if err := retry.Write(security, message); err != nil {
+				countDropped(message)
+				fmt.Fprintf(os.Stderr, "Dropping security event after retrying for %s: %s\n", retry.Timeout, err)
+				return
+			}
+			countSent(message)
+		})
+		return nil
+	}
+
+	if spooler != nil {
+		spooler.send(message)
+		return nil
+	}
+
+	if err := writer.WriteMessage(message); err != nil {
+		return err
+	}
+
+	countSent(message)
+	return nil
+}
+
+// Messages no server accepted within retry.Timeout are kept in the fallback file, or else dropped
+func dropped(message *gelf.Message, err error) {
+	if errors.Is(err, errTooLarge) {
+		countDropped(message)
+		fmt.Fprintf(os.Stderr, "Dropping message: %s\n", err)
+		return
+	}
+
+	if fallback != nil && fallback.keep(message) {
+		return
+	}
+
+	countDropped(message)
+	fmt.Fprintf(os.Stderr, "Dropping message after retrying for %s: %s\n", retry.Timeout, err)
+}
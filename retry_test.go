@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+// Fails every write, like servers which are all down
+type downWriter struct {
+	attempts int32
+}
+
+func (this *downWriter) WriteMessage(message *gelf.Message) error {
+	atomic.AddInt32(&this.attempts, 1)
+	return errNoEndpoint
+}
+
+func (this *downWriter) Close() {}
+
+func TestForwarderDropsOnce(t *testing.T) {
+	w := &downWriter{}
+	savedWriter, savedRetry := writer, retry
+	defer func() { writer, retry = savedWriter, savedRetry }()
+	writer = w
+	retry = journal2gelf.RetryPolicy{Base: 10 * time.Millisecond, Max: 10 * time.Millisecond, Timeout: 50 * time.Millisecond}
+
+	forwarder := journal2gelf.NewForwarder(&deliveryWriter{})
+	forwarder.Retry = retry
+	forwarder.Dropped = forwarderDropped
+	forwarder.Start()
+
+	entry, err := journal2gelf.NewEntry("lost").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := atomic.LoadUint64(&metrics.entriesDropped)
+	started := time.Now()
+	forwarder.Add(entry)
+	forwarder.Close()
+	elapsed := time.Since(started)
+
+	if n := atomic.LoadUint64(&metrics.entriesDropped) - dropped; 1 != n {
+		t.Errorf("counted %d dropped messages, want 1", n)
+	}
+
+	// A second retry layer would retry every attempt of the first for the whole timeout
+	if elapsed > 4*retry.Timeout || w.attempts > 10 {
+		t.Errorf("dropped after %s and %d attempts, want about %s and at most 10", elapsed, w.attempts, retry.Timeout)
+	}
+}
+
+func TestDeliveryWriterReturnsError(t *testing.T) {
+	saved := writer
+	defer func() { writer = saved }()
+	writer = &downWriter{}
+
+	if err := (&deliveryWriter{}).WriteMessage(&gelf.Message{Short: "lost"}); !errors.Is(err, errNoEndpoint) {
+		t.Errorf("error %v, want %v for the forwarder to retry", err, errNoEndpoint)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+const (
+	S3_MAX_UPLOADS  = 16
+	S3_UPLOAD_TRIES = 5
+)
+
+// Batches messages into gzip compressed NDJSON or Parquet objects, uploaded to S3 compatible storage in the
+// background. Messages are grouped by the key template, so each object only holds messages of one host,
+// unit or date when those are part of the key. An object is uploaded when it reaches maxSize bytes
+// before compression, or maxAge after its first message
+type s3Archive struct {
+	sync.Mutex
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	template  string
+	format    string
+	maxSize   int
+	maxAge    time.Duration
+	batches   map[string]*s3Batch
+	uploads   chan *s3Batch
+	done      sync.WaitGroup
+	client    *http.Client
+	sequence  int
+}
+
+type s3Batch struct {
+	key     string
+	started time.Time
+	size    int
+	data    bytes.Buffer
+	writer  batchWriter
+}
+
+type batchWriter interface {
+	WriteMessage(message *gelf.Message) error
+	Close() error
+}
+
+// One message per line, gzip compressed
+type ndjsonWriter struct {
+	gz *gzip.Writer
+}
+
+func (this *ndjsonWriter) WriteMessage(message *gelf.Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	this.gz.Write(data)
+	_, err = this.gz.Write([]byte{'\n'})
+	return err
+}
+
+func (this *ndjsonWriter) Close() error {
+	return this.gz.Close()
+}
+
+func newS3Archive(endpoint, region, template, format string, maxSize int, maxAge time.Duration) (*s3Archive, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if "" == u.Host || ("http" != u.Scheme && "https" != u.Scheme) {
+		return nil, fmt.Errorf("invalid url %q, expected https://host/bucket", endpoint)
+	}
+
+	this := &s3Archive{
+		endpoint:  u,
+		region:    region,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		template:  template,
+		format:    format,
+		maxSize:   maxSize,
+		maxAge:    maxAge,
+		batches:   map[string]*s3Batch{},
+		uploads:   make(chan *s3Batch, S3_MAX_UPLOADS),
+		client:    &http.Client{Timeout: time.Minute},
+	}
+
+	if "ndjson" != format && "parquet" != format {
+		return nil, fmt.Errorf("invalid format %q, expected ndjson or parquet", format)
+	}
+
+	if "" == this.accessKey || "" == this.secretKey {
+		return nil, fmt.Errorf("set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	this.done.Add(1)
+	go this.upload()
+	go this.roll()
+
+	return this, nil
+}
+
+// Expand {host}, {unit}, {identifier}, {date}, {year}, {month}, {day} and {hour} for a message
+func (this *s3Archive) prefix(entry *SystemdJournalEntry, message *gelf.Message) string {
+	t := time.Unix(0, int64(message.TimeUnix*1000*1000*1000)).UTC()
+
+	clean := func(value string) string {
+		if "" == value {
+			return "unknown"
+		}
+		return strings.Replace(value, "/", "_", -1)
+	}
+
+	return strings.NewReplacer(
+		"{host}", clean(message.Host),
+		"{unit}", clean(entry.Systemd_unit),
+		"{identifier}", clean(message.Facility),
+		"{date}", t.Format("2006-01-02"),
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+		"{hour}", t.Format("15"),
+	).Replace(this.template)
+}
+
+func (this *s3Archive) add(entry *SystemdJournalEntry, message *gelf.Message) {
+	// The size as JSON is used for both formats, to roll objects at roughly the same amount of messages
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+
+	prefix := this.prefix(entry, message)
+
+	this.Lock()
+	defer this.Unlock()
+
+	batch, ok := this.batches[prefix]
+	if !ok {
+		this.sequence++
+		batch = &s3Batch{started: time.Now()}
+		name := fmt.Sprintf("%s-%s-%d", prefix, time.Now().UTC().Format("20060102T150405Z"), this.sequence)
+
+		if "parquet" == this.format {
+			batch.key = name + ".parquet"
+			if batch.writer, err = newParquetWriter(&batch.data); err != nil {
+				return
+			}
+		} else {
+			batch.key = name + ".ndjson.gz"
+			batch.writer = &ndjsonWriter{gz: gzip.NewWriter(&batch.data)}
+		}
+
+		this.batches[prefix] = batch
+	}
+
+	if err := batch.writer.WriteMessage(message); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not archive message: %s\n", err)
+		return
+	}
+	batch.size += len(data) + 1
+
+	if batch.size >= this.maxSize {
+		this.finish(prefix, batch)
+	}
+}
+
+// Hand a complete batch to the uploader, must be called with the lock held. When the uploads can't keep
+// up the batch is dropped, to not hold up sending to Graylog
+func (this *s3Archive) finish(prefix string, batch *s3Batch) {
+	delete(this.batches, prefix)
+	batch.writer.Close()
+
+	select {
+	case this.uploads <- batch:
+	default:
+		fmt.Fprintf(os.Stderr, "Too many pending S3 uploads, dropping %s\n", batch.key)
+	}
+}
+
+func (this *s3Archive) roll() {
+	for range time.Tick(time.Second) {
+		this.Lock()
+		for prefix, batch := range this.batches {
+			if time.Since(batch.started) >= this.maxAge {
+				this.finish(prefix, batch)
+			}
+		}
+		this.Unlock()
+	}
+}
+
+func (this *s3Archive) upload() {
+	defer this.done.Done()
+
+	for batch := range this.uploads {
+		for try := 1; ; try++ {
+			err := this.put(batch.key, batch.data.Bytes())
+			if nil == err {
+				break
+			}
+
+			if try == S3_UPLOAD_TRIES {
+				fmt.Fprintf(os.Stderr, "Giving up on uploading %s: %s\n", batch.key, err)
+				break
+			}
+
+			fmt.Fprintf(os.Stderr, "Could not upload %s, retrying: %s\n", batch.key, err)
+			time.Sleep(SLEEP_AFTER_ERROR)
+		}
+	}
+}
+
+func (this *s3Archive) put(key string, data []byte) error {
+	u := *this.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	u.RawPath = s3EscapePath(u.Path)
+
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if "parquet" == this.format {
+		req.Header.Set("Content-Type", "application/vnd.apache.parquet")
+	} else {
+		req.Header.Set("Content-Type", "application/gzip")
+	}
+
+	hash := sha256.Sum256(data)
+	signS3Request(req, hex.EncodeToString(hash[:]), this.region, this.accessKey, this.secretKey, this.token, time.Now())
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var body bytes.Buffer
+		body.ReadFrom(resp.Body)
+		return fmt.Errorf("%s: %.200s", resp.Status, body.String())
+	}
+
+	return nil
+}
+
+// Upload all open batches and wait for the uploads to finish
+func (this *s3Archive) Close() {
+	this.Lock()
+	batches := this.batches
+	this.batches = map[string]*s3Batch{}
+	this.Unlock()
+
+	for _, batch := range batches {
+		batch.writer.Close()
+		this.uploads <- batch
+	}
+	close(this.uploads)
+
+	this.done.Wait()
+}
+
+// Sign the request with AWS signature version 4, using host and all headers set on the request
+func signS3Request(req *http.Request, payloadHash, region, accessKey, secretKey, token string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if "" != token {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	request := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonical.String(), signed, payloadHash}, "\n")
+	requestHash := sha256.Sum256([]byte(request))
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signed, hex.EncodeToString(hmacSha256(key, toSign))))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// S3 expects everything except unreserved characters and the slashes to be percent encoded
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+// A message of a login, authentication or privilege change, by the identifiers logging it. The named
+// subpatterns Actor, Target, Source and Command fill the fields of the same name
+type securityPattern struct {
+	identifiers stringList
+	action      string
+	outcome     string
+	re          *regexp.Regexp
+}
+
+// PAM messages are logged by whichever program uses it, so they match any identifier
+var securityPatterns = []securityPattern{
+	// Accepted publickey for alice from 203.0.113.5 port 52114 ssh2
+	{[]string{"sshd", "sshd-session"}, "login", "success", regexp.MustCompile(`^Accepted \S+ for (?P<Actor>\S+) from (?P<Source>\S+) port`)},
+	// Failed password for invalid user bob from 203.0.113.5 port 52114 ssh2
+	{[]string{"sshd", "sshd-session"}, "login", "failure", regexp.MustCompile(`^Failed \S+ for (?:invalid user )?(?P<Actor>\S+) from (?P<Source>\S+) port`)},
+	// Invalid user bob from 203.0.113.5 port 52114
+	{[]string{"sshd", "sshd-session"}, "login", "failure", regexp.MustCompile(`^Invalid user (?P<Actor>\S*) from (?P<Source>\S+)`)},
+	// alice : 3 incorrect password attempts ; TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/usr/bin/id
+	{[]string{"sudo"}, "sudo", "failure", regexp.MustCompile(`^\s*(?P<Actor>\S+) : (?:\d+ incorrect password attempts?|user NOT in sudoers|command not allowed) ; .*USER=(?P<Target>\S+) ; COMMAND=(?P<Command>.*)$`)},
+	// alice : TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/usr/bin/id
+	{[]string{"sudo"}, "sudo", "success", regexp.MustCompile(`^\s*(?P<Actor>\S+) : TTY=.*USER=(?P<Target>\S+) ; COMMAND=(?P<Command>.*)$`)},
+	// New session 3 of user alice.
+	{[]string{"systemd-logind"}, "session_open", "success", regexp.MustCompile(`^New session \S+ of user (?P<Target>.+?)\.?$`)},
+	// pam_unix(su:session): session opened for user root(uid=0) by alice(uid=1000)
+	{nil, "session_open", "success", regexp.MustCompile(`^pam_unix\([^:]+:session\): session opened for user (?P<Target>[^\s(]+)(?:\(uid=\d+\))? by (?P<Actor>[^\s(]*)`)},
+	// pam_unix(sshd:session): session closed for user alice
+	{nil, "session_close", "success", regexp.MustCompile(`^pam_unix\([^:]+:session\): session closed for user (?P<Target>\S+)`)},
+	// pam_unix(sshd:auth): authentication failure; logname= uid=0 euid=0 tty=ssh ruser= rhost=203.0.113.5  user=alice
+	{nil, "authenticate", "failure", regexp.MustCompile(`^pam_unix\([^:]+:auth\): authentication failure; logname=(?P<Actor>\S*) .*rhost=(?P<Source>\S*)(?:\s+user=(?P<Target>\S+))?`)},
+}
+
+var securityFields = map[string]string{"Actor": "actor", "Target": "target", "Source": "source_ip", "Command": "command"}
+
+// Recognize logins, authentication failures, sudo and sessions, and describe them with the same fields
+// whichever program logged them. They're tagged with the stream field, so Graylog can route them to the
+// stream of the security team
+func recognizeSecurityEvent(entry *SystemdJournalEntry) {
+	for _, pattern := range securityPatterns {
+		if nil != pattern.identifiers && !pattern.identifiers.contains(entry.Syslog_identifier) {
+			continue
+		}
+
+		m := pattern.re.FindStringSubmatch(entry.Message)
+		if nil == m {
+			continue
+		}
+
+		entry.SetField("stream", *securityStream)
+		entry.SetField("action", pattern.action)
+		entry.SetField("outcome", pattern.outcome)
+
+		for i, name := range pattern.re.SubexpNames() {
+			if field, ok := securityFields[name]; ok {
+				entry.SetField(field, m[i])
+			}
+		}
+
+		return
+	}
+}
+
+// Security events are sent on their own, not merged with other lines of the process
+func isSecurityEntry(entry *SystemdJournalEntry) bool {
+	return *securityStream == entry.Fields["stream"]
+}
+
+func isSecurityEvent(message *gelf.Message) bool {
+	return *securityStream == message.Extra["stream"]
+}
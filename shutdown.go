@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	SHUTDOWN_TIMEOUT = 10 * time.Second
+	JOURNALCTL_GRACE = 3 * time.Second
+)
+
+var shuttingDown int32
+
+// Closed on the first signal, for what waits on something else than journalctl
+var shutdown = make(chan struct{})
+
+// On SIGTERM or SIGINT stop journalctl, so the main loop ends and flushes the pending entry. When that takes
+// too long, for example because the server is unreachable, or on a second signal exit immediately
+func handleSignals(journal *journalctl) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-signals
+	fmt.Fprintf(os.Stderr, "Received %s, shutting down\n", sig)
+	atomic.StoreInt32(&shuttingDown, 1)
+	close(shutdown)
+
+	journal.signal(syscall.SIGTERM)
+	kill := time.AfterFunc(JOURNALCTL_GRACE, journal.kill)
+	defer kill.Stop()
+
+	select {
+	case sig = <-signals:
+		fmt.Fprintf(os.Stderr, "Received %s again, exiting immediately\n", sig)
+	case <-time.After(SHUTDOWN_TIMEOUT):
+		fmt.Fprintln(os.Stderr, "Shutdown timed out, exiting")
+	}
+
+	os.Exit(1)
+}
+
+func isShuttingDown() bool {
+	return 1 == atomic.LoadInt32(&shuttingDown)
+}
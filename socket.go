@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+// Entries are handled one at a time, whether read from the journal or the socket. Held while calling handleEntry
+var entryLock sync.Mutex
+
+// Other programs on the host hand entries to the socket, as lines of journalctl --output=json like the
+// Shipper of the journal2gelf package writes them. Every entry is answered with ok, or the reason it was
+// rejected, once the forwarder has it
+type entrySocket struct {
+	listener  net.Listener
+	forwarder *journal2gelf.Forwarder
+	maxLine   int
+	closed    bool
+}
+
+// Only root and the group of the socket may write entries
+const SOCKET_MODE = 0660
+
+func listenSocket(path string, forwarder *journal2gelf.Forwarder, maxLine int) (*entrySocket, error) {
+	this, err := openSocket(path, forwarder, maxLine)
+	if err != nil {
+		return nil, err
+	}
+
+	go this.accept()
+	return this, nil
+}
+
+func openSocket(path string, forwarder *journal2gelf.Forwarder, maxLine int) (*entrySocket, error) {
+	// Left behind when the previous run was killed
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, SOCKET_MODE); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &entrySocket{listener: listener, forwarder: forwarder, maxLine: maxLine}, nil
+}
+
+func (this *entrySocket) accept() {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go this.serve(conn.(*net.UnixConn))
+	}
+}
+
+func (this *entrySocket) serve(conn *net.UnixConn) {
+	defer conn.Close()
+
+	cred, err := peerCredentials(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get the credentials of a socket client: %s\n", err)
+		return
+	}
+
+	s := bufio.NewScanner(conn)
+	s.Buffer(make([]byte, 64*1024), this.maxLine)
+
+	for s.Scan() {
+		atomic.AddUint64(&metrics.entriesRead, 1)
+
+		entry, err := journal2gelf.ParseEntryWith(s.Bytes(), parseOptions)
+		if err != nil {
+			atomic.AddUint64(&metrics.parseErrors, 1)
+			fmt.Fprintf(conn, "%s\n", err)
+			continue
+		}
+
+		if !this.handle(entry, cred, "shipper") {
+			fmt.Fprintln(conn, "shutting down")
+			return
+		}
+
+		fmt.Fprintln(conn, "ok")
+	}
+}
+
+// Like journald, the process is taken from the connection rather than from what the client claims
+func (this *entrySocket) handle(entry *SystemdJournalEntry, cred *syscall.Ucred, transport string) bool {
+	entry.Pid = strconv.Itoa(int(cred.Pid))
+	entry.Uid = strconv.Itoa(int(cred.Uid))
+	entry.Gid = strconv.Itoa(int(cred.Gid))
+	entry.Transport = transport
+
+	if 0 == entry.Realtime_timestamp {
+		entry.Realtime_timestamp = time.Now().UnixNano() / 1000
+	}
+
+	if "" == entry.Hostname {
+		entry.Hostname, _ = os.Hostname()
+	}
+
+	entryLock.Lock()
+	defer entryLock.Unlock()
+
+	if this.closed {
+		return false
+	}
+
+	handleEntry(entry, this.forwarder)
+	return true
+}
+
+func peerCredentials(conn *net.UnixConn) (*syscall.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if nil == err {
+		err = credErr
+	}
+
+	return cred, err
+}
+
+// Stop accepting entries, before the forwarder is closed
+func (this *entrySocket) Close() {
+	this.listener.Close()
+
+	entryLock.Lock()
+	this.closed = true
+	entryLock.Unlock()
+}
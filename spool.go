@@ -0,0 +1,572 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+const (
+	SPOOL_HEADER_SIZE   = 8
+	SPOOL_POSITION_FILE = "position"
+	SPOOL_SAVE_INTERVAL = 100
+	SPOOL_COMPACT_EVERY = time.Minute
+
+	// Far more than a GELF message can be, a longer record is corrupt
+	SPOOL_MAX_RECORD = 64 * 1024 * 1024
+)
+
+// Messages which couldn't be sent are appended to segment files in the spool directory, and sent by a
+// background goroutine once the server is reachable again. Each record is prefixed by its length and
+// checksum, so a partially written record after a crash is detected and truncated when opening the spool.
+// The read position is saved in a separate file to resume after a restart. Messages spooled more than
+// maxAge ago are skipped when read, and segments which only contain those are removed in the background.
+// Age is by the time of spooling, not the time of the message, so replayed old entries aren't skipped
+type spool struct {
+	sync.Mutex
+	dir         string
+	maxSize     int64
+	maxAge      time.Duration
+	segmentSize int64
+	segments    []*spoolSegment
+	current     *os.File
+	reader      *os.File
+	readOffset  int64
+	peeked      *spoolSegment
+	unsaved     int
+	wake        chan struct{}
+}
+
+type spoolSegment struct {
+	name string
+	size int64
+}
+
+// The gelf.Message with its Extra fields, which the GELF library leaves out when unmarshalling
+type spoolRecord struct {
+	Version  string                 `json:"version"`
+	Host     string                 `json:"host"`
+	Short    string                 `json:"short_message"`
+	Full     string                 `json:"full_message"`
+	TimeUnix float64                `json:"timestamp"`
+	Level    int32                  `json:"level"`
+	Facility string                 `json:"facility"`
+	Extra    map[string]interface{} `json:"extra"`
+	Spooled  float64                `json:"spooled,omitempty"`
+}
+
+var errSpoolCorrupt = errors.New("corrupt record")
+
+func openSpool(dir string, maxSize int64, maxAge time.Duration) (*spool, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	this := &spool{
+		dir:         dir,
+		maxSize:     maxSize,
+		maxAge:      maxAge,
+		segmentSize: maxSize / 16,
+		wake:        make(chan struct{}, 1),
+	}
+
+	if this.segmentSize < 1024*1024 {
+		this.segmentSize = 1024 * 1024
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		size, err := recoverSegment(name)
+		if err != nil {
+			return nil, err
+		}
+
+		this.segments = append(this.segments, &spoolSegment{name: name, size: size})
+	}
+
+	this.loadPosition()
+
+	return this, nil
+}
+
+// Scan all records and truncate the segment after the last valid one
+func recoverSegment(name string) (int64, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var offset int64
+	for {
+		_, next, err := readSpoolRecord(f, offset)
+		if err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Truncating spool segment %s at %d: %s\n", name, offset, err)
+			return offset, f.Truncate(offset)
+		}
+
+		offset = next
+	}
+}
+
+func readSpoolRecord(f *os.File, offset int64) ([]byte, int64, error) {
+	var header [SPOOL_HEADER_SIZE]byte
+	if n, err := f.ReadAt(header[:], offset); err == io.EOF && n == 0 {
+		return nil, 0, io.EOF
+	} else if err != nil {
+		return nil, 0, errSpoolCorrupt
+	}
+
+	// Check the length before allocating it, a corrupt one could be gigabytes
+	length := int64(binary.LittleEndian.Uint32(header[0:4]))
+	if length > SPOOL_MAX_RECORD {
+		return nil, 0, errSpoolCorrupt
+	}
+	if info, err := f.Stat(); err != nil || offset+SPOOL_HEADER_SIZE+length > info.Size() {
+		return nil, 0, errSpoolCorrupt
+	}
+
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset+SPOOL_HEADER_SIZE); err != nil {
+		return nil, 0, errSpoolCorrupt
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, 0, errSpoolCorrupt
+	}
+
+	return data, offset + SPOOL_HEADER_SIZE + int64(len(data)), nil
+}
+
+func (this *spool) loadPosition() {
+	data, err := ioutil.ReadFile(filepath.Join(this.dir, SPOOL_POSITION_FILE))
+	if err != nil {
+		return
+	}
+
+	parts := strings.Fields(string(data))
+	if len(parts) != 2 {
+		return
+	}
+
+	// Segments before the saved one were already sent completely
+	for len(this.segments) > 0 && filepath.Base(this.segments[0].name) < parts[0] {
+		os.Remove(this.segments[0].name)
+		this.segments = this.segments[1:]
+	}
+
+	if len(this.segments) > 0 && filepath.Base(this.segments[0].name) == parts[0] {
+		this.readOffset, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+}
+
+func (this *spool) savePosition() {
+	this.unsaved = 0
+
+	name := ""
+	if len(this.segments) > 0 {
+		name = filepath.Base(this.segments[0].name)
+	}
+
+	file := filepath.Join(this.dir, SPOOL_POSITION_FILE)
+	if err := ioutil.WriteFile(file+".tmp", []byte(fmt.Sprintf("%s %d\n", name, this.readOffset)), 0640); err == nil {
+		os.Rename(file+".tmp", file)
+	}
+}
+
+// Send directly while nothing is spooled, otherwise queue behind the spooled messages to keep them in order
+func (this *spool) send(message *gelf.Message) {
+	// Severe messages don't wait for the spooled ones while the server is reachable
+	empty := this.empty()
+	if empty || isImmediate(message) {
+		err := writer.WriteMessage(message)
+		if err == nil {
+			countSent(message)
+			return
+		}
+
+		if errors.Is(err, errTooLarge) {
+			countDropped(message)
+			fmt.Fprintln(os.Stderr, "Dropping message: "+err.Error())
+			return
+		}
+
+		if empty {
+			fmt.Fprintln(os.Stderr, "Spooling messages because of: "+err.Error())
+		}
+	}
+
+	if err := this.append(message); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not spool message: "+err.Error())
+		if fallback != nil {
+			fallback.keep(message)
+		}
+	}
+}
+
+func (this *spool) empty() bool {
+	this.Lock()
+	defer this.Unlock()
+
+	return 0 == len(this.segments) || (1 == len(this.segments) && this.readOffset >= this.segments[0].size)
+}
+
+func newSpoolRecord(message *gelf.Message) *spoolRecord {
+	return &spoolRecord{
+		Version:  message.Version,
+		Host:     message.Host,
+		Short:    message.Short,
+		Full:     message.Full,
+		TimeUnix: message.TimeUnix,
+		Level:    message.Level,
+		Facility: message.Facility,
+		Extra:    message.Extra,
+	}
+}
+
+func (this *spoolRecord) message() *gelf.Message {
+	return &gelf.Message{
+		Version:  this.Version,
+		Host:     this.Host,
+		Short:    this.Short,
+		Full:     this.Full,
+		TimeUnix: this.TimeUnix,
+		Level:    this.Level,
+		Facility: this.Facility,
+		Extra:    this.Extra,
+	}
+}
+
+func (this *spool) append(message *gelf.Message) error {
+	spooled := newSpoolRecord(message)
+	spooled.Spooled = float64(time.Now().UnixNano()/1000) / 1000 / 1000
+
+	data, err := json.Marshal(spooled)
+	if err != nil {
+		return err
+	}
+	if len(data) > SPOOL_MAX_RECORD {
+		return fmt.Errorf("message of %d bytes is too large to spool", len(data))
+	}
+
+	record := make([]byte, SPOOL_HEADER_SIZE+len(data))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[SPOOL_HEADER_SIZE:], data)
+
+	this.Lock()
+	defer this.Unlock()
+
+	if nil == this.current || this.segments[len(this.segments)-1].size >= this.segmentSize {
+		if err := this.rotate(); err != nil {
+			return err
+		}
+	}
+
+	// Drop the oldest messages when full, but never the segment being written
+	for len(this.segments) > 1 && this.size()+int64(len(record)) > this.maxSize {
+		fmt.Fprintf(os.Stderr, "Spool is full, dropping %s\n", this.segments[0].name)
+		atomic.AddUint64(&metrics.spoolDropped, this.remaining())
+		if fallback != nil {
+			this.rescue()
+		}
+		this.removeOldest()
+	}
+
+	last := this.segments[len(this.segments)-1]
+	n, err := this.current.Write(record)
+	last.size += int64(n)
+
+	// Don't leave a partial record behind, the next append would be unreadable
+	if err != nil {
+		this.current.Truncate(last.size - int64(n))
+		last.size -= int64(n)
+		return err
+	}
+
+	select {
+	case this.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (this *spool) size() int64 {
+	var size int64
+	for _, segment := range this.segments {
+		size += segment.size
+	}
+
+	return size - this.readOffset
+}
+
+func (this *spool) rotate() error {
+	if nil != this.current {
+		this.current.Close()
+	}
+
+	name := filepath.Join(this.dir, fmt.Sprintf("%020d.spool", time.Now().UnixNano()))
+	if len(this.segments) > 0 && name <= this.segments[len(this.segments)-1].name {
+		return fmt.Errorf("clock went backwards, not creating %s", name)
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+
+	this.current = f
+	this.segments = append(this.segments, &spoolSegment{name: name})
+	return nil
+}
+
+func (this *spool) removeOldest() {
+	if nil != this.reader {
+		this.reader.Close()
+		this.reader = nil
+	}
+
+	if 1 == len(this.segments) && nil != this.current {
+		this.current.Close()
+		this.current = nil
+	}
+
+	os.Remove(this.segments[0].name)
+	this.segments = this.segments[1:]
+	this.readOffset = 0
+	this.savePosition()
+}
+
+// Count the records in the oldest segment which haven't been sent yet
+func (this *spool) remaining() uint64 {
+	f, err := os.Open(this.segments[0].name)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	var count uint64
+	for offset := this.readOffset; ; count++ {
+		var header [SPOOL_HEADER_SIZE]byte
+		if _, err := f.ReadAt(header[:], offset); err != nil {
+			return count
+		}
+
+		offset += SPOOL_HEADER_SIZE + int64(binary.LittleEndian.Uint32(header[0:4]))
+	}
+}
+
+// Keep the severe messages of the oldest segment in the fallback file before it's dropped
+func (this *spool) rescue() {
+	f, err := os.Open(this.segments[0].name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	for offset := this.readOffset; ; {
+		data, next, err := readSpoolRecord(f, offset)
+		if err != nil {
+			return
+		}
+		offset = next
+
+		var record spoolRecord
+		if err := json.Unmarshal(data, &record); err == nil {
+			fallback.keep(record.message())
+		}
+	}
+}
+
+// Records spooled by older versions have no time, they're only removed with their segment
+func (this *spool) expired(spooled float64) bool {
+	return this.maxAge > 0 && spooled > 0 && time.Since(time.Unix(0, int64(spooled*1000*1000*1000))) > this.maxAge
+}
+
+// Returns the oldest spooled message and the offset to commit after sending it
+func (this *spool) peek() (*gelf.Message, int64, bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	for len(this.segments) > 0 {
+		if nil == this.reader {
+			f, err := os.Open(this.segments[0].name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Could not open spool segment: "+err.Error())
+				this.removeOldest()
+				continue
+			}
+			this.reader = f
+		}
+
+		if this.readOffset >= this.segments[0].size {
+			// The segment being written is only removed once it's complete
+			if 1 == len(this.segments) && nil != this.current && this.segments[0].size < this.segmentSize {
+				return nil, 0, false
+			}
+
+			this.removeOldest()
+			continue
+		}
+
+		data, next, err := readSpoolRecord(this.reader, this.readOffset)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping rest of spool segment %s: %s\n", this.segments[0].name, err)
+			this.removeOldest()
+			continue
+		}
+
+		var record spoolRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			this.readOffset = next
+			continue
+		}
+
+		if this.expired(record.Spooled) {
+			atomic.AddUint64(&metrics.spoolExpired, 1)
+			this.readOffset = next
+			continue
+		}
+
+		this.peeked = this.segments[0]
+		return record.message(), next, true
+	}
+
+	return nil, 0, false
+}
+
+func (this *spool) commit(offset int64) {
+	this.Lock()
+	defer this.Unlock()
+
+	// The segment may have been dropped or expired while the message was being sent
+	if 0 == len(this.segments) || this.segments[0] != this.peeked {
+		return
+	}
+
+	this.readOffset = offset
+	if this.unsaved++; this.unsaved >= SPOOL_SAVE_INTERVAL {
+		this.savePosition()
+	}
+}
+
+// Send spooled messages oldest first, retrying until the server is reachable
+func (this *spool) drain() {
+	for {
+		message, next, ok := this.peek()
+		if !ok {
+			select {
+			case <-this.wake:
+			case <-time.After(SLEEP_AFTER_ERROR):
+			}
+			continue
+		}
+
+		for {
+			err := writer.WriteMessage(message)
+			if err == nil {
+				countSent(message)
+				break
+			}
+
+			// Would block the spool forever
+			if errors.Is(err, errTooLarge) {
+				countDropped(message)
+				fmt.Fprintln(os.Stderr, "Dropping spooled message: "+err.Error())
+				break
+			}
+
+			fmt.Fprintln(os.Stderr, "Spool processing paused because of: "+err.Error())
+			time.Sleep(SLEEP_AFTER_ERROR)
+		}
+
+		this.commit(next)
+	}
+}
+
+// Periodically remove segments which were last written more than maxAge ago, so an outage doesn't fill
+// the disk with messages that will be skipped anyway
+func (this *spool) compact() {
+	if 0 == this.maxAge {
+		return
+	}
+
+	for range time.Tick(SPOOL_COMPACT_EVERY) {
+		this.Lock()
+		for len(this.segments) > 0 {
+			info, err := os.Stat(this.segments[0].name)
+			if err == nil && time.Since(info.ModTime()) <= this.maxAge {
+				break
+			}
+
+			atomic.AddUint64(&metrics.spoolExpired, this.remaining())
+			this.removeOldest()
+		}
+		this.Unlock()
+	}
+}
+
+func (this *spool) Close() {
+	this.Lock()
+	defer this.Unlock()
+
+	this.savePosition()
+
+	if nil != this.current {
+		this.current.Close()
+	}
+	if nil != this.reader {
+		this.reader.Close()
+	}
+}
+
+// Parse a size like 512M
+func parseSize(value string) (int64, error) {
+	if "" == value {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	multiplier := int64(1)
+
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1024
+	case "M":
+		multiplier = 1024 * 1024
+	case "G":
+		multiplier = 1024 * 1024 * 1024
+	}
+
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	return n * multiplier, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+// A spool of three messages with the length of the second record set to length. Returns the offset of
+// the second record
+func corruptSpool(t *testing.T, length uint32) (*spool, int64) {
+	sp, err := openSpool(t.TempDir(), 4*1024*1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, short := range []string{"first", "second", "third"} {
+		if err := sp.append(&gelf.Message{Short: short}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.OpenFile(sp.segments[0].name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var header [SPOOL_HEADER_SIZE]byte
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		t.Fatal(err)
+	}
+	offset := SPOOL_HEADER_SIZE + int64(binary.LittleEndian.Uint32(header[0:4]))
+
+	binary.LittleEndian.PutUint32(header[0:4], length)
+	if _, err := f.WriteAt(header[0:4], offset); err != nil {
+		t.Fatal(err)
+	}
+
+	return sp, offset
+}
+
+func TestSpoolCorruptLength(t *testing.T) {
+	for _, length := range []uint32{0xffffffff, SPOOL_MAX_RECORD - 1} {
+		sp, _ := corruptSpool(t, length)
+
+		message, next, ok := sp.peek()
+		if !ok || "first" != message.Short {
+			t.Fatalf("length %d: peeked %v %v, want the first message", length, message, ok)
+		}
+		sp.commit(next)
+
+		if message, _, ok := sp.peek(); ok {
+			t.Errorf("length %d: peeked %q, want the rest of the segment skipped", length, message.Short)
+		}
+
+		// Opened again after a restart, the segment is cut before the corrupt record
+		sp, offset := corruptSpool(t, length)
+		reopened, err := openSpool(sp.dir, 4*1024*1024, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if 1 != len(reopened.segments) || offset != reopened.segments[0].size {
+			t.Errorf("length %d: segments %v after opening, want one of %d bytes", length, reopened.segments, offset)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// How often the standby tries to take the lock
+const STANDBY_POLL = time.Second
+
+// Set once this instance holds the standby lock
+var leading int32
+
+var errStandbyStopped = errors.New("stopped as standby")
+
+// Two instances sharing a lock file and a checkpoint form a hot standby pair: only the one holding the
+// lock reads the journal and ships. The kernel releases the lock when the leader exits, however it exits,
+// and the standby takes over from the checkpoint the leader saved last. The file is kept open, and locked,
+// until this process exits. Returns errStandbyStopped when shut down while waiting
+func waitForLeadership(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if syscall.EWOULDBLOCK == err {
+		fmt.Fprintf(os.Stderr, "Another instance holds %s, waiting as standby\n", path)
+
+		// Polled instead of blocking, so a signal still stops the standby
+		for syscall.EWOULDBLOCK == err {
+			select {
+			case <-shutdown:
+				file.Close()
+				return nil, errStandbyStopped
+			case <-time.After(STANDBY_POLL):
+			}
+
+			err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		}
+		if nil == err {
+			fmt.Fprintln(os.Stderr, "Took over as leader")
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Only informational, to see which instance leads
+	hostname, _ := os.Hostname()
+	file.Truncate(0)
+	file.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), hostname)), 0)
+
+	atomic.StoreInt32(&leading, 1)
+	return file, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStandbyStopsOnShutdown(t *testing.T) {
+	saved := shutdown
+	defer func() { shutdown = saved }()
+	shutdown = make(chan struct{})
+
+	path := filepath.Join(t.TempDir(), "lock")
+	leader, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	if err := syscall.Flock(int(leader.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := waitForLeadership(path)
+		done <- err
+	}()
+
+	close(shutdown)
+	select {
+	case err := <-done:
+		if !errors.Is(err, errStandbyStopped) {
+			t.Errorf("error %v, want %v", err, errStandbyStopped)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("standby still waiting after shutdown")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Messages matching a status matcher are only sent when their Status subpattern differs from the previous
+// occurrence, for example health checks. Unchanged ones are counted and summarized once per interval
+type statusMatcher struct {
+	name string
+	re   *regexp.Regexp
+}
+
+type statusState struct {
+	status     string
+	suppressed int
+	last       *SystemdJournalEntry
+	since      time.Time
+	summarized time.Time
+}
+
+type statusTracker struct {
+	sync.Mutex
+	matchers []*statusMatcher
+	interval time.Duration
+	states   map[string]*statusState
+}
+
+func newStatusTracker(rules []string, interval time.Duration) (*statusTracker, error) {
+	this := &statusTracker{interval: interval, states: make(map[string]*statusState)}
+
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid status matcher %q, use name:regex", rule)
+		}
+
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid status matcher %q: %s", rule, err)
+		}
+
+		if re.SubexpIndex("Status") == -1 {
+			return nil, fmt.Errorf("status matcher %q has no (?P<Status>...) subpattern", rule)
+		}
+
+		this.matchers = append(this.matchers, &statusMatcher{name: parts[0], re: re})
+	}
+
+	return this, nil
+}
+
+// Whether the entry repeats the previous status and should be dropped. Once per interval an unchanged entry
+// is let through with the number of suppressed ones. When the status changes while entries are suppressed,
+// the summary of those is returned, to send before the entry
+func (this *statusTracker) suppress(entry *SystemdJournalEntry) (bool, *SystemdJournalEntry) {
+	for _, matcher := range this.matchers {
+		m := matcher.re.FindStringSubmatch(entry.Message)
+		if nil == m {
+			continue
+		}
+
+		return this.track(matcher.name+"\x00"+entry.Hostname+"\x00"+entry.Syslog_identifier, m[matcher.re.SubexpIndex("Status")], entry)
+	}
+
+	return false, nil
+}
+
+func (this *statusTracker) track(key, status string, entry *SystemdJournalEntry) (bool, *SystemdJournalEntry) {
+	this.Lock()
+	defer this.Unlock()
+
+	now := time.Now()
+	state, ok := this.states[key]
+
+	if !ok || state.status != status {
+		var summary *SystemdJournalEntry
+		if ok {
+			entry.SetField("Status_Previous", state.status)
+			summary = state.summary(status)
+		}
+
+		this.states[key] = &statusState{status: status, since: now, summarized: now}
+		return false, summary
+	}
+
+	if now.Sub(state.summarized) < this.interval {
+		state.suppressed++
+		state.last = entry
+		return true, nil
+	}
+
+	entry.SetField("Status_Suppressed", strconv.Itoa(state.suppressed))
+	entry.SetField("Status_Unchanged_Since", state.since.Format(time.RFC3339))
+	entry.SetField("Status_Summary", fmt.Sprintf("still %s, suppressed %d", status, state.suppressed))
+
+	state.suppressed = 0
+	state.last = nil
+	state.summarized = now
+	return false, nil
+}
+
+// The last suppressed entry with the number of suppressed ones, nil when none were
+func (this *statusState) summary(changed string) *SystemdJournalEntry {
+	if 0 == this.suppressed {
+		return nil
+	}
+
+	// Without pid it isn't merged with the changed entry
+	summary := *this.last
+	summary.Pid = ""
+	summary.Fields = make(map[string]string, len(this.last.Fields))
+	for key, value := range this.last.Fields {
+		summary.Fields[key] = value
+	}
+
+	summary.SetField("Status_Suppressed", strconv.Itoa(this.suppressed))
+	summary.SetField("Status_Unchanged_Since", this.since.Format(time.RFC3339))
+	summary.SetField("Status_Summary", fmt.Sprintf("was %s until it changed to %s, suppressed %d", this.status, changed, this.suppressed))
+
+	return &summary
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// Values in the export format larger than this are taken to be garbage rather than a field
+const EXPORT_MAX_FIELD = 64 * 1024 * 1024
+
+// Read entries from stdin instead of running journalctl, as written by journalctl --output=json or in the
+// export format of journalctl --output=export and systemd-journal-remote. The format is detected from the
+// first byte, entries in the export format are converted to JSON lines for the usual scanner
+func stdinInput() io.Reader {
+	r := bufio.NewReader(os.Stdin)
+
+	if first, err := r.Peek(1); err != nil || '{' == first[0] {
+		return r
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := convertExport(r, pw)
+		if isShuttingDown() {
+			err = nil
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+func convertExport(r *bufio.Reader, w io.Writer) error {
+	for {
+		fields, err := readExportEntry(r)
+		if io.EOF == err {
+			return nil
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping malformed journal entry: %s\n", err)
+			atomic.AddUint64(&metrics.entriesRead, 1)
+			atomic.AddUint64(&metrics.parseErrors, 1)
+
+			if errUnexpectedEOF == err {
+				return nil
+			}
+			continue
+		}
+
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+}
+
+var errUnexpectedEOF = fmt.Errorf("input ends within an entry")
+
+// Read the fields of one entry, like journalctl's JSON output a field set multiple times becomes an array
+// and a value which isn't valid UTF-8 an array of bytes. After an error the rest of the entry is skipped
+func readExportEntry(r *bufio.Reader) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	var malformed error
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			if 0 == len(fields) && nil == malformed && 0 == len(bytes.TrimSpace(line)) {
+				return nil, io.EOF
+			}
+			return nil, errUnexpectedEOF
+		}
+
+		line = line[:len(line)-1]
+		if 0 == len(line) {
+			if nil != malformed {
+				return nil, malformed
+			}
+			if 0 == len(fields) {
+				continue
+			}
+			return fields, nil
+		}
+
+		if nil != malformed {
+			continue
+		}
+
+		var key string
+		var value []byte
+		if i := bytes.IndexByte(line, '='); i >= 0 {
+			key, value = string(line[:i]), line[i+1:]
+		} else {
+			key = string(line)
+			if !isFieldName(key) {
+				malformed = fmt.Errorf("invalid field name %.100q", key)
+				continue
+			}
+
+			var size [8]byte
+			if _, err := io.ReadFull(r, size[:]); err != nil {
+				return nil, errUnexpectedEOF
+			}
+
+			n := binary.LittleEndian.Uint64(size[:])
+			if n > EXPORT_MAX_FIELD {
+				malformed = fmt.Errorf("field %.100s of %d bytes is too large", key, n)
+				continue
+			}
+
+			value = make([]byte, n+1)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return nil, errUnexpectedEOF
+			}
+			if '\n' != value[n] {
+				malformed = fmt.Errorf("field %.100s isn't followed by a newline", key)
+				continue
+			}
+			value = value[:n]
+		}
+
+		if !isFieldName(key) {
+			malformed = fmt.Errorf("invalid field name %.100q", key)
+			continue
+		}
+
+		addExportValue(fields, key, value)
+	}
+}
+
+func addExportValue(fields map[string]interface{}, key string, data []byte) {
+	var value interface{} = string(data)
+	if !utf8.Valid(data) {
+		b := make([]int, len(data))
+		for i, c := range data {
+			b[i] = int(c)
+		}
+		value = b
+	}
+
+	switch existing := fields[key].(type) {
+	case nil:
+		fields[key] = value
+	case []interface{}:
+		fields[key] = append(existing, value)
+	default:
+		fields[key] = []interface{}{existing, value}
+	}
+}
+
+// Journal field names consist of uppercase letters, digits and underscores, and don't start with a digit
+func isFieldName(key string) bool {
+	if "" == key || key[0] >= '0' && key[0] <= '9' {
+		return false
+	}
+
+	for _, c := range key {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || '_' == c) {
+			return false
+		}
+	}
+
+	return true
+}
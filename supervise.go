@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	RESTART_BACKOFF_MIN = time.Second
+	RESTART_BACKOFF_MAX = time.Minute
+)
+
+// Runs journalctl, and when following restarts it after the last entry read when it exits unexpectedly,
+// for example because journald was restarted
+type journalctl struct {
+	sync.Mutex
+	cmd      *exec.Cmd
+	args     []string
+	stdin    bool
+	follow   bool
+	cursor   string
+	read     bool
+	started  time.Time
+	backoff  time.Duration
+	restarts []time.Time
+}
+
+// With stdin set entries are read from stdin instead, which is never restarted
+func newJournalctl(args []string, stdin bool) *journalctl {
+	this := &journalctl{args: args, stdin: stdin, backoff: RESTART_BACKOFF_MIN}
+	if stdin {
+		return this
+	}
+
+	for _, arg := range args {
+		if "-f" == arg || "--follow" == arg {
+			this.follow = true
+		}
+	}
+
+	return this
+}
+
+func (this *journalctl) start() (io.Reader, error) {
+	if this.stdin {
+		return stdinInput(), nil
+	}
+
+	args := []string{"--all", "--output=json"}
+	if "" == this.cursor {
+		args = append(args, this.args...)
+	} else {
+		args = append(args, withoutPosition(this.args)...)
+		args = append(args, "--after-cursor="+this.cursor)
+	}
+
+	cmd := exec.Command("journalctl", args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	this.cmd = cmd
+	this.started = time.Now()
+	return stdout, nil
+}
+
+// Remember where to continue after a restart
+func (this *journalctl) seen(entry *SystemdJournalEntry) {
+	this.read = true
+	if "" != entry.Cursor {
+		this.cursor = entry.Cursor
+	}
+}
+
+func (this *journalctl) wait() error {
+	if this.stdin {
+		return nil
+	}
+
+	return this.cmd.Wait()
+}
+
+// Closing stdin ends reading from it, like stopping journalctl does
+func (this *journalctl) signal(sig os.Signal) {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.stdin {
+		os.Stdin.Close()
+	}
+
+	if nil != this.cmd && nil != this.cmd.Process {
+		this.cmd.Process.Signal(sig)
+	}
+}
+
+func (this *journalctl) kill() {
+	this.signal(syscall.SIGKILL)
+}
+
+// Decide whether journalctl should be started again after it exited with err, and wait before doing so.
+// Failing before the first entry is read means the arguments are wrong, that's never retried
+func (this *journalctl) restart(err error, maxPerMinute int) (bool, error) {
+	if isShuttingDown() || !this.follow || maxPerMinute <= 0 {
+		return false, err
+	}
+
+	if !this.read && err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	recent := this.restarts[:0]
+	for _, t := range this.restarts {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	this.restarts = recent
+
+	if len(this.restarts) >= maxPerMinute {
+		return false, fmt.Errorf("restarted %d times within a minute, giving up", len(this.restarts))
+	}
+
+	// A run that lasted a while was a success, start over with the shortest delay
+	if now.Sub(this.started) > RESTART_BACKOFF_MAX {
+		this.backoff = RESTART_BACKOFF_MIN
+	}
+
+	if nil == err {
+		err = fmt.Errorf("exited")
+	}
+	fmt.Fprintf(os.Stderr, "journalctl %s, restarting in %s\n", err, this.backoff)
+
+	time.Sleep(this.backoff)
+	this.restarts = append(this.restarts, time.Now())
+	if this.backoff *= 2; this.backoff > RESTART_BACKOFF_MAX {
+		this.backoff = RESTART_BACKOFF_MAX
+	}
+
+	return !isShuttingDown(), nil
+}
+
+// Leave out the arguments selecting where to start, the cursor takes their place
+func withoutPosition(args []string) []string {
+	var result []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		switch {
+		case "--cursor" == arg || "--after-cursor" == arg || "--cursor-file" == arg:
+			i++
+		case strings.HasPrefix(arg, "--cursor=") || strings.HasPrefix(arg, "--after-cursor=") || strings.HasPrefix(arg, "--cursor-file="):
+		case "--lines" == arg || strings.HasPrefix(arg, "--lines=") || strings.HasPrefix(arg, "-n"):
+			// -n optionally takes the number as the next argument
+			if "-n" == arg && i+1 < len(args) && isNumber(args[i+1]) {
+				i++
+			}
+		default:
+			result = append(result, arg)
+		}
+	}
+
+	return result
+}
+
+func isNumber(value string) bool {
+	value = strings.TrimPrefix(value, "+")
+	if "" == value {
+		return false
+	}
+
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
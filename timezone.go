@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/parse-nl/SystemdJournal2Gelf/journal2gelf"
+)
+
+// Add the --timezone and --timestamp-layout options to the rules. Only for identifiers with a timezone the
+// time from the message is used
+func setupTimezones(rules journal2gelf.Rules, zones []string, layouts []string) error {
+	for _, value := range zones {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid timezone %q, use identifier=zone", value)
+		}
+
+		location, err := time.LoadLocation(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q: %s", value, err)
+		}
+
+		rules.Timezones[parts[0]] = location
+	}
+
+	for _, value := range layouts {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid timestamp layout %q, use identifier=layout", value)
+		}
+
+		rules.TimestampLayouts[parts[0]] = parts[1]
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DECK36/go-gelf/gelf"
+)
+
+// Buckets of units which logged nothing for this long are forgotten
+const UNIT_BUCKET_IDLE = 10 * time.Minute
+
+// A token bucket per unit, or per identifier for entries without one, so a unit stuck in a crash loop
+// can't flood Graylog and starve everything else. Entries over the budget are dropped, and once per
+// interval a message tells how many were dropped for each unit
+type unitLimiter struct {
+	sync.Mutex
+	rate     float64
+	burst    float64
+	interval time.Duration
+	exempt   []string
+	buckets  map[string]*unitBucket
+}
+
+type unitBucket struct {
+	tokens     float64
+	last       int64
+	seen       time.Time
+	suppressed int
+	since      time.Time
+	entry      *SystemdJournalEntry
+}
+
+func newUnitLimiter(rate string, burst int, interval time.Duration, exempt []string) (*unitLimiter, error) {
+	perSecond, err := parseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+
+	if burst < 0 {
+		return nil, fmt.Errorf("invalid burst %d", burst)
+	}
+
+	// Like --rate-limit, allow a second worth of entries at once by default
+	this := &unitLimiter{rate: perSecond, burst: float64(burst), interval: interval, exempt: exempt, buckets: map[string]*unitBucket{}}
+	if 0 == burst {
+		this.burst = perSecond
+	}
+	if this.burst < 1 {
+		this.burst = 1
+	}
+
+	return this, nil
+}
+
+// A number of entries per second, minute or hour, like 500/s. Without unit it's per second
+func parseRate(value string) (float64, error) {
+	parts := strings.SplitN(value, "/", 2)
+
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q, expected a number like 500/s", value)
+	}
+
+	if 1 == len(parts) {
+		return n, nil
+	}
+
+	switch parts[1] {
+	case "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	}
+
+	return 0, fmt.Errorf("invalid rate %q, expected /s, /m or /h", value)
+}
+
+// Whether the entry fits in the budget of its unit. The bucket is refilled by the time between entries as
+// journald recorded it, so reading a backlog is limited the same as following the journal
+func (this *unitLimiter) allow(entry *SystemdJournalEntry) bool {
+	key := entry.Systemd_unit
+	if "" == key {
+		key = entry.Syslog_identifier
+	}
+
+	if "" == key || matchesAny(this.exempt, entry.Systemd_unit) || matchesAny(this.exempt, entry.Syslog_identifier) {
+		return true
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	bucket, ok := this.buckets[key]
+	if !ok {
+		bucket = &unitBucket{tokens: this.burst, last: entry.Realtime_timestamp}
+		this.buckets[key] = bucket
+	}
+
+	if elapsed := entry.Realtime_timestamp - bucket.last; elapsed > 0 {
+		bucket.tokens += float64(elapsed) / 1e6 * this.rate
+		if bucket.tokens > this.burst {
+			bucket.tokens = this.burst
+		}
+		bucket.last = entry.Realtime_timestamp
+	}
+	bucket.seen = time.Now()
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true
+	}
+
+	if 0 == bucket.suppressed {
+		bucket.since = bucket.seen
+	}
+	bucket.suppressed++
+	bucket.entry = entry
+
+	return false
+}
+
+// Report the dropped entries every interval, and forget idle units
+func (this *unitLimiter) run() {
+	for range time.Tick(this.interval) {
+		this.report(false)
+	}
+}
+
+// With all set every unit with dropped entries is reported, not only those suppressed for an interval
+func (this *unitLimiter) report(all bool) {
+	var messages []*gelf.Message
+	now := time.Now()
+
+	this.Lock()
+	for key, bucket := range this.buckets {
+		if bucket.suppressed > 0 && (all || now.Sub(bucket.since) >= this.interval) {
+			messages = append(messages, this.summary(key, bucket, now))
+			bucket.suppressed = 0
+			bucket.entry = nil
+		} else if 0 == bucket.suppressed && now.Sub(bucket.seen) > UNIT_BUCKET_IDLE {
+			delete(this.buckets, key)
+		}
+	}
+	this.Unlock()
+
+	for _, message := range messages {
+		deliver(message)
+	}
+}
+
+func (this *unitLimiter) summary(key string, bucket *unitBucket, now time.Time) *gelf.Message {
+	seconds := int(now.Sub(bucket.since).Seconds() + 0.5)
+	extra := map[string]interface{}{
+		"event":             "rate_limited",
+		"rate_limited_unit": key,
+		"suppressed_count":  bucket.suppressed,
+	}
+	addStaticFields(bucket.entry, extra)
+
+	return &gelf.Message{
+		Version:  "1.1",
+		Host:     host(bucket.entry),
+		Short:    fmt.Sprintf("suppressed %d messages from unit %s in the last %d seconds", bucket.suppressed, key, seconds),
+		TimeUnix: float64(now.UnixNano()/1000) / 1e6,
+		Level:    4,
+		Facility: "SystemdJournal2Gelf",
+		Extra:    extra,
+	}
+}
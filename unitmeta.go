@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// How long the properties of a unit are reused, the active state may be this much out of date
+const UNIT_METADATA_TTL = 30 * time.Second
+
+// Unit properties added to messages of that unit, and their field names
+var unitProperties = map[string]string{
+	"Description":  "unit_description",
+	"Slice":        "unit_slice",
+	"FragmentPath": "unit_fragment_path",
+	"ActiveState":  "unit_active_state",
+}
+
+// Properties of the unit of the entry, as systemd reports them over D-Bus through systemctl show
+type unitEnricher struct{}
+
+func (this unitEnricher) Key(entry *SystemdJournalEntry) string {
+	return entry.Systemd_unit
+}
+
+func (this unitEnricher) Enrich(entry *SystemdJournalEntry) map[string]interface{} {
+	return queryUnit(entry.Systemd_unit)
+}
+
+func queryUnit(unit string) map[string]interface{} {
+	names := make([]string, 0, len(unitProperties))
+	for name := range unitProperties {
+		names = append(names, name)
+	}
+
+	out, err := exec.Command("systemctl", "show", "--property="+strings.Join(names, ","), "--", unit).Output()
+	if err != nil {
+		return nil
+	}
+
+	fields := map[string]interface{}{}
+	for s := bufio.NewScanner(bytes.NewReader(out)); s.Scan(); {
+		parts := strings.SplitN(s.Text(), "=", 2)
+		if len(parts) != 2 || "" == parts[1] {
+			continue
+		}
+
+		if key, ok := unitProperties[parts[0]]; ok {
+			fields[key] = parts[1]
+		}
+	}
+
+	return fields
+}